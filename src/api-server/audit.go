@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	headerRequestID = "X-Request-Id"
+
+	defaultAuditSize = 1000
+)
+
+type auditConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Size is the number of audit events kept for /_audit, 1000 by default.
+	Size int `yaml:"size"`
+	// File receives the audit events, as JSON Lines.
+	File string `yaml:"file"`
+	// Stdout writes the audit events to the standard output, as JSON Lines.
+	Stdout bool `yaml:"stdout"`
+}
+
+// auditEvent is a change made to a record, along with the request which
+// made it.
+type auditEvent struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Caller    string    `json:"caller,omitempty"`
+	// Operation is the method and path of the request.
+	Operation  string `json:"operation,omitempty"`
+	Type       string `json:"type"`
+	Collection string `json:"collection"`
+	ObjectID   string `json:"objectId"`
+	// Patch is the JSON Patch turning the record before the change into the
+	// record after it.
+	Patch []patchOperation `json:"patch"`
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func newPatchOperation(op, path string, value interface{}) patchOperation {
+	operation := patchOperation{Op: op, Path: path}
+	if op != "remove" {
+		// Values come from decoded JSON, and always encode.
+		operation.Value, _ = json.Marshal(value)
+	}
+
+	return operation
+}
+
+// auditRequest is the request whose changes are being audited. It travels
+// in the context of the request, down to the events of its changes.
+type auditRequest struct {
+	id        string
+	caller    string
+	operation string
+}
+
+type auditRequestKey struct{}
+
+func withAuditRequest(ctx context.Context, req *auditRequest) context.Context {
+	return context.WithValue(ctx, auditRequestKey{}, req)
+}
+
+func auditRequestFromContext(ctx context.Context) *auditRequest {
+	req, _ := ctx.Value(auditRequestKey{}).(*auditRequest)
+	return req
+}
+
+// auditLog turns the changes published on the event bus into audit events,
+// attributed to the request which made them.
+type auditLog struct {
+	mu      sync.Mutex
+	enabled bool
+	size    int
+	lastID  uint64
+	entries []auditEvent
+	sinks   []io.Writer
+	// sharedSinks is set when the sinks are the ones of another log, opened
+	// once for the tenants and versions of the API.
+	sharedSinks bool
+	// states holds the last state of the records, to compute the patches.
+	states map[string]map[string]json.RawMessage
+}
+
+func (l *auditLog) configure(cfg auditConfig, data map[string]map[string]json.RawMessage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.enabled = cfg.Enabled
+	l.size = cfg.Size
+	if l.size <= 0 {
+		l.size = defaultAuditSize
+	}
+
+	if l.sharedSinks {
+		l.seed(data)
+		return nil
+	}
+
+	if cfg.Stdout {
+		l.sinks = append(l.sinks, os.Stdout)
+	}
+	if cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("audit file: %w", err)
+		}
+		l.sinks = append(l.sinks, file)
+	}
+
+	l.seed(data)
+
+	return nil
+}
+
+// shareSinks makes l write to the sinks of base rather than opening its own.
+// It must be called before configure.
+func (l *auditLog) shareSinks(base *auditLog) {
+	base.mu.Lock()
+	sinks := base.sinks
+	base.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sinks = sinks
+	l.sharedSinks = true
+}
+
+// reset starts the patches again from data, when the records are replaced
+// without events.
+func (l *auditLog) reset(data map[string]map[string]json.RawMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.enabled {
+		l.seed(data)
+	}
+}
+
+func (l *auditLog) seed(data map[string]map[string]json.RawMessage) {
+	l.states = make(map[string]map[string]json.RawMessage, len(data))
+	for objType, objs := range data {
+		l.states[objType] = make(map[string]json.RawMessage, len(objs))
+		for id, obj := range objs {
+			l.states[objType][id] = obj
+		}
+	}
+}
+
+// record audits evt. It is called by the event bus while the records are
+// locked.
+func (l *auditLog) record(evt event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.states[evt.Collection] == nil {
+		l.states[evt.Collection] = map[string]json.RawMessage{}
+	}
+	before := l.states[evt.Collection][evt.ObjectID]
+	if evt.Type == eventDeleted {
+		delete(l.states[evt.Collection], evt.ObjectID)
+	} else {
+		l.states[evt.Collection][evt.ObjectID] = evt.Object
+	}
+
+	patch, err := diffRecords(before, evt.Object)
+	if err != nil {
+		log.Printf("Unable to audit %s/%s: %v", evt.Collection, evt.ObjectID, err)
+	}
+
+	l.lastID++
+	entry := auditEvent{
+		ID:         l.lastID,
+		Time:       evt.Time,
+		Type:       evt.Type,
+		Collection: evt.Collection,
+		ObjectID:   evt.ObjectID,
+		Patch:      patch,
+	}
+	if evt.request != nil {
+		entry.RequestID = evt.request.id
+		entry.Caller = evt.request.caller
+		entry.Operation = evt.request.operation
+	}
+
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.size {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-l.size:]...)
+	}
+
+	for _, sink := range l.sinks {
+		if err := json.NewEncoder(sink).Encode(entry); err != nil {
+			log.Printf("Unable to write audit event: %v", err)
+		}
+	}
+}
+
+// query returns the audit events matching the non-empty filters.
+func (l *auditLog) query(collection, objectID, caller, typ string) []auditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []auditEvent{}
+	for _, entry := range l.entries {
+		if (collection != "" && entry.Collection != collection) ||
+			(objectID != "" && entry.ObjectID != objectID) ||
+			(caller != "" && entry.Caller != caller) ||
+			(typ != "" && entry.Type != typ) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// auditMiddleware attributes the changes made by mutating requests to their
+// caller, and identifies the requests with X-Request-Id.
+func (a *api) auditMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !a.audit.enabled || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			requestID := r.Header.Get(headerRequestID)
+			if requestID == "" {
+				requestID = uuid.New().String()
+			}
+			w.Header().Set(headerRequestID, requestID)
+
+			next.ServeHTTP(w, r.WithContext(withAuditRequest(r.Context(), &auditRequest{
+				id:        requestID,
+				caller:    a.clientIdentity(r),
+				operation: r.Method + " " + r.URL.Path,
+			})))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// handleGetAudit lists the audit events, filtered by the collection,
+// objectId, caller and type query parameters.
+func (a *api) handleGetAudit(rw http.ResponseWriter, req *http.Request) {
+	if !a.audit.enabled {
+		JSONError(rw, http.StatusNotFound, "audit is not enabled")
+		return
+	}
+
+	query := req.URL.Query()
+	writeJSONResponse(rw, http.StatusOK, a.audit.query(query.Get("collection"), query.Get("objectId"), query.Get("caller"), query.Get("type")))
+}
+
+// diffRecords returns the JSON Patch turning the before record into the
+// after one. A missing record is null.
+func diffRecords(before, after json.RawMessage) ([]patchOperation, error) {
+	var from, to interface{}
+	if len(before) > 0 {
+		if err := json.Unmarshal(before, &from); err != nil {
+			return nil, err
+		}
+	}
+	if len(after) > 0 {
+		if err := json.Unmarshal(after, &to); err != nil {
+			return nil, err
+		}
+	}
+
+	ops := []patchOperation{}
+	switch {
+	case from == nil && to == nil:
+	case from == nil:
+		ops = append(ops, newPatchOperation("add", "", to))
+	case to == nil:
+		ops = append(ops, newPatchOperation("remove", "", nil))
+	default:
+		ops = diffValues("", from, to, ops)
+	}
+
+	return ops, nil
+}
+
+func diffValues(path string, from, to interface{}, ops []patchOperation) []patchOperation {
+	fromObj, fromIsObj := from.(map[string]interface{})
+	toObj, toIsObj := to.(map[string]interface{})
+	if !fromIsObj || !toIsObj {
+		if !reflect.DeepEqual(from, to) {
+			ops = append(ops, newPatchOperation("replace", path, to))
+		}
+		return ops
+	}
+
+	keys := make([]string, 0, len(fromObj)+len(toObj))
+	for k := range fromObj {
+		keys = append(keys, k)
+	}
+	for k := range toObj {
+		if _, ok := fromObj[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := path + "/" + escapePointer(k)
+		fromValue, inFrom := fromObj[k]
+		toValue, inTo := toObj[k]
+
+		switch {
+		case !inTo:
+			ops = append(ops, newPatchOperation("remove", p, nil))
+		case !inFrom:
+			ops = append(ops, newPatchOperation("add", p, toValue))
+		default:
+			ops = diffValues(p, fromValue, toValue, ops)
+		}
+	}
+
+	return ops
+}
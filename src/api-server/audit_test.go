@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func newAuditAPI(t *testing.T, cfg auditConfig) (*api, *httptest.Server) {
+	t.Helper()
+
+	cfg.Enabled = true
+
+	return newTestServer(t, &config{Audit: cfg})
+}
+
+func auditRequestAs(t *testing.T, method, url, consumer, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hub-Consumer", consumer)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	return resp
+}
+
+func Test_audit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	_, srv := newAuditAPI(t, auditConfig{File: file})
+
+	resp := auditRequestAs(t, http.MethodPut, srv.URL+"/weather/0", "admin", `{"city":"GopherCity","weather":"Rainy","wind":12}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requestID := resp.Header.Get(headerRequestID)
+	assert.NotEmpty(t, requestID)
+
+	resp = auditRequestAs(t, http.MethodDelete, srv.URL+"/weather/1", "external", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// Failed mutations are not audited.
+	resp = auditRequestAs(t, http.MethodPut, srv.URL+"/weather/42", "external", `{"city":"Nowhere"}`)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_audit?objectId=0", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var entries []auditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "admin", entries[0].Caller)
+	assert.Equal(t, requestID, entries[0].RequestID)
+	assert.Equal(t, "PUT /weather/0", entries[0].Operation)
+	assert.Equal(t, eventUpdated, entries[0].Type)
+
+	patch, err := json.Marshal(entries[0].Patch)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op":"replace","path":"/weather","value":"Rainy"},
+		{"op":"add","path":"/wind","value":12}
+	]`, string(patch))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_audit?caller=external", "", "")
+	entries = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, eventDeleted, entries[0].Type)
+	assert.Equal(t, []patchOperation{{Op: "remove", Path: ""}}, entries[0].Patch)
+
+	raw, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(raw)), "\n"), 2)
+}
+
+func Test_audit_requestID(t *testing.T) {
+	a, srv := newAuditAPI(t, auditConfig{})
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather", strings.NewReader(`{"city":"Lyon"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerRequestID, "req-1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "req-1", resp.Header.Get(headerRequestID))
+
+	entries := a.audit.query("", "", "", eventCreated)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "req-1", entries[0].RequestID)
+	assert.Equal(t, "127.0.0.1", entries[0].Caller)
+	assert.Equal(t, "add", entries[0].Patch[0].Op)
+}
+
+func Test_grpcAuditInterceptor(t *testing.T) {
+	a, _ := newAuditAPI(t, auditConfig{})
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-hub-consumer", "grpc-client"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + grpcServiceName + "/Delete"}
+
+	_, err := a.grpcAuditInterceptor(ctx, nil, info, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return nil, a.deleteRecord(ctx, "weather", "2")
+	})
+	require.NoError(t, err)
+
+	entries := a.audit.query("weather", "2", "", "")
+	require.Len(t, entries, 1)
+	assert.Equal(t, "grpc-client", entries[0].Caller)
+	assert.Equal(t, info.FullMethod, entries[0].Operation)
+}
+
+func Test_audit_generators(t *testing.T) {
+	a, srv := newTestServer(t, &config{
+		Audit:      auditConfig{Enabled: true},
+		Generators: []generatorConfig{{Collection: "weather", Records: []string{"0"}, Interval: time.Hour, Fields: map[string]fieldGeneratorConfig{"temperature": {Type: generatorRandom, Max: 10}}}},
+	})
+
+	// Generations are not attributed to the request being served.
+	resp := auditRequestAs(t, http.MethodPost, srv.URL+"/_generators/generate", "admin", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	entries := a.audit.query("weather", "0", "", "")
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		assert.Equal(t, "generator", entry.Caller)
+		assert.Equal(t, "generate weather", entry.Operation)
+		assert.Empty(t, entry.RequestID)
+	}
+}
+
+func Test_diffRecords(t *testing.T) {
+	ops, err := diffRecords(
+		json.RawMessage(`{"a":1,"b":{"c":true,"d/e":"x"},"f":[1],"g":null}`),
+		json.RawMessage(`{"a":1,"b":{"c":false,"d/e":"x"},"f":[1,2],"h":0}`),
+	)
+	require.NoError(t, err)
+
+	patch, err := json.Marshal(ops)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op":"replace","path":"/b/c","value":false},
+		{"op":"replace","path":"/f","value":[1,2]},
+		{"op":"remove","path":"/g"},
+		{"op":"add","path":"/h","value":0}
+	]`, string(patch))
+
+	ops, err = diffRecords(nil, json.RawMessage(`{"a":1}`))
+	require.NoError(t, err)
+	assert.Equal(t, []patchOperation{{Op: "add", Path: "", Value: json.RawMessage(`{"a":1}`)}}, ops)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultRealm      = "api-server"
+	defaultAdminScope = "admin"
+)
+
+type authConfig struct {
+	Realm   string             `yaml:"realm"`
+	APIKeys []apiKeyCredential `yaml:"apiKeys"`
+	Users   []userCredential   `yaml:"users"`
+	JWT     jwtConfig          `yaml:"jwt"`
+	// AdminScope is the scope the credentials must grant to use the admin
+	// endpoints, such as /_webhooks, "admin" by default.
+	AdminScope string `yaml:"adminScope"`
+}
+
+type apiKeyCredential struct {
+	Key     string   `yaml:"key"`
+	Subject string   `yaml:"subject"`
+	Scopes  []string `yaml:"scopes"`
+}
+
+type userCredential struct {
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Scopes   []string `yaml:"scopes"`
+}
+
+type jwtConfig struct {
+	// JWKSFile is a local JSON Web Key Set used to verify tokens.
+	JWKSFile string `yaml:"jwksFile"`
+	// Secret is a static HMAC key used to verify tokens.
+	Secret string `yaml:"secret"`
+	// PublicKeyFile is a static PEM encoded public key used to verify tokens.
+	PublicKeyFile string `yaml:"publicKeyFile"`
+	Issuer        string `yaml:"issuer"`
+	Audience      string `yaml:"audience"`
+}
+
+// principal is the identity a request was authenticated with.
+type principal struct {
+	Scheme  string         `json:"scheme"`
+	Subject string         `json:"subject,omitempty"`
+	Scopes  []string       `json:"scopes,omitempty"`
+	Claims  map[string]any `json:"claims,omitempty"`
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+var (
+	errMissingCredentials = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errUnsupportedScheme  = errors.New("unsupported security scheme")
+)
+
+// authenticator enforces the security requirements declared in the OpenAPI
+// spec against the credentials it has been configured with.
+type authenticator struct {
+	realm      string
+	adminScope string
+	apiKeys    map[string]apiKeyCredential
+	users      map[string]userCredential
+	keyFunc    jwt.Keyfunc
+	parser     *jwt.Parser
+}
+
+func newAuthenticator(cfg authConfig) (*authenticator, error) {
+	auth := &authenticator{
+		realm:      cfg.Realm,
+		adminScope: cfg.AdminScope,
+		apiKeys:    map[string]apiKeyCredential{},
+		users:      map[string]userCredential{},
+	}
+	if auth.realm == "" {
+		auth.realm = defaultRealm
+	}
+	if auth.adminScope == "" {
+		auth.adminScope = defaultAdminScope
+	}
+
+	for _, apiKey := range cfg.APIKeys {
+		auth.apiKeys[apiKey.Key] = apiKey
+	}
+	for _, user := range cfg.Users {
+		auth.users[user.Username] = user
+	}
+
+	var methods []string
+	switch {
+	case cfg.JWT.JWKSFile != "":
+		keys, err := loadJWKS(cfg.JWT.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.keyFunc = keys.keyFunc
+		methods = keys.signingMethods()
+
+	case cfg.JWT.PublicKeyFile != "":
+		key, err := loadPublicKey(cfg.JWT.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.keyFunc = func(*jwt.Token) (interface{}, error) { return key, nil }
+		methods = signingMethods(key)
+
+	case cfg.JWT.Secret != "":
+		secret := []byte(cfg.JWT.Secret)
+		auth.keyFunc = func(*jwt.Token) (interface{}, error) { return secret, nil }
+		methods = signingMethods(secret)
+	}
+
+	// Tokens are only accepted when signed with an algorithm of the
+	// configured keys.
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods)}
+	if cfg.JWT.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.JWT.Issuer))
+	}
+	if cfg.JWT.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.JWT.Audience))
+	}
+	auth.parser = jwt.NewParser(opts...)
+
+	return auth, nil
+}
+
+func (a *api) authMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.authorizeRequest(r)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+
+			if p != nil {
+				r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// authorizeRequest checks r against the security requirements of its
+// operation in the spec. It returns the authenticated principal, if any.
+func (a *api) authorizeRequest(r *http.Request) (*principal, error) {
+	doc := a.getSpecDocument()
+	if a.auth == nil || doc == nil {
+		return nil, nil
+	}
+
+	op := doc.findOperation(r.Method, r.URL.Path)
+	return a.auth.authorize(r, doc.Components.SecuritySchemes, doc.securityFor(op))
+}
+
+// authorizeOperation checks r, which acts on the records through another
+// route, such as a bulk request, against the security requirements of the
+// REST operation doing the same, given by method and path.
+func (a *api) authorizeOperation(r *http.Request, method, path string) (*principal, error) {
+	op := new(http.Request)
+	*op = *r
+	op.Method = method
+	op.URL = &url.URL{Path: path}
+
+	return a.authorizeRequest(op)
+}
+
+// adminMiddleware restricts the admin endpoints to the credentials granting
+// the admin scope, once authentication is configured. The credentials are
+// the ones of the security schemes of the spec, or of HTTP basic and bearer
+// authentication without spec.
+func (a *api) adminMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if a.auth == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			schemes := defaultAdminSchemes
+			if doc := a.getSpecDocument(); doc != nil && len(doc.Components.SecuritySchemes) > 0 {
+				schemes = doc.Components.SecuritySchemes
+			}
+
+			p, err := a.auth.authorizeAdmin(r, schemes)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// defaultAdminSchemes are the schemes admin requests authenticate with when
+// the spec declares none.
+var defaultAdminSchemes = map[string]securityScheme{
+	"basic":  {Type: "http", Scheme: "basic"},
+	"bearer": {Type: "http", Scheme: "bearer"},
+}
+
+func writeAuthError(w http.ResponseWriter, err error) {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		for _, challenge := range authErr.challenges {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	JSONError(w, authErrorStatus(err), err.Error())
+}
+
+// authErrorStatus returns the status code answering an authorization error.
+func authErrorStatus(err error) int {
+	var authErr *authError
+	if !errors.As(err, &authErr) {
+		return http.StatusInternalServerError
+	}
+
+	return authErr.status
+}
+
+type authError struct {
+	status     int
+	message    string
+	challenges []string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// authorize checks the request against the security requirements. Any of the
+// requirements has to be satisfied, and satisfying a requirement means
+// satisfying all the schemes it lists.
+func (a *authenticator) authorize(req *http.Request, schemes map[string]securityScheme, requirements []securityRequirement) (*principal, error) {
+	if len(requirements) == 0 {
+		return nil, nil
+	}
+
+	var (
+		challenges []string
+		forbidden  bool
+		invalid    bool
+	)
+	for _, requirement := range requirements {
+		if len(requirement) == 0 {
+			// An empty requirement makes authentication optional.
+			return nil, nil
+		}
+
+		var (
+			authenticated *principal
+			satisfied     = true
+		)
+		for _, name := range sortedKeys(requirement) {
+			scopes := requirement[name]
+
+			scheme, ok := schemes[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown security scheme %q", name)
+			}
+
+			p, err := a.authenticate(req, name, scheme)
+			switch {
+			case err == nil && hasScopes(p.Scopes, scopes):
+				if authenticated == nil {
+					authenticated = p
+				}
+				continue
+			case err == nil:
+				forbidden = true
+				challenges = append(challenges, a.challenge(scheme, "insufficient_scope", scopes))
+			case errors.Is(err, errInvalidCredentials):
+				invalid = true
+				challenges = append(challenges, a.challenge(scheme, "invalid_token", nil))
+			default:
+				challenges = append(challenges, a.challenge(scheme, "", nil))
+			}
+			satisfied = false
+		}
+
+		if satisfied {
+			return authenticated, nil
+		}
+	}
+
+	switch {
+	case forbidden && !invalid:
+		return nil, &authError{status: http.StatusForbidden, message: "insufficient scope", challenges: dedup(challenges)}
+	case invalid:
+		return nil, &authError{status: http.StatusUnauthorized, message: errInvalidCredentials.Error(), challenges: dedup(challenges)}
+	default:
+		return nil, &authError{status: http.StatusUnauthorized, message: errMissingCredentials.Error(), challenges: dedup(challenges)}
+	}
+}
+
+// authorizeAdmin checks that the request is authenticated, with any of the
+// schemes, by credentials granting the admin scope.
+func (a *authenticator) authorizeAdmin(req *http.Request, schemes map[string]securityScheme) (*principal, error) {
+	requirements := make([]securityRequirement, 0, len(schemes))
+	for _, name := range sortedKeys(schemes) {
+		requirements = append(requirements, securityRequirement{name: {a.adminScope}})
+	}
+
+	return a.authorize(req, schemes, requirements)
+}
+
+func (a *authenticator) authenticate(req *http.Request, name string, scheme securityScheme) (*principal, error) {
+	switch strings.ToLower(scheme.Type) {
+	case "apikey":
+		key, err := apiKeyValue(req, scheme)
+		if err != nil {
+			return nil, err
+		}
+
+		cred, ok := a.apiKeys[key]
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		return &principal{Scheme: name, Subject: cred.Subject, Scopes: cred.Scopes}, nil
+
+	case "http":
+		switch strings.ToLower(scheme.Scheme) {
+		case "basic":
+			return a.authenticateBasic(req, name)
+		case "bearer":
+			return a.authenticateBearer(req, name)
+		}
+
+	case "oauth2", "openidconnect":
+		return a.authenticateBearer(req, name)
+	}
+
+	return nil, errUnsupportedScheme
+}
+
+func (a *authenticator) authenticateBasic(req *http.Request, name string) (*principal, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, errMissingCredentials
+	}
+
+	user, ok := a.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil, errInvalidCredentials
+	}
+
+	return &principal{Scheme: name, Subject: username, Scopes: user.Scopes}, nil
+}
+
+func (a *authenticator) authenticateBearer(req *http.Request, name string) (*principal, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return nil, errMissingCredentials
+	}
+
+	claims, err := a.verifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims.GetSubject()
+	return &principal{Scheme: name, Subject: subject, Scopes: claimScopes(claims), Claims: claims}, nil
+}
+
+// verifyToken returns the claims of token once its signature and claims are
+// verified with the configured keys.
+func (a *authenticator) verifyToken(token string) (jwt.MapClaims, error) {
+	if a.keyFunc == nil {
+		return nil, errInvalidCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyFunc); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	return claims, nil
+}
+
+func (a *authenticator) challenge(scheme securityScheme, errCode string, scopes []string) string {
+	var challenge string
+	switch strings.ToLower(scheme.Type) {
+	case "apikey":
+		challenge = fmt.Sprintf("APIKey realm=%q, in=%q, name=%q", a.realm, scheme.In, scheme.Name)
+	case "http":
+		if strings.EqualFold(scheme.Scheme, "basic") {
+			challenge = fmt.Sprintf("Basic realm=%q", a.realm)
+		} else {
+			challenge = fmt.Sprintf("Bearer realm=%q", a.realm)
+		}
+	default:
+		challenge = fmt.Sprintf("Bearer realm=%q", a.realm)
+	}
+
+	if errCode != "" {
+		challenge += fmt.Sprintf(", error=%q", errCode)
+	}
+	if len(scopes) > 0 {
+		challenge += fmt.Sprintf(", scope=%q", strings.Join(scopes, " "))
+	}
+
+	return challenge
+}
+
+func apiKeyValue(req *http.Request, scheme securityScheme) (string, error) {
+	var key string
+	switch scheme.In {
+	case "header":
+		key = req.Header.Get(scheme.Name)
+	case "query":
+		key = req.URL.Query().Get(scheme.Name)
+	case "cookie":
+		cookie, err := req.Cookie(scheme.Name)
+		if err == nil {
+			key = cookie.Value
+		}
+	default:
+		return "", errUnsupportedScheme
+	}
+
+	if key == "" {
+		return "", errMissingCredentials
+	}
+
+	return key, nil
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// claimScopes reads the scopes granted to a token, either from the
+// space-delimited "scope" claim or from the "scp" claim.
+func claimScopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	switch scp := claims["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []interface{}:
+		var scopes []string
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+		return scopes
+	}
+
+	return nil
+}
+
+func hasScopes(granted, required []string) bool {
+	for _, scope := range required {
+		if !slices.Contains(granted, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func loadPublicKey(path string) (interface{}, error) {
+	rawKey, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(rawKey); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(rawKey); err == nil {
+		return key, nil
+	}
+
+	return jwt.ParseEdPublicKeyFromPEM(rawKey)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func dedup(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if !slices.Contains(out, v) {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
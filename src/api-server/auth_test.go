@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthAPI(t *testing.T, cfg authConfig) *httptest.Server {
+	t.Helper()
+
+	a, srv := newTestServer(t, &config{Auth: &cfg})
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi-auth.yaml"))
+
+	return srv
+}
+
+func Test_auth_missingCredentials(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{})
+
+	resp, err := http.Get(srv.URL + "/weather")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.ElementsMatch(t, []string{
+		`APIKey realm="api-server", in="header", name="X-API-Key"`,
+		`Basic realm="api-server"`,
+	}, resp.Header.Values("WWW-Authenticate"))
+}
+
+func Test_auth_apiKey(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{APIKeys: []apiKeyCredential{{Key: "secret", Subject: "alice"}}})
+
+	tests := []struct {
+		desc     string
+		key      string
+		expected int
+	}{
+		{desc: "valid key", key: "secret", expected: http.StatusOK},
+		{desc: "invalid key", key: "nope", expected: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather", http.NoBody)
+			require.NoError(t, err)
+			req.Header.Set("X-API-Key", test.key)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_auth_basic(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{Users: []userCredential{{Username: "admin", Password: "admin"}}})
+
+	tests := []struct {
+		desc     string
+		password string
+		expected int
+	}{
+		{desc: "valid password", password: "admin", expected: http.StatusOK},
+		{desc: "invalid password", password: "nope", expected: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather", http.NoBody)
+			require.NoError(t, err)
+			req.SetBasicAuth("admin", test.password)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_auth_operationOverride(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{})
+
+	resp, err := http.Get(srv.URL + "/weather/public")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	// The operation has no security requirement, the request reaches the
+	// handler which does not know this record.
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_auth_bearerSecret(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{JWT: jwtConfig{Secret: "secret"}})
+
+	sign := func(secret string, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		require.NoError(t, err)
+		return token
+	}
+	unsigned := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		require.NoError(t, err)
+		return token
+	}
+
+	tests := []struct {
+		desc      string
+		method    string
+		token     string
+		expected  int
+		challenge string
+	}{
+		{
+			desc:     "valid token",
+			method:   http.MethodGet,
+			token:    sign("secret", jwt.MapClaims{"sub": "alice"}),
+			expected: http.StatusOK,
+		},
+		{
+			desc:      "invalid signature",
+			method:    http.MethodGet,
+			token:     sign("other", jwt.MapClaims{"sub": "alice"}),
+			expected:  http.StatusUnauthorized,
+			challenge: `Bearer realm="api-server", error="invalid_token"`,
+		},
+		{
+			desc:      "unsigned token",
+			method:    http.MethodGet,
+			token:     unsigned(jwt.MapClaims{"sub": "alice"}),
+			expected:  http.StatusUnauthorized,
+			challenge: `Bearer realm="api-server", error="invalid_token"`,
+		},
+		{
+			desc:      "insufficient scope",
+			method:    http.MethodPost,
+			token:     sign("secret", jwt.MapClaims{"sub": "alice", "scope": "weather:read"}),
+			expected:  http.StatusForbidden,
+			challenge: `Bearer realm="api-server", error="insufficient_scope", scope="weather:write"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, srv.URL+"/weather/0", http.NoBody)
+			require.NoError(t, err)
+			if test.method == http.MethodPost {
+				req.URL.Path = "/weather"
+			}
+			req.Header.Set("Authorization", "Bearer "+test.token)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+			assert.Equal(t, test.challenge, resp.Header.Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func Test_auth_bearerJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	rawJWKS, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(jwksFile, rawJWKS, 0o600))
+
+	srv := newAuthAPI(t, authConfig{JWT: jwtConfig{JWKSFile: jwksFile, Issuer: "hydra"}})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "iss": "hydra"})
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/0", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+signed)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_signingMethods(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"HS256", "HS384", "HS512"}, signingMethods([]byte("secret")))
+	assert.Equal(t, []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, signingMethods(&rsaKey.PublicKey))
+	assert.Equal(t, []string{"ES384"}, signingMethods(&ecKey.PublicKey))
+	assert.Equal(t, []string{"EdDSA"}, signingMethods(edKey))
+
+	keys := jwks{"a": &ecKey.PublicKey, "b": edKey, "c": edKey}
+	assert.Equal(t, []string{"ES384", "EdDSA"}, keys.signingMethods())
+}
+
+func Test_adminMiddleware(t *testing.T) {
+	_, srv := newTestServer(t, &config{
+		Auth: &authConfig{Users: []userCredential{
+			{Username: "admin", Password: "secret", Scopes: []string{"admin"}},
+			{Username: "alice", Password: "secret"},
+		}},
+		Audit: auditConfig{Enabled: true},
+	})
+
+	tests := []struct {
+		desc      string
+		username  string
+		expected  int
+		challenge string
+	}{
+		{desc: "no credentials", expected: http.StatusUnauthorized, challenge: `Basic realm="api-server"`},
+		{desc: "without admin scope", username: "alice", expected: http.StatusForbidden, challenge: `Basic realm="api-server", error="insufficient_scope", scope="admin"`},
+		{desc: "admin", username: "admin", expected: http.StatusOK},
+	}
+
+	for _, path := range []string{"/_webhooks", "/_scenarios", "/_audit", "/_deprecations", "/_generators"} {
+		for _, test := range tests {
+			t.Run(path+" "+test.desc, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, srv.URL+path, http.NoBody)
+				require.NoError(t, err)
+				if test.username != "" {
+					req.SetBasicAuth(test.username, "secret")
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer func() { _ = resp.Body.Close() }()
+
+				assert.Equal(t, test.expected, resp.StatusCode)
+				if test.challenge != "" {
+					assert.Contains(t, resp.Header.Values("WWW-Authenticate"), test.challenge)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	batchPath = "/_batch"
+
+	// maxBatchRequests is the number of sub-requests accepted by a batch.
+	maxBatchRequests = 1000
+)
+
+// batchRequest is a sub-request of a batch, in the format of the OData JSON
+// batch requests.
+type batchRequest struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	// DependsOn lists the IDs of the sub-requests which must succeed for this
+	// one to run.
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+type batchResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// batchHandler runs the sub-requests of a batch one after the other through
+// handler. Sub-requests inherit the headers of the batch request, such as
+// its credentials. Processing stops at the first failing sub-request, unless
+// the Prefer: continue-on-error header is given; the sub-requests not run are
+// answered with 424.
+func (a *api) batchHandler(handler http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var batch struct {
+			Requests []batchRequest `json:"requests"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid batch: %v", err))
+			return
+		}
+
+		if len(batch.Requests) > maxBatchRequests {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("too many requests: %d, at most %d are accepted", len(batch.Requests), maxBatchRequests))
+			return
+		}
+
+		ids := map[string]bool{}
+		for i, sub := range batch.Requests {
+			if sub.ID == "" {
+				JSONError(rw, http.StatusBadRequest, fmt.Sprintf("request %d has no id", i))
+				return
+			}
+			if ids[sub.ID] {
+				JSONError(rw, http.StatusBadRequest, fmt.Sprintf("duplicated request id %q", sub.ID))
+				return
+			}
+			for _, dep := range sub.DependsOn {
+				if !ids[dep] {
+					JSONError(rw, http.StatusBadRequest, fmt.Sprintf("request %q depends on %q, which does not precede it", sub.ID, dep))
+					return
+				}
+			}
+			ids[sub.ID] = true
+		}
+
+		continueOnError := preferContinueOnError(req)
+
+		failed := map[string]bool{}
+		stopped := false
+		responses := make([]batchResponse, 0, len(batch.Requests))
+		for _, sub := range batch.Requests {
+			var resp batchResponse
+			switch {
+			case stopped:
+				resp = batchErrorResponse(sub.ID, http.StatusFailedDependency, "not run: an earlier request failed")
+			case dependencyFailed(sub.DependsOn, failed):
+				resp = batchErrorResponse(sub.ID, http.StatusFailedDependency, "not run: a request it depends on failed")
+			default:
+				resp = runBatchRequest(handler, req, sub)
+			}
+
+			if resp.Status >= http.StatusBadRequest {
+				failed[sub.ID] = true
+				stopped = !continueOnError
+			}
+			responses = append(responses, resp)
+		}
+
+		writeJSONResponse(rw, http.StatusOK, struct {
+			Responses []batchResponse `json:"responses"`
+		}{Responses: responses})
+	}
+}
+
+// runBatchRequest runs sub through handler and captures its response.
+func runBatchRequest(handler http.Handler, batch *http.Request, sub batchRequest) batchResponse {
+	subReq, err := newBatchSubRequest(batch, sub)
+	if err != nil {
+		return batchErrorResponse(sub.ID, http.StatusBadRequest, err.Error())
+	}
+
+	capture := newResponseCapture()
+	handler.ServeHTTP(capture, subReq)
+
+	resp := batchResponse{ID: sub.ID, Status: capture.statusCode(), Headers: map[string]string{}}
+	for name := range capture.header {
+		resp.Headers[name] = capture.header.Get(name)
+	}
+
+	body := capture.body.Bytes()
+	switch {
+	case len(body) == 0:
+	case isJSONMediaType(capture.header.Get("Content-Type")) && json.Valid(body):
+		resp.Body = body
+	default:
+		// Other formats are embedded as a string, as OData does.
+		resp.Body, _ = json.Marshal(string(body))
+	}
+
+	return resp
+}
+
+// newBatchSubRequest builds the request of sub, with the headers of the batch
+// request overridden by its own.
+func newBatchSubRequest(batch *http.Request, sub batchRequest) (*http.Request, error) {
+	target, err := url.Parse(sub.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", sub.URL, err)
+	}
+	if target.IsAbs() || target.Host != "" || !strings.HasPrefix(target.Path, "/") {
+		return nil, fmt.Errorf("url %q must be an absolute path", sub.URL)
+	}
+	if target.Path == batchPath {
+		return nil, errors.New("batches cannot be nested")
+	}
+
+	method := strings.ToUpper(sub.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var contentType string
+	for name, value := range sub.Headers {
+		if http.CanonicalHeaderKey(name) == "Content-Type" {
+			contentType = value
+		}
+	}
+
+	var body []byte
+	if len(sub.Body) > 0 && string(sub.Body) != "null" {
+		body = sub.Body
+		// Bodies of other formats are given as a string.
+		var text string
+		if contentType != "" && !isJSONMediaType(contentType) && json.Unmarshal(sub.Body, &text) == nil {
+			body = []byte(text)
+		}
+		if contentType == "" {
+			contentType = mediaTypeJSON
+		}
+	}
+
+	// The router reuses the routing context found in the request, which is
+	// the one of the batch.
+	ctx := context.WithValue(batch.Context(), chi.RouteCtxKey, nil)
+
+	subReq, err := http.NewRequestWithContext(ctx, method, target.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	subReq.Host = batch.Host
+	subReq.RemoteAddr = batch.RemoteAddr
+
+	subReq.Header = batch.Header.Clone()
+	subReq.Header.Del("Content-Type")
+	subReq.Header.Del("Content-Length")
+	subReq.Header.Del("Prefer")
+	for name, value := range sub.Headers {
+		subReq.Header.Set(name, value)
+	}
+	if contentType != "" {
+		subReq.Header.Set("Content-Type", contentType)
+	}
+
+	return subReq, nil
+}
+
+func batchErrorResponse(id string, status int, msg string) batchResponse {
+	body, _ := json.Marshal(apiError{Message: msg})
+
+	return batchResponse{ID: id, Status: status, Headers: map[string]string{"Content-Type": mediaTypeJSON}, Body: body}
+}
+
+func dependencyFailed(dependsOn []string, failed map[string]bool) bool {
+	for _, dep := range dependsOn {
+		if failed[dep] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// preferContinueOnError reports whether the batch request prefers all its
+// sub-requests to run, even after a failure.
+func preferContinueOnError(req *http.Request) bool {
+	for _, value := range req.Header.Values("Prefer") {
+		for _, pref := range strings.Split(value, ",") {
+			pref, _, _ = strings.Cut(strings.TrimSpace(pref), "=")
+			if pref == "continue-on-error" || pref == "odata.continue-on-error" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == mediaTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doBatch(t *testing.T, url, prefer, body string) []batchResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url+batchPath, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mediaTypeJSON)
+	if prefer != "" {
+		req.Header.Set("Prefer", prefer)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var got struct {
+		Responses []batchResponse `json:"responses"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+
+	return got.Responses
+}
+
+func Test_batch(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+
+	got := doBatch(t, srv.URL, "", `{"requests":[
+		{"id":"create","method":"POST","url":"/forecasts","body":{"cityId":"paris","weather":"Windy"}},
+		{"id":"update","method":"patch","url":"/cities/lyon","headers":{"content-type":"application/json-patch+json"},"body":[{"op":"add","path":"/population","value":513275}]},
+		{"id":"list","url":"/forecasts","dependsOn":["create"]},
+		{"id":"csv","url":"/cities","headers":{"Accept":"text/csv"}}
+	]}`)
+	require.Len(t, got, 4)
+
+	assert.Equal(t, "create", got[0].ID)
+	assert.Equal(t, http.StatusCreated, got[0].Status)
+
+	assert.Equal(t, http.StatusNoContent, got[1].Status)
+	assert.Empty(t, got[1].Body)
+	obj, err := a.getObject("cities", "lyon")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name":"Lyon","population":513275}`, string(obj))
+
+	assert.Equal(t, http.StatusOK, got[2].Status)
+	var list []map[string]interface{}
+	require.NoError(t, json.Unmarshal(got[2].Body, &list))
+	assert.Len(t, list, 4)
+
+	assert.Equal(t, http.StatusOK, got[3].Status)
+	assert.Equal(t, "text/csv", got[3].Headers["Content-Type"])
+	var csv string
+	require.NoError(t, json.Unmarshal(got[3].Body, &csv))
+	assert.Contains(t, csv, "Paris")
+}
+
+func Test_batch_failures(t *testing.T) {
+	_, srv := newRelationsAPI(t, "")
+
+	body := `{"requests":[
+		{"id":"1","method":"POST","url":"/forecasts","body":{"cityId":"nantes"}},
+		{"id":"2","url":"/cities/lyon","dependsOn":["1"]},
+		{"id":"3","url":"/cities/paris"}
+	]}`
+
+	got := doBatch(t, srv.URL, "", body)
+	require.Len(t, got, 3)
+	assert.Equal(t, http.StatusUnprocessableEntity, got[0].Status)
+	assert.Equal(t, http.StatusFailedDependency, got[1].Status)
+	assert.Equal(t, http.StatusFailedDependency, got[2].Status)
+
+	got = doBatch(t, srv.URL, "continue-on-error", body)
+	require.Len(t, got, 3)
+	assert.Equal(t, http.StatusUnprocessableEntity, got[0].Status)
+	assert.Equal(t, http.StatusFailedDependency, got[1].Status)
+	assert.Equal(t, http.StatusOK, got[2].Status)
+
+	got = doBatch(t, srv.URL, "continue-on-error", `{"requests":[
+		{"id":"nested","method":"POST","url":"/_batch"},
+		{"id":"remote","url":"http://example.com/cities"}
+	]}`)
+	require.Len(t, got, 2)
+	assert.Equal(t, http.StatusBadRequest, got[0].Status)
+	assert.Equal(t, http.StatusBadRequest, got[1].Status)
+}
+
+func Test_batch_invalid(t *testing.T) {
+	_, srv := newRelationsAPI(t, "")
+
+	tests := []struct {
+		desc string
+		body string
+	}{
+		{desc: "not JSON", body: `requests`},
+		{desc: "missing id", body: `{"requests":[{"url":"/cities"}]}`},
+		{desc: "duplicated id", body: `{"requests":[{"id":"1","url":"/cities"},{"id":"1","url":"/cities"}]}`},
+		{desc: "unknown dependency", body: `{"requests":[{"id":"1","url":"/cities","dependsOn":["2"]},{"id":"2","url":"/cities"}]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			resp := doRequest(t, http.MethodPost, srv.URL+batchPath, mediaTypeJSON, test.body)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func Test_batch_authorization(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{APIKeys: []apiKeyCredential{{Key: "secret", Subject: "alice"}}})
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+batchPath, strings.NewReader(`{"requests":[
+		{"id":"1","method":"POST","url":"/weather","body":{"city":"Lyon"}},
+		{"id":"2","method":"POST","url":"/weather/_bulk","body":[{"city":"Lyon"}]}
+	]}`))
+	require.NoError(t, err)
+	req.Header.Set("X-API-Key", "secret")
+	req.Header.Set("Prefer", "continue-on-error")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var got struct {
+		Responses []batchResponse `json:"responses"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	require.Len(t, got.Responses, 2)
+	assert.Equal(t, http.StatusUnauthorized, got.Responses[0].Status)
+	assert.Equal(t, http.StatusMultiStatus, got.Responses[1].Status)
+
+	var bulk bulkResponse
+	require.NoError(t, json.Unmarshal(got.Responses[1].Body, &bulk))
+	require.Len(t, bulk.Items, 1)
+	assert.Equal(t, http.StatusUnauthorized, bulk.Items[0].Status)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	bulkOpCreate = "create"
+	bulkOpUpsert = "upsert"
+	bulkOpDelete = "delete"
+
+	// maxBulkItems is the number of items accepted by a bulk request.
+	maxBulkItems = 10000
+)
+
+var errBulkAborted = errors.New("not applied: the bulk request was aborted")
+
+// bulkItemResult is the outcome of an item of a bulk request.
+type bulkItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Atomic    bool             `json:"atomic"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Items     []bulkItemResult `json:"items"`
+}
+
+// handleBulk applies the items of the request body, a JSON array or NDJSON,
+// to a collection. The op query parameter tells what to do with them:
+// create (the default), upsert, which requires their ID and only creates the
+// missing records of the collections allowing upserts, or delete, whose items
+// are IDs or objects with an ID. Items are applied best-effort, unless
+// atomic=true is given: the first failing item then aborts the others.
+func (a *api) handleBulk(rw http.ResponseWriter, req *http.Request) {
+	objType := chi.URLParam(req, "objType")
+	query := req.URL.Query()
+
+	op := query.Get("op")
+	switch op {
+	case "":
+		op = bulkOpCreate
+	case bulkOpCreate, bulkOpUpsert, bulkOpDelete:
+	default:
+		JSONError(rw, http.StatusBadRequest, fmt.Sprintf("unknown bulk operation %q", op))
+		return
+	}
+
+	atomic := false
+	if value := query.Get("atomic"); value != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(value); err != nil {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid atomic %q", value))
+			return
+		}
+	}
+
+	items, err := decodeBulkItems(req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnsupportedMediaType) {
+			status = http.StatusUnsupportedMediaType
+		}
+		JSONError(rw, status, err.Error())
+		return
+	}
+
+	resp := a.applyBulk(req, objType, op, items, atomic)
+
+	status := http.StatusOK
+	switch {
+	case atomic && resp.Failed > 0:
+		status = http.StatusUnprocessableEntity
+	case resp.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+
+	writeJSONResponse(rw, status, resp)
+}
+
+// applyBulk applies op to the items. Each item is authorized first, as the
+// REST operation doing the same. Atomic requests are applied to a copy of the
+// records, whose changes are only committed, and published, if all the items
+// succeed. The records stay locked meanwhile, so that no other change comes
+// in between.
+func (a *api) applyBulk(req *http.Request, objType, op string, items []json.RawMessage, atomic bool) bulkResponse {
+	ctx := req.Context()
+
+	denied := make([]error, len(items))
+	for i, item := range items {
+		method, path := bulkItemOperation(objType, op, item)
+		_, denied[i] = a.authorizeOperation(req, method, path)
+	}
+
+	target := a
+	if atomic {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		target = a.stage()
+	}
+
+	resp := bulkResponse{Atomic: atomic, Items: make([]bulkItemResult, 0, len(items))}
+
+	var changes []recordRef
+	for i, item := range items {
+		result := bulkItemResult{Index: i}
+		if atomic && resp.Failed > 0 {
+			result.Status = http.StatusFailedDependency
+			result.Error = errBulkAborted.Error()
+			resp.Items = append(resp.Items, result)
+			continue
+		}
+
+		if err := denied[i]; err != nil {
+			result.Status = authErrorStatus(err)
+			result.Error = err.Error()
+			resp.Failed++
+			resp.Items = append(resp.Items, result)
+			continue
+		}
+
+		var itemChanges []recordRef
+		var err error
+		result.ID, result.Status, itemChanges, err = target.applyBulkItem(ctx, objType, op, item)
+		if err != nil {
+			result.Error = err.Error()
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+			changes = append(changes, itemChanges...)
+		}
+		resp.Items = append(resp.Items, result)
+	}
+
+	switch {
+	case atomic && resp.Failed > 0:
+		for i := range resp.Items {
+			if resp.Items[i].Error == "" {
+				resp.Items[i].Status = http.StatusFailedDependency
+				resp.Items[i].Error = errBulkAborted.Error()
+			}
+		}
+		resp.Succeeded = 0
+		resp.Failed = len(resp.Items)
+	case atomic:
+		a.commit(ctx, target, changes)
+	}
+
+	return resp
+}
+
+// stage returns a copy of the records, to apply changes to without
+// publishing them. The records must be locked.
+func (a *api) stage() *api {
+	data := make(map[string]map[string]json.RawMessage, len(a.data))
+	for objType, objs := range a.data {
+		data[objType] = maps.Clone(objs)
+	}
+
+	return &api{
+		data:      data,
+		relations: a.relations,
+		ids:       a.ids,
+		sequences: maps.Clone(a.sequences),
+	}
+}
+
+// commit stores the state of the changed records of staged, in the order of
+// their first change. The records must be locked.
+func (a *api) commit(ctx context.Context, staged *api, changes []recordRef) {
+	a.sequences = staged.sequences
+
+	seen := make(map[recordRef]bool, len(changes))
+	for _, ref := range changes {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		if obj, ok := staged.data[ref.objType][ref.id]; ok {
+			a.storeObject(ctx, ref.objType, ref.id, obj)
+		} else {
+			a.removeObject(ctx, ref.objType, ref.id)
+		}
+	}
+}
+
+// bulkItemOperation returns the method and path of the REST operation
+// applying op to item.
+func bulkItemOperation(objType, op string, item json.RawMessage) (string, string) {
+	collection := "/" + url.PathEscape(objType)
+
+	switch op {
+	case bulkOpDelete:
+		id, _ := bulkDeletedID(item)
+		return http.MethodDelete, collection + "/" + url.PathEscape(id)
+	case bulkOpUpsert:
+		var obj map[string]interface{}
+		_ = json.Unmarshal(item, &obj)
+		return http.MethodPut, collection + "/" + url.PathEscape(bulkItemID(obj))
+	default:
+		return http.MethodPost, collection
+	}
+}
+
+// applyBulkItem applies op to item, and returns the ID of the record, the
+// status code answering the item and the records it changed.
+func (a *api) applyBulkItem(ctx context.Context, objType, op string, item json.RawMessage) (string, int, []recordRef, error) {
+	if op == bulkOpDelete {
+		id, err := bulkDeletedID(item)
+		if err != nil {
+			return "", http.StatusBadRequest, nil, err
+		}
+
+		if _, err := a.getObject(objType, id); err != nil {
+			return id, http.StatusNotFound, nil, fmt.Errorf("%s/%s %w", objType, id, errRecordNotFound)
+		}
+
+		plan, err := a.deletionPlan(objType, id, map[recordRef]bool{})
+		if err != nil {
+			return id, recordErrorStatus(err), nil, err
+		}
+
+		for _, ref := range plan {
+			a.deleteObject(ctx, ref.objType, ref.id)
+		}
+
+		return id, http.StatusNoContent, plan, nil
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(item, &obj); err != nil || obj == nil {
+		return "", http.StatusBadRequest, nil, errors.New("item is not an object")
+	}
+
+	if op == bulkOpCreate {
+		id, err := a.createRecord(ctx, objType, obj)
+		if err != nil {
+			return "", recordErrorStatus(err), nil, err
+		}
+
+		return id, http.StatusCreated, []recordRef{{objType: objType, id: id}}, nil
+	}
+
+	id := bulkItemID(obj)
+	if id == "" {
+		return "", http.StatusBadRequest, nil, errors.New("item has no id")
+	}
+
+	created, err := a.replaceRecord(ctx, objType, id, obj)
+	if err != nil {
+		return id, recordErrorStatus(err), nil, err
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	return id, status, []recordRef{{objType: objType, id: id}}, nil
+}
+
+// bulkDeletedID returns the ID of an item of a delete bulk request, an ID or
+// an object with an ID.
+func bulkDeletedID(item json.RawMessage) (string, error) {
+	var id string
+	if err := json.Unmarshal(item, &id); err == nil {
+		return id, nil
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(item, &obj); err != nil {
+		return "", errors.New("item is neither an ID nor an object")
+	}
+	if id = bulkItemID(obj); id == "" {
+		return "", errors.New("item has no id")
+	}
+
+	return id, nil
+}
+
+func bulkItemID(obj map[string]interface{}) string {
+	switch id := obj["id"].(type) {
+	case string:
+		return id
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// decodeBulkItems reads the items of a bulk request, sent as a JSON array or
+// as NDJSON.
+func decodeBulkItems(req *http.Request) ([]json.RawMessage, error) {
+	mediaType := "application/json"
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedMediaType, contentType)
+		}
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []json.RawMessage
+	switch mediaType {
+	case "application/json":
+		if err = json.Unmarshal(body, &items); err != nil {
+			return nil, fmt.Errorf("request body is not a JSON array: %w", err)
+		}
+
+	case "application/x-ndjson", "application/jsonl", "application/jsonlines":
+		dec := json.NewDecoder(bytes.NewReader(body))
+		for dec.More() {
+			var item json.RawMessage
+			if err = dec.Decode(&item); err != nil {
+				return nil, fmt.Errorf("item %d: %w", len(items), err)
+			}
+			items = append(items, item)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedMediaType, mediaType)
+	}
+
+	if len(items) > maxBulkItems {
+		return nil, fmt.Errorf("too many items: %d, at most %d are accepted", len(items), maxBulkItems)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeBulkResponse(t *testing.T, resp *http.Response) bulkResponse {
+	t.Helper()
+
+	var got bulkResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+
+	return got
+}
+
+func Test_bulk_bestEffort(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/forecasts/_bulk", "application/x-ndjson",
+		`{"cityId":"lyon","weather":"Windy"}
+{"cityId":"nantes","weather":"Foggy"}
+"not an object"
+`)
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+
+	got := decodeBulkResponse(t, resp)
+	assert.False(t, got.Atomic)
+	assert.Equal(t, 1, got.Succeeded)
+	assert.Equal(t, 2, got.Failed)
+	require.Len(t, got.Items, 3)
+	assert.Equal(t, http.StatusCreated, got.Items[0].Status)
+	assert.Equal(t, http.StatusUnprocessableEntity, got.Items[1].Status)
+	assert.Equal(t, http.StatusBadRequest, got.Items[2].Status)
+
+	obj, err := a.getObject("forecasts", got.Items[0].ID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cityId":"lyon","weather":"Windy"}`, string(obj))
+}
+
+func Test_bulk_atomic(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+	a.ids = map[string]idConfig{"forecasts": {Upsert: true}}
+
+	_, events := a.events.subscribe(0, false)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/forecasts/_bulk?op=upsert&atomic=true", "application/json",
+		`[{"id":"1","cityId":"lyon","weather":"Windy"},{"id":"4","cityId":"paris","weather":"Foggy"},{"id":"5","cityId":"nantes"}]`)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	got := decodeBulkResponse(t, resp)
+	assert.True(t, got.Atomic)
+	assert.Equal(t, 0, got.Succeeded)
+	assert.Equal(t, 3, got.Failed)
+	require.Len(t, got.Items, 3)
+	assert.Equal(t, http.StatusFailedDependency, got.Items[0].Status)
+	assert.Equal(t, http.StatusFailedDependency, got.Items[1].Status)
+	assert.Equal(t, http.StatusUnprocessableEntity, got.Items[2].Status)
+
+	obj, err := a.getObject("forecasts", "1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cityId":"lyon","weather":"Sunny"}`, string(obj))
+
+	_, err = a.getObject("forecasts", "4")
+	assert.Error(t, err)
+
+	// Nothing is published for an aborted request.
+	assert.Empty(t, events)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/forecasts/_bulk?op=upsert&atomic=true", "application/json",
+		`[{"id":"1","cityId":"lyon","weather":"Windy"},{"id":"4","cityId":"paris","weather":"Foggy"}]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	got = decodeBulkResponse(t, resp)
+	assert.Equal(t, 2, got.Succeeded)
+	assert.Equal(t, http.StatusOK, got.Items[0].Status)
+	assert.Equal(t, http.StatusCreated, got.Items[1].Status)
+
+	require.Len(t, events, 2)
+	evt := <-events
+	assert.Equal(t, []string{eventUpdated, "1"}, []string{evt.Type, evt.ObjectID})
+	evt = <-events
+	assert.Equal(t, []string{eventCreated, "4"}, []string{evt.Type, evt.ObjectID})
+}
+
+func Test_bulk_upsertWithoutUpserts(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/forecasts/_bulk?op=upsert", "application/json",
+		`[{"id":"1","cityId":"lyon","weather":"Windy"},{"id":"4","cityId":"paris","weather":"Foggy"}]`)
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+
+	got := decodeBulkResponse(t, resp)
+	assert.Equal(t, http.StatusOK, got.Items[0].Status)
+	assert.Equal(t, http.StatusNotFound, got.Items[1].Status)
+
+	_, err := a.getObject("forecasts", "4")
+	assert.Error(t, err)
+}
+
+func Test_bulk_atomicDeleteAbortsCascade(t *testing.T) {
+	a, srv := newRelationsAPI(t, onDeleteCascade)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/cities/_bulk?op=delete&atomic=1", "application/json", `["lyon",{"id":"nantes"}]`)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	got := decodeBulkResponse(t, resp)
+	assert.Equal(t, http.StatusFailedDependency, got.Items[0].Status)
+	assert.Equal(t, http.StatusNotFound, got.Items[1].Status)
+
+	for _, ref := range []recordRef{{"cities", "lyon"}, {"forecasts", "1"}, {"forecasts", "2"}} {
+		_, err := a.getObject(ref.objType, ref.id)
+		assert.NoError(t, err, ref)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/cities/_bulk?op=delete", "application/json", `["lyon"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err := a.getObject("forecasts", "1")
+	assert.Error(t, err)
+}
+
+func Test_bulk_invalid(t *testing.T) {
+	_, srv := newRelationsAPI(t, "")
+
+	tests := []struct {
+		desc        string
+		query       string
+		contentType string
+		body        string
+		status      int
+	}{
+		{desc: "unknown op", query: "?op=merge", contentType: "application/json", body: `[]`, status: http.StatusBadRequest},
+		{desc: "invalid atomic", query: "?atomic=maybe", contentType: "application/json", body: `[]`, status: http.StatusBadRequest},
+		{desc: "not an array", contentType: "application/json", body: `{}`, status: http.StatusBadRequest},
+		{desc: "invalid NDJSON", contentType: "application/x-ndjson", body: "{}\n{", status: http.StatusBadRequest},
+		{desc: "unsupported media type", contentType: "text/csv", body: "a,b", status: http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			resp := doRequest(t, http.MethodPost, srv.URL+"/forecasts/_bulk"+test.query, test.contentType, test.body)
+			assert.Equal(t, test.status, resp.StatusCode)
+		})
+	}
+}
+
+func Test_bulk_authorization(t *testing.T) {
+	srv := newAuthAPI(t, authConfig{
+		APIKeys: []apiKeyCredential{{Key: "secret", Subject: "alice"}},
+		JWT:     jwtConfig{Secret: "secret"},
+	})
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "bob", "scope": "weather:write"}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc     string
+		token    string
+		expected int
+		item     int
+	}{
+		{desc: "api key", expected: http.StatusMultiStatus, item: http.StatusUnauthorized},
+		{desc: "api key and token with the write scope", token: token, expected: http.StatusOK, item: http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather/_bulk", strings.NewReader(`[{"city":"Lyon"}]`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "secret")
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+			require.Equal(t, test.expected, resp.StatusCode)
+
+			got := decodeBulkResponse(t, resp)
+			require.Len(t, got.Items, 1)
+			assert.Equal(t, test.item, got.Items[0].Status)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// responseCapture buffers a response so that it can be inspected or
+// rewritten before being sent to the client.
+type responseCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseCapture() *responseCapture {
+	return &responseCapture{header: http.Header{}}
+}
+
+func (c *responseCapture) Header() http.Header {
+	return c.header
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	return c.body.Write(b)
+}
+
+func (c *responseCapture) statusCode() int {
+	if c.status == 0 {
+		return http.StatusOK
+	}
+
+	return c.status
+}
+
+// flush sends the captured response with the given body.
+func (c *responseCapture) flush(rw http.ResponseWriter, body []byte) {
+	for k, v := range c.header {
+		rw.Header()[k] = v
+	}
+
+	rw.WriteHeader(c.statusCode())
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errNotAcceptable        = errors.New("not acceptable")
+)
+
+const mediaTypeJSONPatch = "application/json-patch+json"
+
+var xmlNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+}.DecMode()
+
+// codec serializes resources to and from one of the supported formats.
+type codec struct {
+	// mediaTypes lists the media types of the format, the first one being
+	// used in responses.
+	mediaTypes []string
+	// collectionsOnly is set for formats unable to represent a single
+	// object.
+	collectionsOnly bool
+	marshal         func(v interface{}) ([]byte, error)
+	unmarshal       func(data []byte) (interface{}, error)
+}
+
+var codecs = []*codec{
+	{
+		mediaTypes: []string{"application/json"},
+		marshal:    json.Marshal,
+		unmarshal: func(data []byte) (interface{}, error) {
+			var v interface{}
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+	},
+	{
+		mediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		marshal:    yaml.Marshal,
+		unmarshal: func(data []byte) (interface{}, error) {
+			var v interface{}
+			err := yaml.Unmarshal(data, &v)
+			return v, err
+		},
+	},
+	{
+		mediaTypes: []string{"application/xml", "text/xml"},
+		marshal:    marshalXML,
+		unmarshal:  unmarshalXML,
+	},
+	{
+		mediaTypes:      []string{"text/csv"},
+		collectionsOnly: true,
+		marshal:         marshalCSV,
+		unmarshal:       unmarshalCSV,
+	},
+	{
+		mediaTypes: []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		marshal:    msgpack.Marshal,
+		unmarshal: func(data []byte) (interface{}, error) {
+			var v interface{}
+			err := msgpack.Unmarshal(data, &v)
+			return v, err
+		},
+	},
+	{
+		mediaTypes: []string{"application/cbor"},
+		marshal:    cbor.Marshal,
+		unmarshal: func(data []byte) (interface{}, error) {
+			var v interface{}
+			err := cborDecMode.Unmarshal(data, &v)
+			return v, err
+		},
+	},
+}
+
+func codecMediaTypes(collection bool) []string {
+	var mediaTypes []string
+	for _, c := range codecs {
+		if c.collectionsOnly && !collection {
+			continue
+		}
+		mediaTypes = append(mediaTypes, c.mediaTypes...)
+	}
+
+	return mediaTypes
+}
+
+func codecFor(mediaType string) *codec {
+	for _, c := range codecs {
+		for _, mt := range c.mediaTypes {
+			if mt == mediaType {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+// responseCodec returns the codec matching the Accept header of the request.
+// Formats only able to represent collections are offered when collection is
+// set.
+func responseCodec(req *http.Request, collection bool) (*codec, error) {
+	mediaType := negotiate(req.Header.Get("Accept"), codecMediaTypes(collection))
+	if mediaType == "" {
+		return nil, fmt.Errorf("%w, supported media types: %s", errNotAcceptable, strings.Join(codecMediaTypes(collection), ", "))
+	}
+
+	return codecFor(mediaType), nil
+}
+
+// requestCodec returns the codec matching the Content-Type header of the
+// request. Requests without Content-Type, or with an unknown one such as the
+// form curl -d sends, are read as JSON, as they have always been.
+func requestCodec(req *http.Request) *codec {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return codecs[0]
+	}
+
+	if c := codecFor(mediaType); c != nil {
+		return c
+	}
+	if c := codecFor(suffixMediaType(mediaType)); c != nil {
+		return c
+	}
+
+	return codecs[0]
+}
+
+// decodeBody reads the request body in the format given by its Content-Type.
+func decodeBody(req *http.Request) (interface{}, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return requestCodec(req).unmarshal(body)
+}
+
+// decodeObject reads a single object from the request body.
+func decodeObject(req *http.Request) (map[string]interface{}, error) {
+	v, err := decodeBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Formats such as CSV only hold lists, a single row stands for an object.
+	if list, ok := v.([]interface{}); ok && len(list) == 1 {
+		v = list[0]
+	}
+
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("request body is not an object")
+	}
+
+	return obj, nil
+}
+
+// write sends v with the given status code.
+func (c *codec) write(rw http.ResponseWriter, status int, v interface{}) {
+	body, err := c.marshal(v)
+	if errors.Is(err, errNotAcceptable) {
+		JSONError(rw, http.StatusNotAcceptable, err.Error())
+		return
+	}
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", c.mediaTypes[0])
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
+
+// isJSONPatch tells whether a Content-Type is suitable for JSON patches,
+// which the other formats supported are not. JSON and unknown types are
+// accepted as well, as patches have long been read whatever their type.
+func isJSONPatch(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == mediaTypeJSONPatch {
+		return true
+	}
+
+	c := codecFor(mediaType)
+	return c == nil || c == codecs[0]
+}
+
+// bodyError reports an error met while decoding a request body.
+func bodyError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedMediaType) {
+		JSONError(rw, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+
+	JSONError(rw, http.StatusInternalServerError, err.Error())
+}
+
+// toGeneric converts the typed slices built by handlers to the generic
+// representation decoders produce.
+func toGeneric(v interface{}) interface{} {
+	if docs, ok := v.([]map[string]interface{}); ok {
+		list := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			list[i] = doc
+		}
+		return list
+	}
+
+	return v
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+
+	var err error
+	if list, ok := toGeneric(v).([]interface{}); ok {
+		err = writeXMLList(enc, "objects", "object", list)
+	} else {
+		err = writeXMLValue(enc, "object", v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func writeXMLValue(enc *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !xmlNameRe.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		// Keys which are not valid element names are kept in an attribute.
+		start = xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}},
+		}
+	}
+
+	switch value := toGeneric(v).(type) {
+	case map[string]interface{}:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, key := range sortedKeys(value) {
+			if err := writeXMLValue(enc, key, value[key]); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+
+	case []interface{}:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, item := range value {
+			if err := writeXMLValue(enc, "item", item); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+
+	case nil:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		return enc.EncodeToken(start.End())
+
+	default:
+		return enc.EncodeElement(scalarString(value), start)
+	}
+}
+
+func writeXMLList(enc *xml.Encoder, name, itemName string, list []interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, item := range list {
+		if err := writeXMLValue(enc, itemName, item); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+type xmlNode struct {
+	name     string
+	text     strings.Builder
+	children []*xmlNode
+}
+
+// unmarshalXML reads the documents produced by marshalXML. Leaf values are
+// read as strings, as XML carries no type information.
+func unmarshalXML(data []byte) (interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	var (
+		stack []*xmlNode
+		root  *xmlNode
+	)
+	for {
+		token, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local}
+			for _, attr := range t.Attr {
+				if t.Name.Local == "field" && attr.Name.Local == "name" {
+					node.name = attr.Value
+				}
+			}
+
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("empty XML document")
+	}
+
+	return root.value(), nil
+}
+
+func (n *xmlNode) value() interface{} {
+	if len(n.children) == 0 {
+		return n.text.String()
+	}
+
+	if n.isList() {
+		list := make([]interface{}, len(n.children))
+		for i, child := range n.children {
+			list[i] = child.value()
+		}
+		return list
+	}
+
+	obj := map[string]interface{}{}
+	for _, child := range n.children {
+		value := child.value()
+
+		existing, ok := obj[child.name]
+		if !ok {
+			obj[child.name] = value
+			continue
+		}
+
+		// Repeated elements make a list.
+		if list, isList := existing.([]interface{}); isList {
+			obj[child.name] = append(list, value)
+		} else {
+			obj[child.name] = []interface{}{existing, value}
+		}
+	}
+
+	return obj
+}
+
+func (n *xmlNode) isList() bool {
+	for _, child := range n.children {
+		if child.name != n.children[0].name {
+			return false
+		}
+	}
+
+	name := n.children[0].name
+	return len(n.children) > 1 || name == "item" || name == "object"
+}
+
+// marshalCSV writes a list of objects as CSV, with a column per field. The id
+// column comes first, then the other fields in alphabetical order.
+func marshalCSV(v interface{}) ([]byte, error) {
+	list, ok := toGeneric(v).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: CSV can only represent collections", errNotAcceptable)
+	}
+
+	columns := map[string]struct{}{}
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: CSV can only represent collections of objects", errNotAcceptable)
+		}
+		for k := range obj {
+			columns[k] = struct{}{}
+		}
+	}
+
+	header := make([]string, 0, len(columns))
+	for k := range columns {
+		if k != "id" {
+			header = append(header, k)
+		}
+	}
+	sort.Strings(header)
+	if _, ok := columns["id"]; ok {
+		header = append([]string{"id"}, header...)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	for _, item := range list {
+		obj := item.(map[string]interface{})
+
+		row := make([]string, len(header))
+		for i, column := range header {
+			switch value := obj[column].(type) {
+			case nil:
+			case map[string]interface{}, []interface{}:
+				nested, err := json.Marshal(value)
+				if err != nil {
+					return nil, err
+				}
+				row[i] = string(nested)
+			default:
+				row[i] = scalarString(value)
+			}
+		}
+
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// unmarshalCSV reads CSV rows as a list of objects keyed by the header row.
+func unmarshalCSV(data []byte) (interface{}, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty CSV document")
+	}
+
+	header := records[0]
+	list := make([]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		obj := map[string]interface{}{}
+		for i, column := range header {
+			if i < len(record) && record[i] != "" {
+				obj[column] = record[i]
+			}
+		}
+		list = append(list, obj)
+	}
+
+	return list, nil
+}
+
+func scalarString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case []byte:
+		return string(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func newCodecAPI(t *testing.T) (*api, *httptest.Server) {
+	t.Helper()
+
+	return newTestServer(t, nil)
+}
+
+func Test_responseFormats(t *testing.T) {
+	_, srv := newCodecAPI(t)
+
+	tests := []struct {
+		desc        string
+		path        string
+		accept      string
+		expected    int
+		contentType string
+		decode      func(t *testing.T, body []byte) interface{}
+	}{
+		{
+			desc:        "yaml",
+			path:        "/weather/0",
+			accept:      "application/yaml",
+			expected:    http.StatusOK,
+			contentType: "application/yaml",
+			decode: func(t *testing.T, body []byte) interface{} {
+				t.Helper()
+				v, err := codecFor("application/yaml").unmarshal(body)
+				require.NoError(t, err)
+				return v.(map[string]interface{})["city"]
+			},
+		},
+		{
+			desc:        "xml",
+			path:        "/weather/0",
+			accept:      "text/xml",
+			expected:    http.StatusOK,
+			contentType: "application/xml",
+			decode: func(t *testing.T, body []byte) interface{} {
+				t.Helper()
+				assert.Contains(t, string(body), "<city>GopherCity</city>")
+				return "GopherCity"
+			},
+		},
+		{
+			desc:        "msgpack",
+			path:        "/weather/0",
+			accept:      "application/msgpack",
+			expected:    http.StatusOK,
+			contentType: "application/msgpack",
+			decode: func(t *testing.T, body []byte) interface{} {
+				t.Helper()
+				var doc map[string]interface{}
+				require.NoError(t, msgpack.Unmarshal(body, &doc))
+				return doc["city"]
+			},
+		},
+		{
+			desc:        "cbor",
+			path:        "/weather/0",
+			accept:      "application/cbor",
+			expected:    http.StatusOK,
+			contentType: "application/cbor",
+			decode: func(t *testing.T, body []byte) interface{} {
+				t.Helper()
+				var doc map[string]interface{}
+				require.NoError(t, cbor.Unmarshal(body, &doc))
+				return doc["city"]
+			},
+		},
+		{
+			desc:        "csv collection",
+			path:        "/weather",
+			accept:      "text/csv",
+			expected:    http.StatusOK,
+			contentType: "text/csv",
+			decode: func(t *testing.T, body []byte) interface{} {
+				t.Helper()
+				assert.Contains(t, string(body), "id,city,weather\n")
+				assert.Contains(t, string(body), "0,GopherCity,Moderate rain\n")
+				return "GopherCity"
+			},
+		},
+		{desc: "csv single object", path: "/weather/0", accept: "text/csv", expected: http.StatusNotAcceptable},
+		{desc: "unsupported", path: "/weather", accept: "text/html", expected: http.StatusNotAcceptable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+test.path, http.NoBody)
+			require.NoError(t, err)
+			req.Header.Set("Accept", test.accept)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+			if test.decode == nil {
+				return
+			}
+
+			assert.Equal(t, test.contentType, resp.Header.Get("Content-Type"))
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "GopherCity", test.decode(t, body))
+		})
+	}
+}
+
+func Test_requestFormats(t *testing.T) {
+	msgpackBody, err := msgpack.Marshal(map[string]interface{}{"city": "Lyon"})
+	require.NoError(t, err)
+	cborBody, err := cbor.Marshal(map[string]interface{}{"city": "Lyon"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc        string
+		contentType string
+		body        []byte
+		expected    int
+	}{
+		{desc: "json", contentType: "application/json", body: []byte(`{"city": "Lyon"}`), expected: http.StatusCreated},
+		{desc: "json suffix", contentType: "application/vnd.weather+json", body: []byte(`{"city": "Lyon"}`), expected: http.StatusCreated},
+		{desc: "yaml", contentType: "application/yaml", body: []byte("city: Lyon\n"), expected: http.StatusCreated},
+		{desc: "xml", contentType: "application/xml", body: []byte(`<object><city>Lyon</city></object>`), expected: http.StatusCreated},
+		{desc: "csv", contentType: "text/csv", body: []byte("city\nLyon\n"), expected: http.StatusCreated},
+		{desc: "msgpack", contentType: "application/msgpack", body: msgpackBody, expected: http.StatusCreated},
+		{desc: "cbor", contentType: "application/cbor", body: cborBody, expected: http.StatusCreated},
+		{desc: "form read as json", contentType: "application/x-www-form-urlencoded", body: []byte(`{"city": "Lyon"}`), expected: http.StatusCreated},
+		{desc: "unknown read as json", contentType: "text/plain", body: []byte(`{"city": "Lyon"}`), expected: http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			a, srv := newCodecAPI(t)
+
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather", bytes.NewReader(test.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", test.contentType)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			require.Equal(t, test.expected, resp.StatusCode)
+			if test.expected != http.StatusCreated {
+				return
+			}
+
+			var created map[string]string
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+			obj, err := a.getObject("weather", created["id"])
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"city": "Lyon"}`, string(obj))
+		})
+	}
+}
+
+func Test_xmlRoundTrip(t *testing.T) {
+	doc := []interface{}{
+		map[string]interface{}{
+			"id":      "0",
+			"city":    "GopherCity",
+			"tags":    []interface{}{"rain", "wind"},
+			"my key":  "value",
+			"details": map[string]interface{}{"humidity": "80"},
+		},
+	}
+
+	body, err := marshalXML(doc)
+	require.NoError(t, err)
+
+	v, err := unmarshalXML(body)
+	require.NoError(t, err)
+	assert.Equal(t, doc, v)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config holds the optional features of the server, loaded from the file
+// given with the -config flag.
+type config struct {
+	Auth        *authConfig         `yaml:"auth"`
+	Identity    identityConfig      `yaml:"identity"`
+	Versioning  *versioningConfig   `yaml:"versioning"`
+	Deprecation deprecationConfig   `yaml:"deprecation"`
+	Relations   []relationConfig    `yaml:"relations"`
+	Idempotency idempotencyConfig   `yaml:"idempotency"`
+	IDs         map[string]idConfig `yaml:"ids"`
+	Events      eventsConfig        `yaml:"events"`
+	Webhooks    webhooksConfig      `yaml:"webhooks"`
+	GraphQL     graphqlConfig       `yaml:"graphql"`
+	GRPC        grpcConfig          `yaml:"grpc"`
+	Recording   recordingConfig     `yaml:"recording"`
+	Proxy       *proxyConfig        `yaml:"proxy"`
+	Scenarios   []scenarioConfig    `yaml:"scenarios"`
+	RateLimits  []rateLimitConfig   `yaml:"rateLimits"`
+	// TrustedProxies lists the addresses, or CIDR ranges, of the proxies
+	// whose X-Forwarded-For header identifies the clients of the rate limits.
+	TrustedProxies []string       `yaml:"trustedProxies"`
+	Tenants        *tenantsConfig `yaml:"tenants"`
+	History        historyConfig  `yaml:"history"`
+	Audit          auditConfig    `yaml:"audit"`
+	// Indexes lists the fields indexed per collection, to speed up the
+	// searches on equality.
+	Indexes    map[string][]string   `yaml:"indexes"`
+	Generators []generatorConfig     `yaml:"generators"`
+	Routes     []templateRouteConfig `yaml:"routes"`
+}
+
+func loadConfig(path string) (*config, error) {
+	rawConfig, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+	err = yaml.Unmarshal(rawConfig, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (a *api) configure(cfg *config) error {
+	if cfg.Tenants != nil && cfg.Versioning != nil {
+		return errors.New("tenants can't be combined with versioning")
+	}
+
+	if cfg.Auth != nil {
+		auth, err := newAuthenticator(*cfg.Auth)
+		if err != nil {
+			return err
+		}
+		a.auth = auth
+	}
+
+	a.identity = cfg.Identity
+	a.deprecation = cfg.Deprecation
+	a.idempotency = cfg.Idempotency
+	a.eventsConfig = cfg.Events
+	a.events.size = cfg.Events.bufferSize()
+	a.webhooks.configure(cfg.Webhooks)
+
+	if err := cfg.GraphQL.validate(); err != nil {
+		return err
+	}
+	a.graphql = cfg.GraphQL
+
+	if err := validateRelations(cfg.Relations); err != nil {
+		return err
+	}
+	a.relations = cfg.Relations
+
+	if err := validateIDs(cfg.IDs); err != nil {
+		return err
+	}
+	a.ids = cfg.IDs
+
+	if err := validateScenarios(cfg.Scenarios); err != nil {
+		return err
+	}
+	a.scenarios.configure(cfg.Scenarios)
+
+	if err := validateRateLimits(cfg.RateLimits); err != nil {
+		return err
+	}
+	a.rateLimits = newRateLimiter(cfg.RateLimits)
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	a.trustedProxies = trustedProxies
+
+	if err := validateIndexes(cfg.Indexes); err != nil {
+		return err
+	}
+	a.indexes.configure(cfg.Indexes)
+	if len(cfg.Indexes) > 0 {
+		a.events.listen(a.indexes.record)
+	}
+
+	if err := validateGenerators(cfg.Generators); err != nil {
+		return err
+	}
+
+	routes, err := newTemplateRoutes(cfg.Routes)
+	if err != nil {
+		return err
+	}
+	a.templateRoutes = routes
+
+	if cfg.History.Enabled {
+		a.mu.RLock()
+		a.history.configure(cfg.History, a.data)
+		a.mu.RUnlock()
+		a.events.listen(a.history.record)
+	}
+
+	if cfg.Audit.Enabled {
+		a.mu.RLock()
+		err := a.audit.configure(cfg.Audit, a.data)
+		a.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		a.events.listen(a.audit.record)
+	}
+
+	// Generators are started by the instances serving the requests, so that
+	// the listeners see the first generation.
+	a.generators.configure(cfg.Generators)
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDeprecationClients is the number of clients counted apart per
+	// operation, the calls of the others are counted together.
+	maxDeprecationClients   = 1000
+	otherDeprecationClients = "(other)"
+)
+
+var specDateLayouts = []string{time.RFC3339, time.DateOnly, http.TimeFormat}
+
+type deprecationConfig struct {
+	// RejectAfterSunset answers 410 Gone to calls made after the sunset date
+	// of an operation.
+	RejectAfterSunset bool `yaml:"rejectAfterSunset"`
+}
+
+// deprecationUsage counts the calls made to deprecated operations, per
+// operation and per client.
+type deprecationUsage struct {
+	mu    sync.Mutex
+	calls map[string]*deprecationReport
+}
+
+type deprecationReport struct {
+	OperationID string         `json:"operationId,omitempty"`
+	Method      string         `json:"method"`
+	Path        string         `json:"path"`
+	Sunset      string         `json:"sunset,omitempty"`
+	Clients     map[string]int `json:"clients"`
+}
+
+func (u *deprecationUsage) count(op *specOperation, client string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.calls == nil {
+		u.calls = map[string]*deprecationReport{}
+	}
+
+	// Operations are keyed by method and path so that counts survive spec
+	// reloads.
+	key := op.Method + " " + op.Path
+	report, ok := u.calls[key]
+	if !ok {
+		report = &deprecationReport{Method: op.Method, Path: op.Path, Clients: map[string]int{}}
+		u.calls[key] = report
+	}
+	report.OperationID = op.OperationID
+	report.Sunset = op.Sunset
+
+	if _, ok := report.Clients[client]; !ok && len(report.Clients) >= maxDeprecationClients {
+		client = otherDeprecationClients
+	}
+	report.Clients[client]++
+}
+
+func (u *deprecationUsage) report() []deprecationReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	reports := make([]deprecationReport, 0, len(u.calls))
+	for _, call := range u.calls {
+		report := *call
+		report.Clients = make(map[string]int, len(call.Clients))
+		for client, n := range call.Clients {
+			report.Clients[client] = n
+		}
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Path != reports[j].Path {
+			return reports[i].Path < reports[j].Path
+		}
+		return reports[i].Method < reports[j].Method
+	})
+
+	return reports
+}
+
+// deprecationMiddleware signals deprecated and sunset operations with the
+// Deprecation (RFC 9745), Sunset (RFC 8594) and Link headers.
+func (a *api) deprecationMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			op := a.getSpecDocument().findOperation(r.Method, r.URL.Path)
+			if op == nil || (!op.Deprecated && op.Sunset == "") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if op.Deprecated {
+				if date, ok := parseSpecDate(op.DeprecationDate); ok {
+					w.Header().Set("Deprecation", fmt.Sprintf("@%d", date.Unix()))
+				} else {
+					// Without a date, fall back to the value of the earlier drafts.
+					w.Header().Set("Deprecation", "true")
+				}
+
+				a.deprecations.count(op, a.clientIdentity(r))
+			}
+
+			if op.SuccessorVersion != "" {
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", op.SuccessorVersion))
+			}
+
+			sunset, ok := parseSpecDate(op.Sunset)
+			if ok {
+				w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+
+				if a.deprecation.RejectAfterSunset && time.Now().After(sunset) {
+					JSONError(w, http.StatusGone, fmt.Sprintf("%s %s has been sunset", op.Method, op.Path))
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func (a *api) handleDeprecations(rw http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(a.deprecations.report())
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(body)
+}
+
+func parseSpecDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	for _, layout := range specDateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date, true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const deprecatedSpec = `openapi: "3.0.0"
+info:
+  version: 1.0.0
+  title: Weather
+paths:
+  /weather:
+    get:
+      operationId: getAll
+      deprecated: true
+      x-deprecation-date: "2024-01-01T00:00:00Z"
+      x-sunset: "2999-12-31"
+      x-successor-version: "https://api.example.com/v2/weather"
+      responses:
+        '200':
+          description: An array of weather data
+  /weather/{id}:
+    get:
+      operationId: get
+      deprecated: true
+      x-sunset: "2000-01-01"
+      responses:
+        '200':
+          description: A weather
+    delete:
+      operationId: delete
+      responses:
+        '204':
+          description: No content
+`
+
+func newDeprecatedAPI(t *testing.T, cfg deprecationConfig) *httptest.Server {
+	t.Helper()
+
+	specPath := filepath.Join(t.TempDir(), "openapi.yaml")
+	require.NoError(t, os.WriteFile(specPath, []byte(deprecatedSpec), 0o600))
+
+	a, srv := newTestServer(t, &config{Deprecation: cfg})
+	require.NoError(t, a.loadOpenAPISpec(specPath))
+
+	return srv
+}
+
+func Test_deprecationMiddleware(t *testing.T) {
+	srv := newDeprecatedAPI(t, deprecationConfig{})
+
+	resp, err := http.Get(srv.URL + "/weather")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "@1704067200", resp.Header.Get("Deprecation"))
+	assert.Equal(t, "Tue, 31 Dec 2999 00:00:00 GMT", resp.Header.Get("Sunset"))
+	assert.Equal(t, `<https://api.example.com/v2/weather>; rel="successor-version"`, resp.Header.Get("Link"))
+
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/weather/0", http.NoBody)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Empty(t, resp.Header.Get("Deprecation"))
+	assert.Empty(t, resp.Header.Get("Sunset"))
+}
+
+func Test_deprecationMiddleware_afterSunset(t *testing.T) {
+	tests := []struct {
+		desc     string
+		cfg      deprecationConfig
+		expected int
+	}{
+		{desc: "signal only", expected: http.StatusOK},
+		{desc: "reject", cfg: deprecationConfig{RejectAfterSunset: true}, expected: http.StatusGone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newDeprecatedAPI(t, test.cfg)
+
+			resp, err := http.Get(srv.URL + "/weather/0")
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+			assert.Equal(t, "true", resp.Header.Get("Deprecation"))
+			assert.Equal(t, "Sat, 01 Jan 2000 00:00:00 GMT", resp.Header.Get("Sunset"))
+		})
+	}
+}
+
+func Test_handleDeprecations(t *testing.T) {
+	srv := newDeprecatedAPI(t, deprecationConfig{})
+
+	for _, consumer := range []string{"alice", "alice", "bob"} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("X-Hub-Consumer", consumer)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/_deprecations")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var reports []deprecationReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+
+	assert.Equal(t, []deprecationReport{{
+		OperationID: "getAll",
+		Method:      http.MethodGet,
+		Path:        "/weather",
+		Sunset:      "2999-12-31",
+		Clients:     map[string]int{"alice": 2, "bob": 1},
+	}}, reports)
+}
+
+func Test_deprecationUsage_maxClients(t *testing.T) {
+	var usage deprecationUsage
+	op := &specOperation{Method: http.MethodGet, Path: "/weather"}
+
+	for i := range maxDeprecationClients + 2 {
+		usage.count(op, fmt.Sprintf("client-%d", i))
+	}
+	usage.count(op, "client-0")
+
+	reports := usage.report()
+	require.Len(t, reports, 1)
+	assert.Len(t, reports[0].Clients, maxDeprecationClients+1)
+	assert.Equal(t, 2, reports[0].Clients["client-0"])
+	assert.Equal(t, 2, reports[0].Clients[otherDeprecationClients])
+}
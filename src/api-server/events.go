@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+
+	defaultEventsBufferSize = 1000
+	defaultEventsHeartbeat  = 15 * time.Second
+
+	// subscriberBufferSize is how many events a subscriber can lag behind
+	// before being disconnected. Clients then resume from their last event.
+	subscriberBufferSize = 64
+)
+
+type eventsConfig struct {
+	// BufferSize is the number of events kept for clients resuming a feed.
+	BufferSize int `yaml:"bufferSize"`
+	// Heartbeat is the interval of the keep-alive messages of the feeds.
+	Heartbeat time.Duration `yaml:"heartbeat"`
+}
+
+func (c eventsConfig) bufferSize() int {
+	if c.BufferSize <= 0 {
+		return defaultEventsBufferSize
+	}
+
+	return c.BufferSize
+}
+
+func (c eventsConfig) heartbeat() time.Duration {
+	if c.Heartbeat <= 0 {
+		return defaultEventsHeartbeat
+	}
+
+	return c.Heartbeat
+}
+
+// event is a change made to a record.
+type event struct {
+	ID         uint64          `json:"eventId"`
+	Type       string          `json:"type"`
+	Collection string          `json:"collection"`
+	ObjectID   string          `json:"objectId"`
+	Object     json.RawMessage `json:"object,omitempty"`
+	Time       time.Time       `json:"time"`
+	// request is the audited request which made the change, if any.
+	request *auditRequest
+}
+
+// eventBus publishes the changes made to the records, and keeps the latest
+// ones so that subscribers can resume where they left.
+type eventBus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	buffer      []event
+	size        int
+	subscribers map[chan event]struct{}
+	// listeners are called on each event, while the records are locked.
+	listeners []func(event)
+}
+
+func (b *eventBus) publish(ctx context.Context, typ, collection, objectID string, obj json.RawMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	evt := event{
+		ID:         b.lastID,
+		Type:       typ,
+		Collection: collection,
+		ObjectID:   objectID,
+		Object:     obj,
+		Time:       time.Now().UTC(),
+		request:    auditRequestFromContext(ctx),
+	}
+
+	size := b.size
+	if size <= 0 {
+		size = defaultEventsBufferSize
+	}
+	b.buffer = append(b.buffer, evt)
+	if len(b.buffer) > size {
+		b.buffer = b.buffer[len(b.buffer)-size:]
+	}
+
+	for _, listener := range b.listeners {
+		listener(evt)
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the next events, along with the
+// buffered events following lastID when resuming. The channel is closed when
+// the subscriber lags too much behind.
+func (b *eventBus) subscribe(lastID uint64, resume bool) ([]event, chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []event
+	for _, evt := range b.buffer {
+		if resume && evt.ID > lastID {
+			missed = append(missed, evt)
+		}
+	}
+
+	ch := make(chan event, subscriberBufferSize)
+	if b.subscribers == nil {
+		b.subscribers = map[chan event]struct{}{}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return missed, ch
+}
+
+// listen registers fn to be called on each event. Unlike subscribers,
+// listeners never miss events, and must not block.
+func (b *eventBus) listen(fn func(event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, fn)
+}
+
+func (b *eventBus) unsubscribe(ch chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	// The feed is read-only and protected by the auth middleware like the
+	// rest of the API, browsers from any origin may use it.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// handleEvents streams the changes of a collection, as Server-Sent Events or
+// over a WebSocket. Clients resume a feed with the Last-Event-ID header, or
+// the lastEventId query parameter.
+func (a *api) handleEvents(rw http.ResponseWriter, req *http.Request) {
+	objType := chi.URLParam(req, "objType")
+
+	lastID, resume, err := lastEventID(req)
+	if err != nil {
+		JSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		a.streamWebSocket(rw, req, objType, lastID, resume)
+		return
+	}
+
+	a.streamSSE(rw, req, objType, lastID, resume)
+}
+
+func (a *api) streamSSE(rw http.ResponseWriter, req *http.Request, objType string, lastID uint64, resume bool) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		JSONError(rw, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	missed, ch := a.events.subscribe(lastID, resume)
+	defer a.events.unsubscribe(ch)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(evt event) error {
+		if evt.Collection != objType {
+			return nil
+		}
+
+		data, err := json.Marshal(evt)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", evt.ID, evt.Type, data)
+		return err
+	}
+
+	for _, evt := range missed {
+		if err := send(evt); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(a.eventsConfig.heartbeat())
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(rw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case evt, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(evt); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (a *api) streamWebSocket(rw http.ResponseWriter, req *http.Request, objType string, lastID uint64, resume bool) {
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		// The upgrader already answered the client.
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	missed, ch := a.events.subscribe(lastID, resume)
+	defer a.events.unsubscribe(ch)
+
+	// Reading is required to process the control messages, and tells when
+	// the client goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(evt event) error {
+		if evt.Collection != objType {
+			return nil
+		}
+		return conn.WriteJSON(evt)
+	}
+
+	for _, evt := range missed {
+		if err := send(evt); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(a.eventsConfig.heartbeat())
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-heartbeat.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(a.eventsConfig.heartbeat()))
+			if err != nil {
+				return
+			}
+
+		case evt, ok := <-ch:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(time.Second))
+				return
+			}
+			if err := send(evt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// lastEventID returns the ID of the last event received by a client resuming
+// a feed.
+func lastEventID(req *http.Request) (uint64, bool, error) {
+	value := req.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = req.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid event ID %q", value)
+	}
+
+	return id, true, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEventsAPI(t *testing.T) (*api, *httptest.Server) {
+	t.Helper()
+
+	return newTestServer(t, &config{Events: eventsConfig{BufferSize: 2}})
+}
+
+// readSSE returns the next n events of a stream, skipping comments.
+func readSSE(t *testing.T, reader *bufio.Reader, n int) []map[string]string {
+	t.Helper()
+
+	var events []map[string]string
+	current := map[string]string{}
+	for len(events) < n {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if len(current) > 0 {
+				events = append(events, current)
+				current = map[string]string{}
+			}
+		case strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ": ")
+			current[field] = value
+		}
+	}
+
+	return events
+}
+
+func openSSE(t *testing.T, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	return bufio.NewReader(resp.Body)
+}
+
+func Test_handleEvents_sse(t *testing.T) {
+	a, srv := newEventsAPI(t)
+
+	reader := openSSE(t, srv.URL+"/weather/_events", "")
+
+	a.setObject(context.Background(), "cities", "lyon", json.RawMessage(`{"name":"Lyon"}`))
+	a.setObject(context.Background(), "weather", "0", json.RawMessage(`{"city":"Lyon"}`))
+	a.deleteObject(context.Background(), "weather", "1")
+
+	events := readSSE(t, reader, 2)
+
+	assert.Equal(t, "2", events[0]["id"])
+	assert.Equal(t, "updated", events[0]["event"])
+	assert.Contains(t, events[0]["data"], `"object":{"city":"Lyon"}`)
+	assert.Equal(t, "3", events[1]["id"])
+	assert.Equal(t, "deleted", events[1]["event"])
+	assert.Contains(t, events[1]["data"], `"objectId":"1"`)
+}
+
+func Test_handleEvents_resume(t *testing.T) {
+	a, srv := newEventsAPI(t)
+
+	a.setObject(context.Background(), "weather", "3", json.RawMessage(`{}`))
+	a.setObject(context.Background(), "weather", "4", json.RawMessage(`{}`))
+	a.setObject(context.Background(), "weather", "5", json.RawMessage(`{}`))
+
+	reader := openSSE(t, srv.URL+"/weather/_events", "1")
+
+	// The buffer only holds the last 2 events.
+	events := readSSE(t, reader, 2)
+	assert.Equal(t, "2", events[0]["id"])
+	assert.Equal(t, "created", events[0]["event"])
+	assert.Equal(t, "3", events[1]["id"])
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/_events", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/_events", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "nope")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_handleEvents_webSocket(t *testing.T) {
+	a, srv := newEventsAPI(t)
+
+	a.setObject(context.Background(), "weather", "3", json.RawMessage(`{"city":"Lyon"}`))
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/weather/_events?lastEventId=0"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	defer func() { _ = conn.Close() }()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var evt event
+	require.NoError(t, conn.ReadJSON(&evt))
+	assert.Equal(t, uint64(1), evt.ID)
+	assert.Equal(t, "created", evt.Type)
+	assert.Equal(t, "3", evt.ObjectID)
+
+	a.deleteObject(context.Background(), "weather", "3")
+
+	evt = event{}
+	require.NoError(t, conn.ReadJSON(&evt))
+	assert.Equal(t, uint64(2), evt.ID)
+	assert.Equal(t, "deleted", evt.Type)
+	assert.Empty(t, evt.Object)
+}
+
+func Test_eventBus_slowSubscriber(t *testing.T) {
+	bus := &eventBus{}
+
+	_, ch := bus.subscribe(0, false)
+	for range subscriberBufferSize + 1 {
+		bus.publish(context.Background(), eventCreated, "weather", "0", nil)
+	}
+
+	for range ch {
+	}
+	assert.Empty(t, bus.subscribers)
+
+	missed, _ := bus.subscribe(uint64(subscriberBufferSize), true)
+	require.Len(t, missed, 1)
+	assert.Equal(t, uint64(subscriberBufferSize+1), missed[0].ID)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	generatorDaily      = "daily"
+	generatorRandomWalk = "randomWalk"
+	generatorRandom     = "random"
+	generatorChoice     = "choice"
+	generatorDerived    = "derived"
+	generatorNow        = "now"
+
+	defaultGeneratorInterval = time.Minute
+	defaultGeneratorPeak     = "15:00"
+)
+
+// generatorConfig makes the records of a collection vary over time. Each
+// interval, the generated fields of the records are computed again and
+// stored, which feeds the change feed.
+type generatorConfig struct {
+	Collection string `yaml:"collection"`
+	// Records lists the IDs of the generated records, which are created when
+	// missing. All the records of the collection by default.
+	Records []string `yaml:"records"`
+	// Interval is the time between two generations, a minute by default.
+	Interval time.Duration `yaml:"interval"`
+	// Seed makes the random values reproducible.
+	Seed   uint64                          `yaml:"seed"`
+	Fields map[string]fieldGeneratorConfig `yaml:"fields"`
+}
+
+// fieldGeneratorConfig generates the values of a field:
+//   - daily follows a daily curve between min and max, peaking at peak,
+//   - randomWalk moves the value by at most step each time,
+//   - random picks a value between min and max,
+//   - choice picks one of values,
+//   - derived computes the value from the from field of the record, once
+//     the other fields are generated: from plus offset, or the value of the
+//     first threshold it is below,
+//   - now is the time of the generation.
+//
+// Noise adds a random value between -noise and noise to numbers, which are
+// rounded to decimals.
+type fieldGeneratorConfig struct {
+	Type string  `yaml:"type"`
+	Min  float64 `yaml:"min"`
+	Max  float64 `yaml:"max"`
+	// Peak is the UTC time of the daily maximum, 15:00 by default.
+	Peak string `yaml:"peak"`
+	// Step is the largest move of random walks, a twentieth of the range by
+	// default.
+	Step       float64              `yaml:"step"`
+	Values     []interface{}        `yaml:"values"`
+	From       string               `yaml:"from"`
+	Offset     float64              `yaml:"offset"`
+	Thresholds []generatorThreshold `yaml:"thresholds"`
+	// Default is the derived value above all the thresholds.
+	Default  interface{} `yaml:"default"`
+	Noise    float64     `yaml:"noise"`
+	Decimals int         `yaml:"decimals"`
+}
+
+type generatorThreshold struct {
+	Below float64     `yaml:"below"`
+	Value interface{} `yaml:"value"`
+}
+
+func (c generatorConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return defaultGeneratorInterval
+	}
+
+	return c.Interval
+}
+
+// peak returns the time of the day of the daily maximum.
+func (c fieldGeneratorConfig) peak() (time.Duration, error) {
+	peak := c.Peak
+	if peak == "" {
+		peak = defaultGeneratorPeak
+	}
+
+	t, err := time.Parse("15:04", peak)
+	if err != nil {
+		return 0, fmt.Errorf("invalid peak %q, expecting HH:MM", peak)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func validateGenerators(generators []generatorConfig) error {
+	collections := map[string]bool{}
+	for _, g := range generators {
+		if g.Collection == "" {
+			return errors.New("generator without collection")
+		}
+		if collections[g.Collection] {
+			return fmt.Errorf("duplicated generator of %q", g.Collection)
+		}
+		collections[g.Collection] = true
+
+		if len(g.Fields) == 0 {
+			return fmt.Errorf("generator of %q: no field to generate", g.Collection)
+		}
+
+		for name, f := range g.Fields {
+			if err := f.validate(); err != nil {
+				return fmt.Errorf("generator of %q: field %q: %w", g.Collection, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c fieldGeneratorConfig) validate() error {
+	switch c.Type {
+	case generatorDaily, generatorRandomWalk, generatorRandom:
+		if c.Min > c.Max {
+			return fmt.Errorf("min %v is greater than max %v", c.Min, c.Max)
+		}
+		if _, err := c.peak(); err != nil {
+			return err
+		}
+	case generatorChoice:
+		if len(c.Values) == 0 {
+			return errors.New("no values to choose from")
+		}
+	case generatorDerived:
+		if c.From == "" {
+			return errors.New("no field to derive from")
+		}
+	case generatorNow:
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+
+	if c.Noise < 0 || c.Decimals < 0 {
+		return errors.New("noise and decimals must not be negative")
+	}
+
+	return nil
+}
+
+// generatorStatus describes a generator, as listed by /_generators.
+type generatorStatus struct {
+	Collection  string    `json:"collection"`
+	Interval    string    `json:"interval"`
+	Seed        uint64    `json:"seed"`
+	Generations int       `json:"generations"`
+	Last        time.Time `json:"last"`
+}
+
+type generator struct {
+	cfg         generatorConfig
+	rng         *rand.Rand
+	generations int
+	last        time.Time
+}
+
+// generatorEngine runs the generators of the collections.
+type generatorEngine struct {
+	mu         sync.Mutex
+	generators []*generator
+	stop       chan struct{}
+}
+
+func (e *generatorEngine) configure(generators []generatorConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.generators = nil
+	for _, cfg := range generators {
+		e.generators = append(e.generators, &generator{
+			cfg: cfg,
+			rng: rand.New(rand.NewPCG(cfg.Seed, cfg.Seed)),
+		})
+	}
+}
+
+// start generates the records, then generates them again at the interval of
+// each generator, until stopped.
+func (e *generatorEngine) start(a *api) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stop != nil || len(e.generators) == 0 {
+		return
+	}
+	e.stop = make(chan struct{})
+
+	now := time.Now()
+	for _, g := range e.generators {
+		g.run(a, now)
+
+		go func(g *generator, stop chan struct{}) {
+			ticker := time.NewTicker(g.cfg.interval())
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-stop:
+					return
+				case now := <-ticker.C:
+					e.mu.Lock()
+					// The generators may have been stopped while waiting.
+					select {
+					case <-stop:
+					default:
+						g.run(a, now)
+					}
+					e.mu.Unlock()
+				}
+			}
+		}(g, e.stop)
+	}
+}
+
+// shutdown stops the generators.
+func (e *generatorEngine) shutdown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+}
+
+// generate runs all the generators at now.
+func (e *generatorEngine) generate(a *api, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, g := range e.generators {
+		g.run(a, now)
+	}
+}
+
+func (e *generatorEngine) list() []generatorStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	statuses := make([]generatorStatus, 0, len(e.generators))
+	for _, g := range e.generators {
+		statuses = append(statuses, generatorStatus{
+			Collection:  g.cfg.Collection,
+			Interval:    g.cfg.interval().String(),
+			Seed:        g.cfg.Seed,
+			Generations: g.generations,
+			Last:        g.last,
+		})
+	}
+
+	return statuses
+}
+
+// run stores the records generated at now. The engine must be locked. The
+// records are locked while generated, so that no change made in between is
+// lost.
+func (g *generator) run(a *api, now time.Time) {
+	// The changes are audited as made by the generator, not by the request
+	// being served.
+	ctx := withAuditRequest(context.Background(), &auditRequest{caller: "generator", operation: "generate " + g.cfg.Collection})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := g.cfg.Records
+	if len(ids) == 0 {
+		ids = sortedKeys(a.data[g.cfg.Collection])
+	}
+
+	for _, id := range ids {
+		doc := map[string]interface{}{}
+		if obj, ok := a.data[g.cfg.Collection][id]; ok {
+			if err := json.Unmarshal(obj, &doc); err != nil {
+				log.Printf("Unable to generate %s/%s: %v", g.cfg.Collection, id, err)
+				continue
+			}
+		}
+
+		g.generate(doc, now)
+
+		data, err := json.Marshal(doc)
+		if err != nil {
+			log.Printf("Unable to generate %s/%s: %v", g.cfg.Collection, id, err)
+			continue
+		}
+		a.storeObject(ctx, g.cfg.Collection, id, data)
+	}
+
+	g.generations++
+	g.last = now
+}
+
+// generate sets the generated fields of doc at now. Derived fields are
+// generated last, from the other fields.
+func (g *generator) generate(doc map[string]interface{}, now time.Time) {
+	names := sortedKeys(g.cfg.Fields)
+	sort.SliceStable(names, func(i, j int) bool {
+		return g.cfg.Fields[names[i]].Type != generatorDerived && g.cfg.Fields[names[j]].Type == generatorDerived
+	})
+
+	for _, name := range names {
+		f := g.cfg.Fields[name]
+
+		var value float64
+		switch f.Type {
+		case generatorNow:
+			doc[name] = now.UTC().Format(time.RFC3339)
+			continue
+
+		case generatorChoice:
+			doc[name] = f.Values[g.rng.IntN(len(f.Values))]
+			continue
+
+		case generatorDaily:
+			peak, _ := f.peak()
+			sinceMidnight := now.UTC().Sub(now.UTC().Truncate(24 * time.Hour))
+			phase := 2 * math.Pi * (sinceMidnight - peak).Hours() / 24
+			value = (f.Min+f.Max)/2 + (f.Max-f.Min)/2*math.Cos(phase)
+
+		case generatorRandomWalk:
+			current, ok := doc[name].(float64)
+			if !ok {
+				current = (f.Min + f.Max) / 2
+			}
+			step := f.Step
+			if step <= 0 {
+				step = (f.Max - f.Min) / 20
+			}
+			value = math.Max(f.Min, math.Min(f.Max, current+g.uniform(step)))
+
+		case generatorRandom:
+			value = f.Min + g.rng.Float64()*(f.Max-f.Min)
+
+		case generatorDerived:
+			from, ok := doc[f.From].(float64)
+			if !ok {
+				continue
+			}
+			if len(f.Thresholds) > 0 {
+				doc[name] = f.Default
+				for _, threshold := range f.Thresholds {
+					if from < threshold.Below {
+						doc[name] = threshold.Value
+						break
+					}
+				}
+				continue
+			}
+			value = from + f.Offset
+		}
+
+		if f.Noise > 0 {
+			value += g.uniform(f.Noise)
+		}
+		if f.Type != generatorDerived {
+			value = math.Max(f.Min, math.Min(f.Max, value))
+		}
+
+		scale := math.Pow(10, float64(f.Decimals))
+		doc[name] = math.Round(value*scale) / scale
+	}
+}
+
+// uniform returns a random value between -amplitude and amplitude.
+func (g *generator) uniform(amplitude float64) float64 {
+	return (g.rng.Float64()*2 - 1) * amplitude
+}
+
+func (a *api) handleGetGenerators(rw http.ResponseWriter, _ *http.Request) {
+	writeJSONResponse(rw, http.StatusOK, a.generators.list())
+}
+
+// handleGenerate runs the generators right away, without waiting for their
+// interval.
+func (a *api) handleGenerate(rw http.ResponseWriter, _ *http.Request) {
+	a.generators.generate(a, time.Now())
+
+	writeJSONResponse(rw, http.StatusOK, a.generators.list())
+}
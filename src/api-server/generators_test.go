@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGeneratorsAPI(t *testing.T, generators []generatorConfig) *api {
+	t.Helper()
+
+	a := &api{
+		data: map[string]map[string]json.RawMessage{
+			"weather": {
+				"0": json.RawMessage(`{"city":"GopherCity","weather":"Moderate rain"}`),
+				"1": json.RawMessage(`{"city":"City of Gophers","weather":"Sunny"}`),
+			},
+		},
+	}
+	require.NoError(t, a.configure(&config{Generators: generators}))
+	a.generators.start(a)
+	t.Cleanup(a.generators.shutdown)
+
+	return a
+}
+
+func getDoc(t *testing.T, a *api, objType, id string) map[string]interface{} {
+	t.Helper()
+
+	obj, err := a.getObject(objType, id)
+	require.NoError(t, err)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(obj, &doc))
+
+	return doc
+}
+
+func Test_validateGenerators(t *testing.T) {
+	fields := map[string]fieldGeneratorConfig{"temperature": {Type: generatorRandom, Max: 10}}
+
+	assert.NoError(t, validateGenerators([]generatorConfig{{Collection: "weather", Fields: fields}}))
+
+	tests := []struct {
+		desc       string
+		generators []generatorConfig
+	}{
+		{desc: "no collection", generators: []generatorConfig{{Fields: fields}}},
+		{desc: "duplicated", generators: []generatorConfig{{Collection: "weather", Fields: fields}, {Collection: "weather", Fields: fields}}},
+		{desc: "no fields", generators: []generatorConfig{{Collection: "weather"}}},
+		{desc: "unknown type", generators: []generatorConfig{{Collection: "weather", Fields: map[string]fieldGeneratorConfig{"t": {Type: "sine"}}}}},
+		{desc: "inverted range", generators: []generatorConfig{{Collection: "weather", Fields: map[string]fieldGeneratorConfig{"t": {Type: generatorDaily, Min: 10, Max: 5}}}}},
+		{desc: "invalid peak", generators: []generatorConfig{{Collection: "weather", Fields: map[string]fieldGeneratorConfig{"t": {Type: generatorDaily, Peak: "3pm"}}}}},
+		{desc: "no values", generators: []generatorConfig{{Collection: "weather", Fields: map[string]fieldGeneratorConfig{"t": {Type: generatorChoice}}}}},
+		{desc: "no source", generators: []generatorConfig{{Collection: "weather", Fields: map[string]fieldGeneratorConfig{"t": {Type: generatorDerived}}}}},
+		{desc: "negative noise", generators: []generatorConfig{{Collection: "weather", Fields: map[string]fieldGeneratorConfig{"t": {Type: generatorRandom, Noise: -1}}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Error(t, validateGenerators(test.generators))
+		})
+	}
+}
+
+func Test_generators_daily(t *testing.T) {
+	a := newGeneratorsAPI(t, []generatorConfig{{
+		Collection: "weather",
+		Fields: map[string]fieldGeneratorConfig{
+			"temperature": {Type: generatorDaily, Min: 5, Max: 25, Peak: "15:00"},
+			"feelsLike":   {Type: generatorDerived, From: "temperature", Offset: -2},
+			"label": {Type: generatorDerived, From: "temperature", Default: "Hot", Thresholds: []generatorThreshold{
+				{Below: 10, Value: "Cold"},
+				{Below: 20, Value: "Mild"},
+			}},
+			"updatedAt": {Type: generatorNow},
+		},
+	}})
+
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	a.generators.generate(a, day.Add(15*time.Hour))
+	doc := getDoc(t, a, "weather", "0")
+	assert.Equal(t, "GopherCity", doc["city"])
+	assert.Equal(t, 25.0, doc["temperature"])
+	assert.Equal(t, 23.0, doc["feelsLike"])
+	assert.Equal(t, "Hot", doc["label"])
+	assert.Equal(t, "2024-06-01T15:00:00Z", doc["updatedAt"])
+
+	a.generators.generate(a, day.Add(3*time.Hour))
+	doc = getDoc(t, a, "weather", "1")
+	assert.Equal(t, 5.0, doc["temperature"])
+	assert.Equal(t, 3.0, doc["feelsLike"])
+	assert.Equal(t, "Cold", doc["label"])
+
+	a.generators.generate(a, day.Add(9*time.Hour))
+	doc = getDoc(t, a, "weather", "1")
+	assert.Equal(t, 15.0, doc["temperature"])
+	assert.Equal(t, "Mild", doc["label"])
+}
+
+func Test_generators_seeded(t *testing.T) {
+	generators := []generatorConfig{{
+		Collection: "sensors",
+		Records:    []string{"a", "b"},
+		Seed:       42,
+		Fields: map[string]fieldGeneratorConfig{
+			"humidity": {Type: generatorRandomWalk, Min: 0, Max: 100, Step: 5, Decimals: 1},
+			"wind":     {Type: generatorRandom, Min: 0, Max: 50, Noise: 2},
+			"sky":      {Type: generatorChoice, Values: []interface{}{"clear", "overcast"}},
+		},
+	}}
+
+	a := newGeneratorsAPI(t, generators)
+	b := newGeneratorsAPI(t, generators)
+
+	for i := 0; i < 20; i++ {
+		before := getDoc(t, a, "sensors", "a")
+
+		now := time.Now()
+		a.generators.generate(a, now)
+		b.generators.generate(b, now)
+
+		for _, id := range []string{"a", "b"} {
+			doc := getDoc(t, a, "sensors", id)
+			assert.Equal(t, doc, getDoc(t, b, "sensors", id))
+
+			assert.GreaterOrEqual(t, doc["humidity"], 0.0)
+			assert.LessOrEqual(t, doc["humidity"], 100.0)
+			assert.GreaterOrEqual(t, doc["wind"], 0.0)
+			assert.LessOrEqual(t, doc["wind"], 50.0)
+			assert.Contains(t, []interface{}{"clear", "overcast"}, doc["sky"])
+		}
+
+		assert.InDelta(t, before["humidity"], getDoc(t, a, "sensors", "a")["humidity"], 5.05)
+	}
+
+	// Records of the collection not listed are not generated.
+	_, err := a.getObject("weather", "0")
+	require.NoError(t, err)
+	assert.NotContains(t, getDoc(t, a, "weather", "0"), "humidity")
+}
+
+func Test_generators_changeFeed(t *testing.T) {
+	a := newGeneratorsAPI(t, []generatorConfig{{
+		Collection: "weather",
+		Records:    []string{"0"},
+		Fields:     map[string]fieldGeneratorConfig{"temperature": {Type: generatorRandom, Min: 10, Max: 20}},
+	}})
+
+	var events []event
+	a.events.listen(func(evt event) { events = append(events, evt) })
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/_generators/generate", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Len(t, events, 1)
+	assert.Equal(t, eventUpdated, events[0].Type)
+	assert.Equal(t, "weather", events[0].Collection)
+	assert.Equal(t, "0", events[0].ObjectID)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_generators", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var statuses []generatorStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "weather", statuses[0].Collection)
+	assert.Equal(t, "1m0s", statuses[0].Interval)
+	assert.Equal(t, 2, statuses[0].Generations)
+}
+
+func Test_generators_interval(t *testing.T) {
+	a := newGeneratorsAPI(t, []generatorConfig{{
+		Collection: "weather",
+		Interval:   10 * time.Millisecond,
+		Fields:     map[string]fieldGeneratorConfig{"updatedAt": {Type: generatorNow}},
+	}})
+
+	assert.Eventually(t, func() bool {
+		return a.generators.list()[0].Generations > 2
+	}, time.Second, 5*time.Millisecond)
+
+	a.generators.shutdown()
+	generations := a.generators.list()[0].Generations
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, generations, a.generators.list()[0].Generations)
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	graphqlSchemaData    = "data"
+	graphqlSchemaOpenAPI = "openapi"
+
+	graphqlString  = "String"
+	graphqlInt     = "Int"
+	graphqlFloat   = "Float"
+	graphqlBoolean = "Boolean"
+	graphqlJSON    = "JSON"
+)
+
+type graphqlConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Schema is where the types of the collections come from: "data", the
+	// default, infers them from the records, and "openapi" reads them from
+	// the OpenAPI document, falling back to the records.
+	Schema string `yaml:"schema"`
+}
+
+func (c graphqlConfig) validate() error {
+	switch c.Schema {
+	case "", graphqlSchemaData, graphqlSchemaOpenAPI:
+		return nil
+	default:
+		return fmt.Errorf("graphql: unknown schema source %q", c.Schema)
+	}
+}
+
+// graphqlCollection is a collection exposed through GraphQL, along with the
+// scalar type of each field of its records.
+type graphqlCollection struct {
+	name      string
+	typeName  string
+	fieldName string
+	fields    map[string]string
+}
+
+// reservedTypeNames are the GraphQL types not generated from a collection.
+var reservedTypeNames = map[string]bool{
+	"Query":        true,
+	"Mutation":     true,
+	"Subscription": true,
+	"ChangeType":   true,
+	graphqlJSON:    true,
+}
+
+// graphqlCollections returns the collections of the records, and those of the
+// OpenAPI document when it is the source of the schema.
+func (a *api) graphqlCollections() ([]graphqlCollection, error) {
+	var root *yaml.Node
+	if a.graphql.Schema == graphqlSchemaOpenAPI {
+		if doc := a.getOpenAPISpec(); doc != nil {
+			root = doc.node
+		}
+	}
+
+	names := a.collectionNames()
+	if root != nil {
+		for _, name := range specCollections(root) {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	var collections []graphqlCollection
+	seen := map[string]bool{}
+	for _, name := range names {
+		typeName := pascalCase(name)
+		if typeName == "" || seen[typeName] {
+			continue
+		}
+		seen[typeName] = true
+
+		if reservedTypeNames[typeName] {
+			typeName += "Record"
+		}
+
+		var fields map[string]string
+		if root != nil {
+			fields = schemaFields(root, collectionSchema(root, name))
+		}
+		if len(fields) == 0 {
+			objs, _ := a.listObjects(name)
+
+			var err error
+			fields, err = inferFields(objs)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		collections = append(collections, graphqlCollection{
+			name:      name,
+			typeName:  typeName,
+			fieldName: camelCase(typeName),
+			fields:    fields,
+		})
+	}
+
+	return collections, nil
+}
+
+// graphqlSchema builds the schema of the collections. It is built for each
+// request, so that it follows the records and the OpenAPI document.
+func (a *api) graphqlSchema() (graphql.Schema, error) {
+	collections, err := a.graphqlCollections()
+	if err != nil {
+		return graphql.Schema{}, err
+	}
+
+	jsonScalar := graphql.NewScalar(graphql.ScalarConfig{
+		Name:         graphqlJSON,
+		Description:  "Any JSON value.",
+		Serialize:    func(v interface{}) interface{} { return v },
+		ParseValue:   func(v interface{}) interface{} { return v },
+		ParseLiteral: literalValue,
+	})
+	scalars := map[string]graphql.Type{
+		graphqlString:  graphql.String,
+		graphqlInt:     graphql.Int,
+		graphqlFloat:   graphql.Float,
+		graphqlBoolean: graphql.Boolean,
+		graphqlJSON:    jsonScalar,
+	}
+
+	changeType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "ChangeType",
+		Values: graphql.EnumValueConfigMap{
+			"CREATED": {Value: eventCreated},
+			"UPDATED": {Value: eventUpdated},
+			"DELETED": {Value: eventDeleted},
+		},
+	})
+
+	queries := graphql.Fields{
+		"_collections": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+			Resolve: func(graphql.ResolveParams) (interface{}, error) {
+				return a.collectionNames(), nil
+			},
+		},
+	}
+	mutations := graphql.Fields{}
+	subscriptions := graphql.Fields{}
+
+	for _, collection := range collections {
+		objectFields := graphql.Fields{"id": &graphql.Field{Type: graphql.NewNonNull(graphql.ID)}}
+		inputFields := graphql.InputObjectConfigFieldMap{}
+		for name, kind := range collection.fields {
+			objectFields[name] = &graphql.Field{Type: scalars[kind]}
+			inputFields[name] = &graphql.InputObjectFieldConfig{Type: scalars[kind]}
+		}
+
+		objectType := graphql.NewObject(graphql.ObjectConfig{Name: collection.typeName, Fields: objectFields})
+
+		a.addGraphQLQueries(queries, collection, objectType)
+
+		if len(inputFields) > 0 {
+			inputType := graphql.NewInputObject(graphql.InputObjectConfig{Name: collection.typeName + "Input", Fields: inputFields})
+			a.addGraphQLMutations(mutations, collection, objectType, inputType)
+		}
+
+		changeObject := graphql.NewObject(graphql.ObjectConfig{
+			Name: collection.typeName + "Change",
+			Fields: graphql.Fields{
+				"type":    &graphql.Field{Type: graphql.NewNonNull(changeType)},
+				"eventId": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"id":      &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+				"object":  &graphql.Field{Type: objectType},
+			},
+		})
+		a.addGraphQLSubscription(subscriptions, collection, changeObject, changeType)
+	}
+
+	cfg := graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: queries}),
+	}
+	if len(mutations) > 0 {
+		cfg.Mutation = graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutations})
+	}
+	if len(subscriptions) > 0 {
+		cfg.Subscription = graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: subscriptions})
+	}
+
+	return graphql.NewSchema(cfg)
+}
+
+func (a *api) addGraphQLQueries(queries graphql.Fields, collection graphqlCollection, objectType *graphql.Object) {
+	queries[collection.fieldName] = &graphql.Field{
+		Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(objectType))),
+		Resolve: func(graphql.ResolveParams) (interface{}, error) {
+			objs, _ := a.listObjects(collection.name)
+
+			ids := make([]string, 0, len(objs))
+			for id := range objs {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+
+			records := make([]map[string]interface{}, 0, len(ids))
+			for _, id := range ids {
+				record, err := graphqlRecord(id, objs[id])
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, record)
+			}
+
+			return records, nil
+		},
+	}
+
+	queries[collection.fieldName+"ById"] = &graphql.Field{
+		Type: objectType,
+		Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			id, _ := p.Args["id"].(string)
+
+			raw, err := a.getObject(collection.name, id)
+			if err != nil {
+				return nil, nil
+			}
+
+			return graphqlRecord(id, raw)
+		},
+	}
+}
+
+// addGraphQLMutations exposes the writes of the collection. Each mutation is
+// authorized as the REST operation doing the same.
+func (a *api) addGraphQLMutations(mutations graphql.Fields, collection graphqlCollection, objectType *graphql.Object, inputType *graphql.InputObject) {
+	path := "/" + url.PathEscape(collection.name)
+
+	mutations["create"+collection.typeName] = &graphql.Field{
+		Type: objectType,
+		Args: graphql.FieldConfigArgument{"input": {Type: graphql.NewNonNull(inputType)}},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			input, _ := p.Args["input"].(map[string]interface{})
+
+			if err := a.authorizeGraphQL(p.Context, http.MethodPost, path); err != nil {
+				return nil, err
+			}
+
+			obj := make(map[string]interface{}, len(input))
+			for k, v := range input {
+				obj[k] = v
+			}
+
+			id, err := a.createRecord(p.Context, collection.name, obj)
+			if err != nil {
+				return nil, err
+			}
+
+			obj["id"] = id
+			return obj, nil
+		},
+	}
+
+	// Updates only change the fields given in the input.
+	mutations["update"+collection.typeName] = &graphql.Field{
+		Type: objectType,
+		Args: graphql.FieldConfigArgument{
+			"id":    {Type: graphql.NewNonNull(graphql.ID)},
+			"input": {Type: graphql.NewNonNull(inputType)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			id, _ := p.Args["id"].(string)
+			input, _ := p.Args["input"].(map[string]interface{})
+
+			if err := a.authorizeGraphQL(p.Context, http.MethodPatch, path+"/"+url.PathEscape(id)); err != nil {
+				return nil, err
+			}
+
+			obj := map[string]interface{}{}
+			if raw, err := a.getObject(collection.name, id); err == nil {
+				if err = json.Unmarshal(raw, &obj); err != nil {
+					return nil, err
+				}
+			}
+			for k, v := range input {
+				obj[k] = v
+			}
+
+			if _, err := a.replaceRecord(p.Context, collection.name, id, obj); err != nil {
+				return nil, err
+			}
+
+			obj["id"] = id
+			return obj, nil
+		},
+	}
+
+	mutations["delete"+collection.typeName] = &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Boolean),
+		Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			id, _ := p.Args["id"].(string)
+
+			if err := a.authorizeGraphQL(p.Context, http.MethodDelete, path+"/"+url.PathEscape(id)); err != nil {
+				return nil, err
+			}
+
+			if _, err := a.getObject(collection.name, id); err != nil {
+				return false, nil
+			}
+
+			if err := a.deleteRecord(p.Context, collection.name, id); err != nil {
+				return nil, err
+			}
+
+			return true, nil
+		},
+	}
+}
+
+// addGraphQLSubscription exposes the change feed of the collection.
+func (a *api) addGraphQLSubscription(subscriptions graphql.Fields, collection graphqlCollection, changeObject *graphql.Object, changeType *graphql.Enum) {
+	subscriptions[collection.fieldName+"Changed"] = &graphql.Field{
+		Type: graphql.NewNonNull(changeObject),
+		Args: graphql.FieldConfigArgument{
+			"types": {Type: graphql.NewList(graphql.NewNonNull(changeType))},
+		},
+		Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+			var types []string
+			if values, ok := p.Args["types"].([]interface{}); ok {
+				for _, value := range values {
+					types = append(types, fmt.Sprint(value))
+				}
+			}
+
+			_, events := a.events.subscribe(0, false)
+
+			out := make(chan interface{})
+			go func() {
+				defer close(out)
+				defer a.events.unsubscribe(events)
+
+				for {
+					select {
+					case <-p.Context.Done():
+						return
+
+					case evt, ok := <-events:
+						if !ok {
+							return
+						}
+						if evt.Collection != collection.name || (len(types) > 0 && !slices.Contains(types, evt.Type)) {
+							continue
+						}
+
+						select {
+						case out <- evt:
+						case <-p.Context.Done():
+							return
+						}
+					}
+				}
+			}()
+
+			return out, nil
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			evt, ok := p.Source.(event)
+			if !ok {
+				return nil, errors.New("not a change event")
+			}
+
+			change := map[string]interface{}{
+				"type":    evt.Type,
+				"eventId": strconv.FormatUint(evt.ID, 10),
+				"id":      evt.ObjectID,
+			}
+			if evt.Object != nil {
+				record, err := graphqlRecord(evt.ObjectID, evt.Object)
+				if err != nil {
+					return nil, err
+				}
+				change["object"] = record
+			}
+
+			return change, nil
+		},
+	}
+}
+
+func graphqlRecord(id string, raw json.RawMessage) (map[string]interface{}, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, err
+	}
+	record["id"] = id
+
+	return record, nil
+}
+
+// inferFields returns the scalar type of the fields of the records. Fields
+// holding values of different types, objects or arrays are JSON.
+func inferFields(objs map[string]json.RawMessage) (map[string]string, error) {
+	fields := map[string]string{}
+	for _, raw := range objs {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+
+		for name, value := range obj {
+			if name == "id" || !isGraphQLName(name) {
+				continue
+			}
+			fields[name] = mergeKinds(fields[name], valueKind(value))
+		}
+	}
+
+	for name, kind := range fields {
+		if kind == "" {
+			fields[name] = graphqlJSON
+		}
+	}
+
+	return fields, nil
+}
+
+func valueKind(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return graphqlString
+	case bool:
+		return graphqlBoolean
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return graphqlInt
+		}
+		return graphqlFloat
+	default:
+		return graphqlJSON
+	}
+}
+
+func mergeKinds(known, kind string) string {
+	switch {
+	case known == "" || known == kind:
+		return kind
+	case kind == "":
+		return known
+	case (known == graphqlInt && kind == graphqlFloat) || (known == graphqlFloat && kind == graphqlInt):
+		return graphqlFloat
+	default:
+		return graphqlJSON
+	}
+}
+
+// specCollections returns the collections of the OpenAPI document: the first
+// segment of its paths.
+func specCollections(root *yaml.Node) []string {
+	paths := mappingValue(root, "paths")
+	if paths == nil {
+		return nil
+	}
+
+	var names []string
+	for i := 0; i+1 < len(paths.Content); i += 2 {
+		segments := strings.Split(strings.Trim(paths.Content[i].Value, "/"), "/")
+		name := segments[0]
+		if name == "" || isTemplateSegment(name) || strings.HasPrefix(name, "_") || slices.Contains(names, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// collectionSchema returns the schema of the records of a collection, taken
+// from the responses of GET /{collection}/{id}, or GET /{collection}, or from
+// the component schema named after the collection.
+func collectionSchema(root *yaml.Node, collection string) *yaml.Node {
+	var single, list *yaml.Node
+
+	if paths := mappingValue(root, "paths"); paths != nil {
+		for i := 0; i+1 < len(paths.Content); i += 2 {
+			segments := strings.Split(strings.Trim(paths.Content[i].Value, "/"), "/")
+			if segments[0] != collection {
+				continue
+			}
+
+			pathItem := derefSchema(root, paths.Content[i+1])
+			switch {
+			case len(segments) == 2 && isTemplateSegment(segments[1]) && single == nil:
+				single = responseSchema(root, pathItem)
+			case len(segments) == 1 && list == nil:
+				list = responseSchema(root, pathItem)
+			}
+		}
+	}
+
+	switch {
+	case single != nil:
+		return single
+	case list != nil:
+		return list
+	}
+
+	for _, pointer := range []string{"/components/schemas/", "/definitions/"} {
+		if schema, err := resolvePointer(root, pointer+escapePointer(collection)); err == nil {
+			return derefSchema(root, schema)
+		}
+	}
+
+	return nil
+}
+
+func responseSchema(root, pathItem *yaml.Node) *yaml.Node {
+	get := mappingValue(pathItem, "get")
+	if get == nil {
+		return nil
+	}
+
+	responses := mappingValue(get, "responses")
+	if responses == nil {
+		return nil
+	}
+
+	for _, code := range []string{"200", "201"} {
+		response := derefSchema(root, mappingValue(responses, code))
+		if response == nil {
+			continue
+		}
+
+		// Swagger 2.0 responses have their schema at the top level.
+		if schema := mappingValue(response, "schema"); schema != nil {
+			return derefSchema(root, schema)
+		}
+
+		content := mappingValue(response, "content")
+		if content == nil || content.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(content.Content); i += 2 {
+			if strings.Contains(content.Content[i].Value, "json") {
+				return derefSchema(root, mappingValue(content.Content[i+1], "schema"))
+			}
+		}
+	}
+
+	return nil
+}
+
+// schemaFields returns the scalar type of the properties of an object
+// schema, or of the items of an array schema.
+func schemaFields(root, schema *yaml.Node) map[string]string {
+	schema = derefSchema(root, schema)
+	if schema == nil {
+		return nil
+	}
+
+	if schemaType(schema) == "array" {
+		schema = derefSchema(root, mappingValue(schema, "items"))
+		if schema == nil {
+			return nil
+		}
+	}
+
+	properties := mappingValue(schema, "properties")
+	if properties == nil || properties.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	fields := map[string]string{}
+	for i := 0; i+1 < len(properties.Content); i += 2 {
+		name := properties.Content[i].Value
+		if name == "id" || !isGraphQLName(name) {
+			continue
+		}
+
+		switch schemaType(derefSchema(root, properties.Content[i+1])) {
+		case "string":
+			fields[name] = graphqlString
+		case "integer":
+			fields[name] = graphqlInt
+		case "number":
+			fields[name] = graphqlFloat
+		case "boolean":
+			fields[name] = graphqlBoolean
+		default:
+			fields[name] = graphqlJSON
+		}
+	}
+
+	return fields
+}
+
+// schemaType returns the type of a schema, the first one besides null for
+// the OpenAPI 3.1 type lists.
+func schemaType(schema *yaml.Node) string {
+	if schema == nil {
+		return ""
+	}
+
+	typ := mappingValue(schema, "type")
+	switch {
+	case typ == nil:
+		return ""
+	case typ.Kind == yaml.SequenceNode:
+		for _, item := range typ.Content {
+			if item.Value != "null" {
+				return item.Value
+			}
+		}
+		return ""
+	default:
+		return typ.Value
+	}
+}
+
+// derefSchema follows the local references of node.
+func derefSchema(root, node *yaml.Node) *yaml.Node {
+	for range 32 {
+		if node == nil {
+			return nil
+		}
+
+		ref := mappingValue(node, "$ref")
+		if ref == nil || !strings.HasPrefix(ref.Value, "#") {
+			return node
+		}
+
+		var err error
+		node, err = resolvePointer(root, strings.TrimPrefix(ref.Value, "#"))
+		if err != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func literalValue(value ast.Value) interface{} {
+	switch v := value.(type) {
+	case *ast.ObjectValue:
+		obj := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			obj[field.Name.Value] = literalValue(field.Value)
+		}
+		return obj
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(v.Values))
+		for _, item := range v.Values {
+			list = append(list, literalValue(item))
+		}
+		return list
+	case *ast.IntValue:
+		n, err := strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return nil
+		}
+		return n
+	case *ast.FloatValue:
+		f, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case *ast.StringValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	default:
+		return nil
+	}
+}
+
+// operationType returns the type of the operation of a GraphQL document:
+// query, mutation or subscription.
+func operationType(query, operationName string) string {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return ""
+	}
+
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+			return op.Operation
+		}
+	}
+
+	return ""
+}
+
+func pascalCase(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)))
+	})
+
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	out := b.String()
+	if out != "" && unicode.IsDigit(rune(out[0])) {
+		out = "_" + out
+	}
+
+	return out
+}
+
+func camelCase(typeName string) string {
+	if typeName == "" || typeName[0] == '_' {
+		return typeName
+	}
+
+	return strings.ToLower(typeName[:1]) + typeName[1:]
+}
+
+func isGraphQLName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+
+	for i, r := range name {
+		switch {
+		case r == '_', r < unicode.MaxASCII && unicode.IsLetter(r):
+		case i > 0 && r < unicode.MaxASCII && unicode.IsDigit(r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// lessID orders integer IDs numerically, and other IDs lexically.
+func lessID(a, b string) bool {
+	na, errA := strconv.ParseInt(a, 10, 64)
+	nb, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+
+	return a < b
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// graphqlTransportWS is the subprotocol of the GraphQL over WebSocket
+// protocol.
+const graphqlTransportWS = "graphql-transport-ws"
+
+// graphqlHTTPRequestKey is the context key of the HTTP request GraphQL
+// operations are run for.
+type graphqlHTTPRequestKey struct{}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// handleGraphQL serves GraphQL over HTTP, and subscriptions over WebSocket.
+func (a *api) handleGraphQL(rw http.ResponseWriter, req *http.Request) {
+	if websocket.IsWebSocketUpgrade(req) {
+		a.serveGraphQLWebSocket(rw, req)
+		return
+	}
+
+	var gqlReq graphqlRequest
+	switch req.Method {
+	case http.MethodGet:
+		gqlReq.Query = req.URL.Query().Get("query")
+		gqlReq.OperationName = req.URL.Query().Get("operationName")
+		if variables := req.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &gqlReq.Variables); err != nil {
+				JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid variables: %s", err))
+				return
+			}
+		}
+
+		// GET requests must be safe.
+		if operationType(gqlReq.Query, gqlReq.OperationName) == "mutation" {
+			rw.Header().Set("Allow", http.MethodPost)
+			JSONError(rw, http.StatusMethodNotAllowed, "mutations must be sent with POST")
+			return
+		}
+
+	default:
+		if err := json.NewDecoder(req.Body).Decode(&gqlReq); err != nil {
+			JSONError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if gqlReq.Query == "" {
+		JSONError(rw, http.StatusBadRequest, "missing query")
+		return
+	}
+
+	schema, err := a.graphqlSchema()
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  gqlReq.Query,
+		VariableValues: gqlReq.Variables,
+		OperationName:  gqlReq.OperationName,
+		Context:        context.WithValue(req.Context(), graphqlHTTPRequestKey{}, req),
+	})
+
+	writeJSONResponse(rw, http.StatusOK, result)
+}
+
+var graphqlUpgrader = websocket.Upgrader{
+	Subprotocols: []string{graphqlTransportWS},
+	CheckOrigin:  func(*http.Request) bool { return true },
+}
+
+type graphqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// serveGraphQLWebSocket implements the graphql-transport-ws protocol: the
+// client initializes the connection, then runs operations identified by an ID
+// until they complete.
+func (a *api) serveGraphQLWebSocket(rw http.ResponseWriter, req *http.Request) {
+	conn, err := graphqlUpgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	if conn.Subprotocol() != graphqlTransportWS {
+		closeGraphQLWebSocket(conn, websocket.CloseProtocolError, "unsupported subprotocol")
+		return
+	}
+
+	var writeMu sync.Mutex
+	send := func(msg graphqlMessage) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		_ = conn.WriteJSON(msg)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(req.Context(), graphqlHTTPRequestKey{}, req))
+	defer cancel()
+
+	var mu sync.Mutex
+	operations := map[string]context.CancelFunc{}
+	initialized := false
+
+	for {
+		var msg graphqlMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			if initialized {
+				closeGraphQLWebSocket(conn, 4429, "Too many initialisation requests")
+				return
+			}
+			initialized = true
+			send(graphqlMessage{Type: "connection_ack"})
+
+		case "ping":
+			send(graphqlMessage{Type: "pong"})
+
+		case "pong":
+
+		case "subscribe":
+			if !initialized {
+				closeGraphQLWebSocket(conn, 4401, "Unauthorized")
+				return
+			}
+
+			var gqlReq graphqlRequest
+			if err := json.Unmarshal(msg.Payload, &gqlReq); err != nil {
+				closeGraphQLWebSocket(conn, 4400, err.Error())
+				return
+			}
+
+			mu.Lock()
+			if _, ok := operations[msg.ID]; ok {
+				mu.Unlock()
+				closeGraphQLWebSocket(conn, 4409, fmt.Sprintf("Subscriber for %s already exists", msg.ID))
+				return
+			}
+			opCtx, opCancel := context.WithCancel(ctx)
+			operations[msg.ID] = opCancel
+			mu.Unlock()
+
+			go func(id string) {
+				completed := a.runGraphQLOperation(opCtx, gqlReq, func(result *graphql.Result) {
+					payload, err := json.Marshal(result)
+					if err != nil {
+						return
+					}
+					send(graphqlMessage{ID: id, Type: "next", Payload: payload})
+				})
+
+				mu.Lock()
+				_, active := operations[id]
+				delete(operations, id)
+				mu.Unlock()
+				opCancel()
+
+				// Operations completed by the client are not acknowledged.
+				if completed && active {
+					send(graphqlMessage{ID: id, Type: "complete"})
+				}
+			}(msg.ID)
+
+		case "complete":
+			mu.Lock()
+			if opCancel, ok := operations[msg.ID]; ok {
+				delete(operations, msg.ID)
+				opCancel()
+			}
+			mu.Unlock()
+
+		default:
+			closeGraphQLWebSocket(conn, 4400, fmt.Sprintf("unknown message type %q", msg.Type))
+			return
+		}
+	}
+}
+
+// authorizeGraphQL checks the HTTP request of the GraphQL operation, whose
+// context is ctx, against the security requirements of the REST operation
+// doing the same, given by method and path.
+func (a *api) authorizeGraphQL(ctx context.Context, method, path string) error {
+	req, ok := ctx.Value(graphqlHTTPRequestKey{}).(*http.Request)
+	if !ok {
+		req = (&http.Request{Header: http.Header{}}).WithContext(ctx)
+	}
+
+	_, err := a.authorizeOperation(req, method, path)
+	return err
+}
+
+// runGraphQLOperation runs a GraphQL operation, calling next with each of its
+// results. It reports whether the operation ran to completion.
+func (a *api) runGraphQLOperation(ctx context.Context, gqlReq graphqlRequest, next func(*graphql.Result)) bool {
+	schema, err := a.graphqlSchema()
+	if err != nil {
+		next(&graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return true
+	}
+
+	params := graphql.Params{
+		Schema:         schema,
+		RequestString:  gqlReq.Query,
+		VariableValues: gqlReq.Variables,
+		OperationName:  gqlReq.OperationName,
+		Context:        ctx,
+	}
+
+	if operationType(gqlReq.Query, gqlReq.OperationName) != "subscription" {
+		next(graphql.Do(params))
+		return true
+	}
+
+	results := graphql.Subscribe(params)
+	for {
+		select {
+		case <-ctx.Done():
+			// Let the subscription goroutine end.
+			go func() {
+				for range results {
+				}
+			}()
+			return false
+
+		case result, ok := <-results:
+			if !ok {
+				return true
+			}
+			next(result)
+		}
+	}
+}
+
+func closeGraphQLWebSocket(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
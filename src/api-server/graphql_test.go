@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGraphQLAPI(t *testing.T, cfg graphqlConfig) (*api, *httptest.Server) {
+	t.Helper()
+
+	a, srv := newTestServer(t, &config{GraphQL: cfg})
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi.yaml"))
+
+	return a, srv
+}
+
+func graphqlDo(t *testing.T, srv *httptest.Server, query string, variables map[string]interface{}) map[string]interface{} {
+	t.Helper()
+
+	body, err := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	require.NoError(t, err)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/graphql", "application/json", string(body))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+	return result
+}
+
+func Test_handleGraphQL_query(t *testing.T) {
+	_, srv := newGraphQLAPI(t, graphqlConfig{Enabled: true})
+
+	result := graphqlDo(t, srv, `{ weather { id city } weatherById(id: "1") { weather } }`, nil)
+
+	assert.Equal(t, map[string]interface{}{
+		"data": map[string]interface{}{
+			"weather": []interface{}{
+				map[string]interface{}{"id": "0", "city": "GopherCity"},
+				map[string]interface{}{"id": "1", "city": "City of Gophers"},
+				map[string]interface{}{"id": "2", "city": "GopherRocks"},
+			},
+			"weatherById": map[string]interface{}{"weather": "Sunny"},
+		},
+	}, result)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/graphql?query="+url.QueryEscape(`{ weatherById(id: "2") { city } }`), "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var getResult map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&getResult))
+	assert.Equal(t, map[string]interface{}{"weatherById": map[string]interface{}{"city": "GopherRocks"}}, getResult["data"])
+}
+
+func Test_handleGraphQL_mutations(t *testing.T) {
+	a, srv := newGraphQLAPI(t, graphqlConfig{Enabled: true})
+
+	result := graphqlDo(t, srv, `mutation($input: WeatherInput!) { createWeather(input: $input) { id city weather } }`,
+		map[string]interface{}{"input": map[string]interface{}{"city": "Lyon", "weather": "Sunny"}})
+	require.Nil(t, result["errors"])
+
+	created := result["data"].(map[string]interface{})["createWeather"].(map[string]interface{})
+	id := created["id"].(string)
+
+	raw, err := a.getObject("weather", id)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city":"Lyon","weather":"Sunny"}`, string(raw))
+
+	result = graphqlDo(t, srv, `mutation { updateWeather(id: "`+id+`", input: {weather: "Rainy"}) { city weather } }`, nil)
+	assert.Equal(t, map[string]interface{}{
+		"updateWeather": map[string]interface{}{"city": "Lyon", "weather": "Rainy"},
+	}, result["data"])
+
+	result = graphqlDo(t, srv, `mutation { deleteWeather(id: "`+id+`") }`, nil)
+	assert.Equal(t, map[string]interface{}{"deleteWeather": true}, result["data"])
+
+	_, err = a.getObject("weather", id)
+	assert.Error(t, err)
+
+	result = graphqlDo(t, srv, `mutation { updateWeather(id: "unknown", input: {weather: "Rainy"}) { city } }`, nil)
+	assert.NotEmpty(t, result["errors"])
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/graphql?query="+url.QueryEscape(`mutation { deleteWeather(id: "0") }`), "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func Test_handleGraphQL_mutationsAuthorization(t *testing.T) {
+	a, srv := newTestServer(t, &config{
+		GraphQL: graphqlConfig{Enabled: true},
+		Auth:    &authConfig{APIKeys: []apiKeyCredential{{Key: "secret", Subject: "alice"}}},
+	})
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi-auth.yaml"))
+
+	before, _ := a.listObjects("weather")
+
+	body, err := json.Marshal(graphqlRequest{Query: `mutation { createWeather(input: {city: "Lyon"}) { id } }`})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/graphql", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, errMissingCredentials.Error(), result.Errors[0].Message)
+
+	after, _ := a.listObjects("weather")
+	assert.Len(t, after, len(before))
+}
+
+func Test_handleGraphQL_openAPISchema(t *testing.T) {
+	a, srv := newGraphQLAPI(t, graphqlConfig{Enabled: true, Schema: graphqlSchemaOpenAPI})
+	a.setObject(context.Background(), "weather", "0", json.RawMessage(`{"city":"GopherCity","weather":"Moderate rain","humidity":80}`))
+
+	// Fields of the records missing from the OpenAPI schema are not exposed.
+	result := graphqlDo(t, srv, `{ weatherById(id: "0") { humidity } }`, nil)
+	assert.NotEmpty(t, result["errors"])
+
+	fields, err := a.graphqlCollections()
+	require.NoError(t, err)
+	require.Len(t, fields, 1)
+	assert.Equal(t, map[string]string{"city": graphqlString, "weather": graphqlString}, fields[0].fields)
+}
+
+func Test_handleGraphQL_disabled(t *testing.T) {
+	_, srv := newGraphQLAPI(t, graphqlConfig{})
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/graphql", "application/json", `{"query":"{ weather { id } }"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "graphql is a regular collection")
+}
+
+func Test_handleGraphQL_subscription(t *testing.T) {
+	a, srv := newGraphQLAPI(t, graphqlConfig{Enabled: true})
+
+	dialer := websocket.Dialer{Subprotocols: []string{graphqlTransportWS}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/graphql", nil)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	require.NoError(t, conn.WriteJSON(graphqlMessage{Type: "connection_init"}))
+
+	var msg graphqlMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, "connection_ack", msg.Type)
+
+	payload, err := json.Marshal(graphqlRequest{Query: `subscription { weatherChanged(types: [DELETED]) { type id } }`})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(graphqlMessage{ID: "1", Type: "subscribe", Payload: payload}))
+
+	// Wait for the subscription to be registered.
+	require.Eventually(t, func() bool {
+		a.events.mu.Lock()
+		defer a.events.mu.Unlock()
+		return len(a.events.subscribers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	a.setObject(context.Background(), "weather", "0", json.RawMessage(`{}`))
+	a.deleteObject(context.Background(), "weather", "1")
+
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, "next", msg.Type)
+	assert.Equal(t, "1", msg.ID)
+	assert.JSONEq(t, `{"data":{"weatherChanged":{"type":"DELETED","id":"1"}}}`, string(msg.Payload))
+
+	require.NoError(t, conn.WriteJSON(graphqlMessage{ID: "1", Type: "complete"}))
+
+	require.Eventually(t, func() bool {
+		a.events.mu.Lock()
+		defer a.events.mu.Unlock()
+		return len(a.events.subscribers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_inferFields(t *testing.T) {
+	fields, err := inferFields(map[string]json.RawMessage{
+		"0": json.RawMessage(`{"name":"Lyon","population":500000,"area":47.87,"capital":false,"tags":["a"],"mixed":1,"null":null,"in-valid":1}`),
+		"1": json.RawMessage(`{"name":"Paris","population":2100000,"area":105,"mixed":"one"}`),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"name":       graphqlString,
+		"population": graphqlInt,
+		"area":       graphqlFloat,
+		"capital":    graphqlBoolean,
+		"tags":       graphqlJSON,
+		"mixed":      graphqlJSON,
+		"null":       graphqlJSON,
+	}, fields)
+}
+
+func Test_pascalCase(t *testing.T) {
+	assert.Equal(t, "Weather", pascalCase("weather"))
+	assert.Equal(t, "UserAccounts", pascalCase("user-accounts"))
+	assert.Equal(t, "_2fa", pascalCase("2fa"))
+	assert.Equal(t, "userAccounts", camelCase(pascalCase("user_accounts")))
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	// Registers the well-known types used by the records service.
+	_ "google.golang.org/protobuf/types/known/emptypb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	grpcPackage     = "traefik.hub.apiserver.v1"
+	grpcServiceName = grpcPackage + ".Records"
+)
+
+type grpcConfig struct {
+	// Enabled serves the records service next to the REST API, over HTTP/2
+	// and gRPC-Web.
+	Enabled bool `yaml:"enabled"`
+}
+
+// recordsFile is the descriptor of the records service. It is built by hand
+// rather than generated, and registered globally so that it is served by the
+// reflection service.
+var recordsFile = sync.OnceValues(func() (protoreflect.FileDescriptor, error) {
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+	msg := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+	field := func(name string, number int32, typ *descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ,
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	method := func(name, input, output string, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(input),
+			OutputType:      proto.String(output),
+			ServerStreaming: proto.Bool(serverStreaming),
+		}
+	}
+
+	records := field("records", 1, msg, "."+grpcPackage+".Record")
+	records.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("traefik/hub/apiserver/v1/records.proto"),
+		Package: proto.String(grpcPackage),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			"google/protobuf/empty.proto",
+			"google/protobuf/struct.proto",
+			"google/protobuf/timestamp.proto",
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("Record",
+				field("id", 1, str, ""),
+				field("data", 2, msg, ".google.protobuf.Struct")),
+			message("ListRequest",
+				field("collection", 1, str, "")),
+			message("ListResponse", records),
+			message("GetRequest",
+				field("collection", 1, str, ""),
+				field("id", 2, str, "")),
+			message("CreateRequest",
+				field("collection", 1, str, ""),
+				field("data", 2, msg, ".google.protobuf.Struct")),
+			message("UpdateRequest",
+				field("collection", 1, str, ""),
+				field("id", 2, str, ""),
+				field("data", 3, msg, ".google.protobuf.Struct")),
+			message("PatchRequest",
+				field("collection", 1, str, ""),
+				field("id", 2, str, ""),
+				field("operations", 3, msg, ".google.protobuf.ListValue")),
+			message("DeleteRequest",
+				field("collection", 1, str, ""),
+				field("id", 2, str, "")),
+			message("WatchRequest",
+				field("collection", 1, str, ""),
+				field("last_event_id", 2, str, "")),
+			message("Event",
+				field("event_id", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64.Enum(), ""),
+				field("type", 2, str, ""),
+				field("collection", 3, str, ""),
+				field("id", 4, str, ""),
+				field("data", 5, msg, ".google.protobuf.Struct"),
+				field("time", 6, msg, ".google.protobuf.Timestamp")),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Records"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("List", ".traefik.hub.apiserver.v1.ListRequest", ".traefik.hub.apiserver.v1.ListResponse", false),
+				method("Get", ".traefik.hub.apiserver.v1.GetRequest", ".traefik.hub.apiserver.v1.Record", false),
+				method("Create", ".traefik.hub.apiserver.v1.CreateRequest", ".traefik.hub.apiserver.v1.Record", false),
+				method("Update", ".traefik.hub.apiserver.v1.UpdateRequest", ".traefik.hub.apiserver.v1.Record", false),
+				method("Patch", ".traefik.hub.apiserver.v1.PatchRequest", ".traefik.hub.apiserver.v1.Record", false),
+				method("Delete", ".traefik.hub.apiserver.v1.DeleteRequest", ".google.protobuf.Empty", false),
+				method("Watch", ".traefik.hub.apiserver.v1.WatchRequest", ".traefik.hub.apiserver.v1.Event", true),
+			},
+		}},
+	}
+
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
+		return nil, err
+	}
+
+	return fd, nil
+})
+
+// grpcRequest holds the fields of the requests of the records service, read
+// from their JSON mapping.
+type grpcRequest struct {
+	Collection  string                 `json:"collection"`
+	ID          string                 `json:"id"`
+	Data        map[string]interface{} `json:"data"`
+	Operations  []interface{}          `json:"operations"`
+	LastEventID string                 `json:"lastEventId"`
+}
+
+type grpcRecord struct {
+	ID   string                 `json:"id"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// newGRPCServer returns a gRPC server exposing the records of the API along
+// with the health and reflection services.
+func (a *api) newGRPCServer() (*grpc.Server, error) {
+	fd, err := recordsFile()
+	if err != nil {
+		return nil, err
+	}
+	service := fd.Services().ByName("Records")
+	messages := fd.Messages()
+
+	unary := func(name string, fn func(context.Context, grpcRequest) (interface{}, error)) grpc.MethodDesc {
+		method := service.Methods().ByName(protoreflect.Name(name))
+		return grpc.MethodDesc{
+			MethodName: name,
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := dynamicpb.NewMessage(method.Input())
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+
+				handle := func(ctx context.Context, in interface{}) (interface{}, error) {
+					var req grpcRequest
+					if err := fromMessage(in.(proto.Message), &req); err != nil {
+						return nil, status.Error(codes.InvalidArgument, err.Error())
+					}
+					if req.Collection == "" {
+						return nil, status.Error(codes.InvalidArgument, "collection is required")
+					}
+
+					out, err := fn(ctx, req)
+					if err != nil {
+						return nil, err
+					}
+					return toMessage(method.Output(), out)
+				}
+
+				if interceptor == nil {
+					return handle(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/" + name}
+				return interceptor(ctx, in, info, handle)
+			},
+		}
+	}
+
+	desc := &grpc.ServiceDesc{
+		ServiceName: grpcServiceName,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			unary("List", a.grpcList),
+			unary("Get", a.grpcGet),
+			unary("Create", a.grpcCreate),
+			unary("Update", a.grpcUpdate),
+			unary("Patch", a.grpcPatch),
+			unary("Delete", a.grpcDelete),
+		},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				return a.grpcWatch(stream, messages.ByName("WatchRequest"), messages.ByName("Event"))
+			},
+		}},
+		Metadata: fd.Path(),
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(a.grpcGuardInterceptor, a.grpcAuditInterceptor),
+		grpc.StreamInterceptor(a.grpcGuardStreamInterceptor),
+	)
+	server.RegisterService(desc, a)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(grpcServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	reflection.Register(server)
+
+	return server, nil
+}
+
+// grpcRESTRequest returns the REST request equivalent to a call of the records
+// service, so that the security requirements and rate limits of the REST API
+// apply to the call. Its headers are the metadata of the call.
+func grpcRESTRequest(ctx context.Context, fullMethod string, call grpcRequest) *http.Request {
+	collection := "/" + url.PathEscape(call.Collection)
+	record := collection + "/" + url.PathEscape(call.ID)
+
+	method, path := http.MethodPost, fullMethod
+	switch strings.TrimPrefix(fullMethod, "/"+grpcServiceName+"/") {
+	case "List":
+		method, path = http.MethodGet, collection
+	case "Get":
+		method, path = http.MethodGet, record
+	case "Create":
+		method, path = http.MethodPost, collection
+	case "Update":
+		method, path = http.MethodPut, record
+	case "Patch":
+		method, path = http.MethodPatch, record
+	case "Delete":
+		method, path = http.MethodDelete, record
+	case "Watch":
+		method, path = http.MethodGet, collection+"/_events"
+	}
+
+	req := (&http.Request{Method: method, URL: &url.URL{Path: path}, Header: http.Header{}}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, v := range md {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	return req
+}
+
+// grpcGuard applies the security requirements and the rate limits of the REST
+// API to a call of the records service. It returns the context of the call,
+// holding the authenticated principal.
+func (a *api) grpcGuard(ctx context.Context, fullMethod string, in interface{}) (context.Context, error) {
+	var call grpcRequest
+	if msg, ok := in.(proto.Message); ok {
+		if err := fromMessage(msg, &call); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	req := grpcRESTRequest(ctx, fullMethod, call)
+
+	p, err := a.authorizeRequest(req)
+	if err != nil {
+		var authErr *authError
+		switch {
+		case !errors.As(err, &authErr):
+			return nil, status.Error(codes.Internal, err.Error())
+		case authErr.status == http.StatusForbidden:
+			return nil, status.Error(codes.PermissionDenied, authErr.Error())
+		default:
+			return nil, status.Error(codes.Unauthenticated, authErr.Error())
+		}
+	}
+	if p != nil {
+		ctx = context.WithValue(ctx, principalKey{}, p)
+		req = req.WithContext(ctx)
+	}
+
+	if limit, allowed := a.rateLimits.take(req, a.rateLimitKey); !allowed {
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit %q exceeded", limit.limit.Name)
+	}
+
+	return ctx, nil
+}
+
+// grpcGuardInterceptor guards the unary calls of the records service with
+// grpcGuard.
+func (a *api) grpcGuardInterceptor(ctx context.Context, in interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+grpcServiceName+"/") {
+		return handler(ctx, in)
+	}
+
+	ctx, err := a.grpcGuard(ctx, info.FullMethod, in)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, in)
+}
+
+// grpcGuardStreamInterceptor guards the streaming calls of the records
+// service with grpcGuard, once their request is received.
+func (a *api) grpcGuardStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !strings.HasPrefix(info.FullMethod, "/"+grpcServiceName+"/") {
+		return handler(srv, stream)
+	}
+
+	return handler(srv, &guardedStream{ServerStream: stream, ctx: stream.Context(), guard: func(in interface{}) (context.Context, error) {
+		return a.grpcGuard(stream.Context(), info.FullMethod, in)
+	}})
+}
+
+// guardedStream checks the first message received before handing it over.
+type guardedStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	guard   func(interface{}) (context.Context, error)
+	guarded bool
+}
+
+func (s *guardedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *guardedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.guarded {
+		return nil
+	}
+
+	ctx, err := s.guard(m)
+	if err != nil {
+		return err
+	}
+	s.ctx = ctx
+	s.guarded = true
+
+	return nil
+}
+
+// grpcAuditInterceptor attributes the changes made by the gRPC calls to their
+// caller, as auditMiddleware does for HTTP requests.
+func (a *api) grpcAuditInterceptor(ctx context.Context, in interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	switch info.FullMethod {
+	case "/" + grpcServiceName + "/Create", "/" + grpcServiceName + "/Update", "/" + grpcServiceName + "/Patch", "/" + grpcServiceName + "/Delete":
+	default:
+		return handler(ctx, in)
+	}
+	if !a.audit.enabled {
+		return handler(ctx, in)
+	}
+
+	// The caller is identified from the metadata as from the headers of an
+	// HTTP request.
+	req := grpcRESTRequest(ctx, info.FullMethod, grpcRequest{})
+
+	requestID := req.Header.Get(headerRequestID)
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(headerRequestID, requestID))
+
+	return handler(withAuditRequest(ctx, &auditRequest{id: requestID, caller: a.clientIdentity(req), operation: info.FullMethod}), in)
+}
+
+func (a *api) grpcList(_ context.Context, req grpcRequest) (interface{}, error) {
+	objs, _ := a.listObjects(req.Collection)
+
+	ids := make([]string, 0, len(objs))
+	for id := range objs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+
+	records := make([]grpcRecord, 0, len(ids))
+	for _, id := range ids {
+		var data map[string]interface{}
+		if err := json.Unmarshal(objs[id], &data); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		records = append(records, grpcRecord{ID: id, Data: data})
+	}
+
+	return map[string]interface{}{"records": records}, nil
+}
+
+func (a *api) grpcGet(_ context.Context, req grpcRequest) (interface{}, error) {
+	raw, err := a.getObject(req.Collection, req.ID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	var data map[string]interface{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return grpcRecord{ID: req.ID, Data: data}, nil
+}
+
+func (a *api) grpcCreate(ctx context.Context, req grpcRequest) (interface{}, error) {
+	data := req.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	id, err := a.createRecord(ctx, req.Collection, data)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcRecord{ID: id, Data: data}, nil
+}
+
+func (a *api) grpcUpdate(ctx context.Context, req grpcRequest) (interface{}, error) {
+	data := req.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	if _, err := a.replaceRecord(ctx, req.Collection, req.ID, data); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcRecord{ID: req.ID, Data: data}, nil
+}
+
+// grpcPatch applies the JSON Patch operations of the request to a record.
+func (a *api) grpcPatch(ctx context.Context, req grpcRequest) (interface{}, error) {
+	raw, err := a.getObject(req.Collection, req.ID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	operations, err := json.Marshal(req.Operations)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	patch, err := jsonpatch.DecodePatch(operations)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	var data map[string]interface{}
+	if err = json.Unmarshal(patched, &data); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err = a.replaceRecord(ctx, req.Collection, req.ID, data); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcRecord{ID: req.ID, Data: data}, nil
+}
+
+func (a *api) grpcDelete(ctx context.Context, req grpcRequest) (interface{}, error) {
+	if err := a.deleteRecord(ctx, req.Collection, req.ID); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return struct{}{}, nil
+}
+
+// grpcWatch streams the changes of a collection, or of all of them when the
+// request has no collection.
+func (a *api) grpcWatch(stream grpc.ServerStream, requestDesc, eventDesc protoreflect.MessageDescriptor) error {
+	in := dynamicpb.NewMessage(requestDesc)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+
+	var req grpcRequest
+	if err := fromMessage(in, &req); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var lastID uint64
+	resume := req.LastEventID != ""
+	if resume {
+		var err error
+		lastID, err = strconv.ParseUint(req.LastEventID, 10, 64)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid event ID %q", req.LastEventID)
+		}
+	}
+
+	missed, ch := a.events.subscribe(lastID, resume)
+	defer a.events.unsubscribe(ch)
+
+	send := func(evt event) error {
+		if req.Collection != "" && evt.Collection != req.Collection {
+			return nil
+		}
+
+		out := map[string]interface{}{
+			"eventId":    strconv.FormatUint(evt.ID, 10),
+			"type":       evt.Type,
+			"collection": evt.Collection,
+			"id":         evt.ObjectID,
+			"time":       evt.Time.Format(time.RFC3339Nano),
+		}
+		if evt.Object != nil {
+			out["data"] = evt.Object
+		}
+
+		msg, err := toMessage(eventDesc, out)
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(msg)
+	}
+
+	for _, evt := range missed {
+		if err := send(evt); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+
+		case evt, ok := <-ch:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "too slow, resume from the last event received")
+			}
+			if err := send(evt); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fromMessage reads msg into v through its JSON mapping.
+func fromMessage(msg proto.Message, v interface{}) error {
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// toMessage builds a message of the given type from the JSON mapping of v.
+func toMessage(desc protoreflect.MessageDescriptor, v interface{}) (proto.Message, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	if err = protojson.Unmarshal(data, msg); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return msg, nil
+}
+
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errRestricted):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	switch recordErrorStatus(err) {
+	case http.StatusNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case http.StatusUnprocessableEntity:
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// grpcHandler serves the gRPC and gRPC-Web requests with server, and the
+// other ones with next.
+func grpcHandler(server *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		contentType := req.Header.Get("Content-Type")
+
+		switch {
+		case strings.HasPrefix(contentType, "application/grpc-web"), isGRPCWebPreflight(req):
+			serveGRPCWeb(server, rw, req)
+		case req.ProtoMajor == 2 && strings.HasPrefix(contentType, "application/grpc"):
+			server.ServeHTTP(rw, req)
+		default:
+			next.ServeHTTP(rw, req)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func newGRPCAPI(t *testing.T, cfg *config) (*api, *grpc.ClientConn, *httptest.Server) {
+	t.Helper()
+
+	a := &api{}
+	require.NoError(t, a.loadData("fixtures/data.json"))
+	if cfg != nil {
+		require.NoError(t, a.configure(cfg))
+	}
+
+	server, err := a.newGRPCServer()
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(h2c.NewHandler(grpcHandler(server, a.getRouter()), &http2.Server{}))
+	t.Cleanup(srv.Close)
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return a, conn, srv
+}
+
+func recordsMethod(t *testing.T, name string) protoreflect.MethodDescriptor {
+	t.Helper()
+
+	fd, err := recordsFile()
+	require.NoError(t, err)
+
+	method := fd.Services().ByName("Records").Methods().ByName(protoreflect.Name(name))
+	require.NotNil(t, method)
+
+	return method
+}
+
+// invokeRecords calls a method of the records service with the JSON mapping
+// of its request, and returns the JSON mapping of its response.
+func invokeRecords(t *testing.T, conn *grpc.ClientConn, name, request string) (string, error) {
+	t.Helper()
+
+	method := recordsMethod(t, name)
+	in := dynamicpb.NewMessage(method.Input())
+	out := dynamicpb.NewMessage(method.Output())
+	require.NoError(t, protojson.Unmarshal([]byte(request), in))
+
+	err := conn.Invoke(context.Background(), "/"+grpcServiceName+"/"+name, in, out)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := protojson.Marshal(out)
+	require.NoError(t, err)
+
+	return string(data), nil
+}
+
+func Test_grpc_crud(t *testing.T) {
+	a, conn, _ := newGRPCAPI(t, nil)
+
+	out, err := invokeRecords(t, conn, "Get", `{"collection":"weather","id":"1"}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"1","data":{"city":"City of Gophers","weather":"Sunny"}}`, out)
+
+	out, err = invokeRecords(t, conn, "List", `{"collection":"weather"}`)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(out, `"id"`))
+
+	out, err = invokeRecords(t, conn, "Create", `{"collection":"weather","data":{"city":"Lyon"}}`)
+	require.NoError(t, err)
+	assert.Contains(t, out, `"data":{"city":"Lyon"}`)
+
+	_, err = invokeRecords(t, conn, "Update", `{"collection":"weather","id":"0","data":{"city":"Paris"}}`)
+	require.NoError(t, err)
+
+	out, err = invokeRecords(t, conn, "Patch", `{"collection":"weather","id":"0","operations":[{"op":"add","path":"/weather","value":"Foggy"}]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"0","data":{"city":"Paris","weather":"Foggy"}}`, out)
+
+	raw, err := a.getObject("weather", "0")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city":"Paris","weather":"Foggy"}`, string(raw))
+
+	_, err = invokeRecords(t, conn, "Delete", `{"collection":"weather","id":"0"}`)
+	require.NoError(t, err)
+
+	_, err = invokeRecords(t, conn, "Get", `{"collection":"weather","id":"0"}`)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = invokeRecords(t, conn, "Get", `{"id":"0"}`)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = invokeRecords(t, conn, "Patch", `{"collection":"weather","id":"1","operations":[{"op":"test","path":"/city","value":"Nope"}]}`)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func Test_grpc_watch(t *testing.T) {
+	a, conn, _ := newGRPCAPI(t, nil)
+
+	a.setObject(context.Background(), "weather", "3", []byte(`{"city":"Lyon"}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	method := recordsMethod(t, "Watch")
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/"+grpcServiceName+"/Watch")
+	require.NoError(t, err)
+
+	in := dynamicpb.NewMessage(method.Input())
+	require.NoError(t, protojson.Unmarshal([]byte(`{"collection":"weather","lastEventId":"0"}`), in))
+	require.NoError(t, stream.SendMsg(in))
+	require.NoError(t, stream.CloseSend())
+
+	out := dynamicpb.NewMessage(method.Output())
+	require.NoError(t, stream.RecvMsg(out))
+
+	data, err := protojson.Marshal(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"type":"created"`)
+	assert.Contains(t, string(data), `"data":{"city":"Lyon"}`)
+
+	a.deleteObject(context.Background(), "weather", "3")
+
+	out = dynamicpb.NewMessage(method.Output())
+	require.NoError(t, stream.RecvMsg(out))
+
+	data, err = protojson.Marshal(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"eventId":"2"`)
+	assert.Contains(t, string(data), `"type":"deleted"`)
+}
+
+func Test_grpc_guard(t *testing.T) {
+	a, conn, _ := newGRPCAPI(t, &config{
+		Auth:       &authConfig{APIKeys: []apiKeyCredential{{Key: "key", Subject: "alice"}}},
+		RateLimits: []rateLimitConfig{{Name: "list", Key: rateLimitKeySubject, Rate: 1, Period: time.Hour, Methods: []string{"GET"}, Path: "/weather"}},
+	})
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi-auth.yaml"))
+
+	_, err := invokeRecords(t, conn, "List", `{"collection":"weather"}`)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key")
+	method := recordsMethod(t, "List")
+	in := dynamicpb.NewMessage(method.Input())
+	require.NoError(t, protojson.Unmarshal([]byte(`{"collection":"weather"}`), in))
+
+	require.NoError(t, conn.Invoke(ctx, "/"+grpcServiceName+"/List", in, dynamicpb.NewMessage(method.Output())))
+
+	err = conn.Invoke(ctx, "/"+grpcServiceName+"/List", in, dynamicpb.NewMessage(method.Output()))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true}, "/"+grpcServiceName+"/Watch")
+	require.NoError(t, err)
+	watch := dynamicpb.NewMessage(recordsMethod(t, "Watch").Input())
+	require.NoError(t, protojson.Unmarshal([]byte(`{"collection":"weather"}`), watch))
+	require.NoError(t, stream.SendMsg(watch))
+	require.NoError(t, stream.CloseSend())
+
+	err = stream.RecvMsg(dynamicpb.NewMessage(recordsMethod(t, "Watch").Output()))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func Test_grpc_healthAndReflection(t *testing.T) {
+	_, conn, _ := newGRPCAPI(t, nil)
+
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: grpcServiceName})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}))
+
+	reflResp, err := stream.Recv()
+	require.NoError(t, err)
+
+	var services []string
+	for _, service := range reflResp.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+	assert.Contains(t, services, grpcServiceName)
+	assert.Contains(t, services, "grpc.health.v1.Health")
+
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: grpcServiceName},
+	}))
+	reflResp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, reflResp.GetFileDescriptorResponse().GetFileDescriptorProto())
+}
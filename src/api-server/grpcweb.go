@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	mediaTypeGRPC        = "application/grpc"
+	mediaTypeGRPCWeb     = "application/grpc-web"
+	mediaTypeGRPCWebText = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag marks the frame holding the trailers of a gRPC-Web
+	// response.
+	grpcWebTrailerFlag = 0x80
+)
+
+// isGRPCWebPreflight tells whether req is the CORS preflight of a gRPC-Web
+// call made by a browser.
+func isGRPCWebPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		strings.Contains(strings.ToLower(req.Header.Get("Access-Control-Request-Headers")), "x-grpc-web")
+}
+
+// serveGRPCWeb translates a gRPC-Web call into a gRPC one: the request is
+// presented to server as HTTP/2, and the trailers of the response are sent
+// in the body, as a last frame.
+func serveGRPCWeb(server http.Handler, rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+
+	if isGRPCWebPreflight(req) {
+		rw.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+		rw.Header().Set("Access-Control-Allow-Headers", req.Header.Get("Access-Control-Request-Headers"))
+		rw.Header().Set("Access-Control-Max-Age", "600")
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, mediaTypeGRPCWebText)
+
+	r := req.Clone(req.Context())
+	r.ProtoMajor, r.ProtoMinor, r.Proto = 2, 0, "HTTP/2.0"
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	if text {
+		r.Header.Set("Content-Type", mediaTypeGRPC+strings.TrimPrefix(contentType, mediaTypeGRPCWebText))
+		r.Body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, req.Body))
+	} else {
+		r.Header.Set("Content-Type", mediaTypeGRPC+strings.TrimPrefix(contentType, mediaTypeGRPCWeb))
+	}
+
+	w := &grpcWebResponseWriter{rw: rw, header: http.Header{}, text: text}
+	server.ServeHTTP(w, r)
+	w.finish()
+}
+
+// grpcWebResponseWriter turns the response of a gRPC server into a gRPC-Web
+// one.
+type grpcWebResponseWriter struct {
+	rw          http.ResponseWriter
+	header      http.Header
+	text        bool
+	wroteHeader bool
+}
+
+func (w *grpcWebResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *grpcWebResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	declared := w.header.Values("Trailer")
+	for k, v := range w.header {
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) || containsFold(declared, k) {
+			continue
+		}
+		w.rw.Header()[k] = v
+	}
+
+	contentType := w.header.Get("Content-Type")
+	if w.text {
+		w.rw.Header().Set("Content-Type", mediaTypeGRPCWebText+strings.TrimPrefix(contentType, mediaTypeGRPC))
+	} else {
+		w.rw.Header().Set("Content-Type", mediaTypeGRPCWeb+strings.TrimPrefix(contentType, mediaTypeGRPC))
+	}
+
+	w.rw.WriteHeader(status)
+}
+
+func (w *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+
+	if w.text {
+		if _, err := io.WriteString(w.rw, base64.StdEncoding.EncodeToString(b)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	return w.rw.Write(b)
+}
+
+func (w *grpcWebResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+
+	if flusher, ok := w.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish sends the trailers: the declared ones, and those set with the
+// http.TrailerPrefix.
+func (w *grpcWebResponseWriter) finish() {
+	w.WriteHeader(http.StatusOK)
+
+	trailers := http.Header{}
+	for _, name := range w.header.Values("Trailer") {
+		for _, k := range strings.Split(name, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if v := w.header.Values(k); len(v) > 0 {
+				trailers[k] = v
+			}
+		}
+	}
+	for k, v := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		}
+	}
+
+	keys := make([]string, 0, len(trailers))
+	for k := range trailers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var block bytes.Buffer
+	for _, k := range keys {
+		for _, v := range trailers[k] {
+			_, _ = fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.Bytes()...)
+
+	_, _ = w.Write(frame)
+	w.Flush()
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func Test_grpcWeb(t *testing.T) {
+	_, _, srv := newGRPCAPI(t, nil)
+
+	method := recordsMethod(t, "Get")
+	in := dynamicpb.NewMessage(method.Input())
+	require.NoError(t, protojson.Unmarshal([]byte(`{"collection":"weather","id":"2"}`), in))
+
+	msg, err := proto.Marshal(in)
+	require.NoError(t, err)
+
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	// gRPC-Web is served over HTTP/1.1.
+	resp, err := http.Post(srv.URL+"/"+grpcServiceName+"/Get", "application/grpc-web+proto", bytes.NewReader(frame))
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/grpc-web+proto", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Greater(t, len(body), 5)
+	assert.Equal(t, byte(0), body[0])
+	size := binary.BigEndian.Uint32(body[1:5])
+
+	out := dynamicpb.NewMessage(method.Output())
+	require.NoError(t, proto.Unmarshal(body[5:5+size], out))
+	data, err := protojson.Marshal(out)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"2","data":{"city":"GopherRocks","weather":"Cloudy"}}`, string(data))
+
+	trailer := body[5+size:]
+	require.Greater(t, len(trailer), 5)
+	assert.Equal(t, byte(grpcWebTrailerFlag), trailer[0])
+	assert.Contains(t, string(trailer[5:]), "grpc-status: 0\r\n")
+
+	// REST requests are still served.
+	resp, err = http.Get(srv.URL + "/weather/2")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_grpcWeb_preflight(t *testing.T) {
+	_, _, srv := newGRPCAPI(t, nil)
+
+	req, err := http.NewRequest(http.MethodOptions, srv.URL+"/"+grpcServiceName+"/Get", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "content-type,x-grpc-web", resp.Header.Get("Access-Control-Allow-Headers"))
+}
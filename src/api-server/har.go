@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// harLog is an HTTP Archive, as described by the HAR 1.2 specification.
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHAR(exchanges []exchange) harLog {
+	entries := make([]harEntry, 0, len(exchanges))
+	for _, e := range exchanges {
+		entries = append(entries, newHAREntry(e))
+	}
+
+	return harLog{Log: harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "api-server", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+func newHAREntry(e exchange) harEntry {
+	elapsed := float64(e.Duration) / float64(time.Millisecond)
+
+	entry := harEntry{
+		StartedDateTime: e.Started.Format(time.RFC3339Nano),
+		Time:            elapsed,
+		Request: harRequest{
+			Method:      e.Request.Method,
+			URL:         e.Request.URL,
+			HTTPVersion: e.Request.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.Request.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    e.Request.BodySize,
+		},
+		Response: harResponse{
+			Status:      e.Response.Status,
+			StatusText:  http.StatusText(e.Response.Status),
+			HTTPVersion: e.Response.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.Response.Header),
+			Content: harBody{
+				Size:     e.Response.BodySize,
+				MimeType: e.Response.Header.Get("Content-Type"),
+				Text:     e.Response.Body,
+				Encoding: e.Response.BodyEncoding,
+			},
+			RedirectURL: e.Response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.Response.BodySize,
+		},
+		Timings: harTimings{Send: 0, Wait: elapsed, Receive: 0},
+	}
+
+	if u, err := url.Parse(e.Request.URL); err == nil {
+		entry.Request.QueryString = harValues(u.Query())
+	}
+
+	if e.Request.BodySize > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: e.Request.Header.Get("Content-Type"),
+			Text:     e.Request.Body,
+			Encoding: e.Request.BodyEncoding,
+		}
+	}
+
+	if e.Request.Truncated || e.Response.Truncated {
+		entry.Comment = "bodies are truncated"
+	}
+
+	return entry
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	return harValues(map[string][]string(header))
+}
+
+// harValues flattens values, sorted by name so that archives are stable.
+func harValues(values map[string][]string) []harNameValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []harNameValue{}
+	for _, name := range names {
+		for _, value := range values[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+
+	return pairs
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newHAREntry(t *testing.T) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	entry := newHAREntry(exchange{
+		Started:  started,
+		Duration: 1500 * time.Microsecond,
+		Request: recordedMessage{
+			Method: http.MethodPost,
+			URL:    "http://localhost/weather?b=2&a=1",
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Content-Type": {"application/json"}, "Accept": {"*/*"}},
+			Body:   `{"city":"Lyon"}`, BodySize: 15,
+		},
+		Response: recordedMessage{
+			Status: http.StatusCreated,
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Content-Type": {"image/png"}},
+			Body:   "iVBORw0KGgo=", BodyEncoding: "base64", BodySize: 8, Truncated: true,
+		},
+	})
+
+	assert.Equal(t, "2024-01-02T03:04:05Z", entry.StartedDateTime)
+	assert.InDelta(t, 1.5, entry.Time, 0.001)
+	assert.Equal(t, []harNameValue{{Name: "Accept", Value: "*/*"}, {Name: "Content-Type", Value: "application/json"}}, entry.Request.Headers)
+	assert.Equal(t, []harNameValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, entry.Request.QueryString)
+	assert.Equal(t, &harPostData{MimeType: "application/json", Text: `{"city":"Lyon"}`}, entry.Request.PostData)
+	assert.Equal(t, "Created", entry.Response.StatusText)
+	assert.Equal(t, harBody{Size: 8, MimeType: "image/png", Text: "iVBORw0KGgo=", Encoding: "base64"}, entry.Response.Content)
+	assert.Equal(t, -1, entry.Response.HeadersSize)
+	assert.NotEmpty(t, entry.Comment)
+}
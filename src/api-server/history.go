@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errHistoryDisabled = errors.New("history is not enabled")
+
+type historyConfig struct {
+	// Enabled keeps the revisions of the records. Deleted records can then
+	// be restored, and read in the past with ?asOf=.
+	Enabled bool `yaml:"enabled"`
+	// MaxRevisions is the number of revisions kept per record, all of them
+	// by default.
+	MaxRevisions int `yaml:"maxRevisions"`
+}
+
+// revision is a state of a record. The revisions of deleted records hold
+// their last state.
+type revision struct {
+	Revision int             `json:"revision"`
+	Type     string          `json:"type"`
+	EventID  uint64          `json:"eventId,omitempty"`
+	Time     time.Time       `json:"time"`
+	Object   json.RawMessage `json:"object,omitempty"`
+}
+
+func (r revision) deleted() bool {
+	return r.Type == eventDeleted
+}
+
+// recordHistory keeps the revisions of the records, fed by the event bus.
+type recordHistory struct {
+	mu        sync.RWMutex
+	enabled   bool
+	max       int
+	revisions map[string]map[string][]revision
+}
+
+// configure starts the history of the records with their current state.
+func (h *recordHistory) configure(cfg historyConfig, data map[string]map[string]json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.enabled = cfg.Enabled
+	h.max = cfg.MaxRevisions
+	h.seed(data)
+}
+
+// reset starts the history again with data, when the records are replaced
+// without events.
+func (h *recordHistory) reset(data map[string]map[string]json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.enabled {
+		h.seed(data)
+	}
+}
+
+func (h *recordHistory) seed(data map[string]map[string]json.RawMessage) {
+	h.revisions = map[string]map[string][]revision{}
+
+	now := time.Now().UTC()
+	for objType, objs := range data {
+		h.revisions[objType] = make(map[string][]revision, len(objs))
+		for id, obj := range objs {
+			h.revisions[objType][id] = []revision{{Revision: 1, Type: eventCreated, Time: now, Object: obj}}
+		}
+	}
+}
+
+// record adds the revision made by evt. It is called by the event bus while
+// the records are locked, so that revisions are in the order of the changes.
+func (h *recordHistory) record(evt event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.revisions[evt.Collection] == nil {
+		h.revisions[evt.Collection] = map[string][]revision{}
+	}
+	revisions := h.revisions[evt.Collection][evt.ObjectID]
+
+	rev := revision{Revision: 1, Type: evt.Type, EventID: evt.ID, Time: evt.Time, Object: evt.Object}
+	if len(revisions) > 0 {
+		last := revisions[len(revisions)-1]
+		rev.Revision = last.Revision + 1
+		if rev.deleted() {
+			rev.Object = last.Object
+		}
+	}
+
+	revisions = append(revisions, rev)
+	if h.max > 0 && len(revisions) > h.max {
+		revisions = append(revisions[:0], revisions[len(revisions)-h.max:]...)
+	}
+	h.revisions[evt.Collection][evt.ObjectID] = revisions
+}
+
+func (h *recordHistory) of(objType, id string) ([]revision, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	revisions, ok := h.revisions[objType][id]
+
+	return append([]revision{}, revisions...), ok
+}
+
+// at returns the revision of objType/id current at t.
+func (h *recordHistory) at(objType, id string, t time.Time) (revision, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return revisionAt(h.revisions[objType][id], t)
+}
+
+// collectionAt returns the records of objType which existed at t.
+func (h *recordHistory) collectionAt(objType string, t time.Time) (map[string]json.RawMessage, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	records, ok := h.revisions[objType]
+	if !ok {
+		return nil, false
+	}
+
+	objs := map[string]json.RawMessage{}
+	for id, revisions := range records {
+		if rev, ok := revisionAt(revisions, t); ok && !rev.deleted() {
+			objs[id] = rev.Object
+		}
+	}
+
+	return objs, true
+}
+
+// deletedRecord is the last revision of a deleted record.
+type deletedRecord struct {
+	ID string `json:"id"`
+	revision
+}
+
+// deletedOf returns the deleted records of objType.
+func (h *recordHistory) deletedOf(objType string) []deletedRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	deleted := []deletedRecord{}
+	for _, id := range sortedKeys(h.revisions[objType]) {
+		revisions := h.revisions[objType][id]
+		if last := revisions[len(revisions)-1]; last.deleted() {
+			deleted = append(deleted, deletedRecord{ID: id, revision: last})
+		}
+	}
+
+	return deleted
+}
+
+func revisionAt(revisions []revision, t time.Time) (revision, bool) {
+	i := sort.Search(len(revisions), func(i int) bool { return revisions[i].Time.After(t) })
+	if i == 0 {
+		return revision{}, false
+	}
+
+	return revisions[i-1], true
+}
+
+// asOf returns the time requested with the asOf query parameter, if any.
+func asOf(req *http.Request) (time.Time, bool, error) {
+	value := req.URL.Query().Get("asOf")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid asOf %q, expecting an RFC 3339 date", value)
+	}
+
+	return t, true, nil
+}
+
+// getObjectAsOf returns the objType/objId record as it was at t.
+func (a *api) getObjectAsOf(objType, objId string, t time.Time) (json.RawMessage, error) {
+	if !a.history.enabled {
+		return nil, errHistoryDisabled
+	}
+
+	rev, ok := a.history.at(objType, objId, t)
+	if !ok || rev.deleted() {
+		return nil, fmt.Errorf("%s/%s %w", objType, objId, errRecordNotFound)
+	}
+
+	return rev.Object, nil
+}
+
+// listObjectsAsOf returns the records of objType as they were at t.
+func (a *api) listObjectsAsOf(objType string, t time.Time) (map[string]json.RawMessage, bool, error) {
+	if !a.history.enabled {
+		return nil, false, errHistoryDisabled
+	}
+
+	objs, ok := a.history.collectionAt(objType, t)
+
+	return objs, ok, nil
+}
+
+func (a *api) handleGetHistory(rw http.ResponseWriter, req *http.Request) {
+	objType := chi.URLParam(req, "objType")
+	objId := chi.URLParam(req, "objId")
+
+	revisions, ok := a.history.of(objType, objId)
+	if !ok {
+		JSONError(rw, http.StatusNotFound, fmt.Sprintf("%s/%s %s", objType, objId, errRecordNotFound))
+		return
+	}
+
+	writeJSONResponse(rw, http.StatusOK, revisions)
+}
+
+// handleGetDeleted lists the deleted records of a collection, which can be
+// restored.
+func (a *api) handleGetDeleted(rw http.ResponseWriter, req *http.Request) {
+	writeJSONResponse(rw, http.StatusOK, a.history.deletedOf(chi.URLParam(req, "objType")))
+}
+
+// handleRestore restores a deleted record in its last state, or any record in
+// the state of the revision given with ?revision=.
+func (a *api) handleRestore(rw http.ResponseWriter, req *http.Request) {
+	objType := chi.URLParam(req, "objType")
+	objId := chi.URLParam(req, "objId")
+
+	revisions, ok := a.history.of(objType, objId)
+	if !ok {
+		JSONError(rw, http.StatusNotFound, fmt.Sprintf("%s/%s %s", objType, objId, errRecordNotFound))
+		return
+	}
+
+	target := revisions[len(revisions)-1]
+	if value := req.URL.Query().Get("revision"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid revision %q", value))
+			return
+		}
+
+		i := sort.Search(len(revisions), func(i int) bool { return revisions[i].Revision >= n })
+		if i == len(revisions) || revisions[i].Revision != n {
+			JSONError(rw, http.StatusNotFound, fmt.Sprintf("revision %d of %s/%s not found", n, objType, objId))
+			return
+		}
+		target = revisions[i]
+	} else if !target.deleted() {
+		JSONError(rw, http.StatusConflict, fmt.Sprintf("%s/%s is not deleted", objType, objId))
+		return
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(target.Object, &obj); err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	created, err := a.restoreRecord(req.Context(), objType, objId, obj)
+	if err != nil {
+		JSONError(rw, recordErrorStatus(err), err.Error())
+		return
+	}
+
+	obj["id"] = objId
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSONResponse(rw, status, obj)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHistoryAPI(t *testing.T, cfg historyConfig) *httptest.Server {
+	t.Helper()
+
+	_, srv := newTestServer(t, &config{History: cfg})
+
+	return srv
+}
+
+// instant returns the current time, after letting the clock move so that it
+// falls between two changes.
+func instant(t *testing.T) string {
+	t.Helper()
+
+	time.Sleep(2 * time.Millisecond)
+	now := time.Now().UTC()
+	time.Sleep(2 * time.Millisecond)
+
+	return url.QueryEscape(now.Format(time.RFC3339Nano))
+}
+
+func Test_history(t *testing.T) {
+	srv := newHistoryAPI(t, historyConfig{Enabled: true})
+
+	initial := instant(t)
+
+	resp := doRequest(t, http.MethodPut, srv.URL+"/weather/1", "application/json", `{"city":"Lyon","weather":"Foggy"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	updated := instant(t)
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/weather/1", "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1?asOf="+initial, "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var obj map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&obj))
+	assert.Equal(t, "City of Gophers", obj["city"])
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1?asOf="+updated, "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&obj))
+	assert.Equal(t, "Lyon", obj["city"])
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather?asOf="+updated, "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Len(t, list, 3)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather?asOf=yesterday", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1/_history", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var revisions []revision
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&revisions))
+	require.Len(t, revisions, 3)
+	assert.Equal(t, []string{eventCreated, eventUpdated, eventDeleted}, []string{revisions[0].Type, revisions[1].Type, revisions[2].Type})
+	assert.Equal(t, 3, revisions[2].Revision)
+	assert.JSONEq(t, `{"city":"Lyon","weather":"Foggy"}`, string(revisions[2].Object))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/_deleted", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var deleted []deletedRecord
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&deleted))
+	require.Len(t, deleted, 1)
+	assert.Equal(t, "1", deleted[0].ID)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/42/_history", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_history_restore(t *testing.T) {
+	srv := newHistoryAPI(t, historyConfig{Enabled: true})
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/weather/1/_restore", "", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	doRequest(t, http.MethodPut, srv.URL+"/weather/1", "application/json", `{"city":"Lyon"}`)
+	doRequest(t, http.MethodDelete, srv.URL+"/weather/1", "", "")
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather/1/_restore", "", "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var obj map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&obj))
+	assert.Equal(t, map[string]interface{}{"id": "1", "city": "Lyon"}, obj)
+
+	// Rolling back to a revision.
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather/1/_restore?revision=1", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&obj))
+	assert.Equal(t, "City of Gophers", obj["city"])
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather/1/_restore?revision=42", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather/1/_restore?revision=last", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_history_maxRevisions(t *testing.T) {
+	var h recordHistory
+	h.configure(historyConfig{Enabled: true, MaxRevisions: 2}, nil)
+
+	for i := range 3 {
+		h.record(event{ID: uint64(i + 1), Type: eventUpdated, Collection: "weather", ObjectID: "1", Time: time.Now()})
+	}
+
+	revisions, ok := h.of("weather", "1")
+	require.True(t, ok)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, 2, revisions[0].Revision)
+	assert.Equal(t, 3, revisions[1].Revision)
+}
+
+func Test_history_disabled(t *testing.T) {
+	srv := newHistoryAPI(t, historyConfig{})
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1?asOf=2024-01-01T00:00:00Z", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather?asOf=2024-01-01T00:00:00Z", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_history_loadData(t *testing.T) {
+	a, srv := newTestServer(t, &config{History: historyConfig{Enabled: true}})
+
+	doRequest(t, http.MethodDelete, srv.URL+"/weather/1", "", "")
+
+	// Reloading the records starts the history again from them.
+	require.NoError(t, a.loadData("fixtures/data.json"))
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1/_history", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var revisions []revision
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&revisions))
+	require.Len(t, revisions, 1)
+	assert.Equal(t, eventCreated, revisions[0].Type)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/_deleted", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var deleted []deletedRecord
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&deleted))
+	assert.Empty(t, deleted)
+}
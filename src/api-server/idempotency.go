@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	headerIdempotencyKey      = "Idempotency-Key"
+	headerIdempotentReplayed  = "Idempotent-Replayed"
+	defaultIdempotencyKeysTTL = 24 * time.Hour
+)
+
+type idempotencyConfig struct {
+	// TTL is how long keys and their response are kept, 24h by default.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c idempotencyConfig) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return defaultIdempotencyKeysTTL
+	}
+
+	return c.TTL
+}
+
+// idempotencyStore holds the responses of the requests made with an
+// Idempotency-Key, along with the fingerprint of the request.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	expires     time.Time
+	// done is false while the first request is being processed.
+	done   bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// reserve returns the entry of key, or creates a pending one when there is
+// none. It reports whether the entry was created. Entries expire after ttl,
+// pending ones included.
+func (s *idempotencyStore) reserve(key, fingerprint string, ttl time.Duration) (*idempotencyEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.entries == nil {
+		s.entries = map[string]*idempotencyEntry{}
+	}
+	for k, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	if entry, ok := s.entries[key]; ok {
+		copied := *entry
+		return &copied, false
+	}
+
+	entry := &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(ttl)}
+	s.entries[key] = entry
+
+	return entry, true
+}
+
+// release forgets the pending entry of key, whose request did not complete,
+// so that it can be retried.
+func (s *idempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok && !entry.done {
+		delete(s.entries, key)
+	}
+}
+
+func (s *idempotencyStore) complete(key string, c *responseCapture) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return
+	}
+
+	// Server errors are not stored, so that the request can be retried.
+	if c.statusCode() >= http.StatusInternalServerError {
+		delete(s.entries, key)
+		return
+	}
+
+	entry.done = true
+	entry.status = c.statusCode()
+	entry.header = c.Header().Clone()
+	entry.body = bytes.Clone(c.body.Bytes())
+}
+
+// idempotencyMiddleware makes POST requests carrying an Idempotency-Key safe
+// to retry: the first response is stored and replayed to the next requests
+// with the same key, as long as they are identical.
+func (a *api) idempotencyMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			idempotencyKey := r.Header.Get(headerIdempotencyKey)
+			if r.Method != http.MethodPost || idempotencyKey == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				JSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// Keys are scoped to the client and the target of the request.
+			key := a.clientIdentity(r) + " " + r.URL.Path + " " + idempotencyKey
+			fingerprint := requestFingerprint(r, body)
+
+			entry, created := a.idempotencyKeys.reserve(key, fingerprint, a.idempotency.ttl())
+			if !created {
+				switch {
+				case entry.fingerprint != fingerprint:
+					JSONError(w, http.StatusUnprocessableEntity, "Idempotency-Key already used for a different request")
+				case !entry.done:
+					JSONError(w, http.StatusConflict, "a request with the same Idempotency-Key is being processed")
+				default:
+					for k, v := range entry.header {
+						w.Header()[k] = v
+					}
+					w.Header().Set(headerIdempotentReplayed, "true")
+					w.WriteHeader(entry.status)
+					_, _ = w.Write(entry.body)
+				}
+				return
+			}
+
+			// The reservation is released when the request panics.
+			defer a.idempotencyKeys.release(key)
+
+			capture := newResponseCapture()
+			next.ServeHTTP(capture, r)
+			a.idempotencyKeys.complete(key, capture)
+
+			capture.flush(w, capture.body.Bytes())
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func requestFingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	_, _ = io.WriteString(hash, req.Method+"\n"+req.URL.RequestURI()+"\n"+req.Header.Get("Content-Type")+"\n")
+	_, _ = hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
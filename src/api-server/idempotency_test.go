@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postWithKey(t *testing.T, url, key, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	return resp
+}
+
+func Test_idempotencyMiddleware(t *testing.T) {
+	a, srv := newTestServer(t, nil)
+
+	resp := postWithKey(t, srv.URL+"/weather", "key-1", `{"city":"Lyon","weather":"Sunny"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+	first, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	resp = postWithKey(t, srv.URL+"/weather", "key-1", `{"city":"Lyon","weather":"Sunny"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	replayed, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, first, replayed)
+
+	objs, _ := a.listObjects("weather")
+	assert.Len(t, objs, 4)
+
+	resp = postWithKey(t, srv.URL+"/weather", "key-1", `{"city":"Lyon","weather":"Rainy"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = postWithKey(t, srv.URL+"/weather", "key-2", `{"city":"Lyon","weather":"Rainy"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = postWithKey(t, srv.URL+"/weather", "", `{"city":"Lyon","weather":"Rainy"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	objs, _ = a.listObjects("weather")
+	assert.Len(t, objs, 6)
+}
+
+func Test_idempotencyStore(t *testing.T) {
+	store := idempotencyStore{}
+
+	entry, created := store.reserve("key", "fingerprint", time.Hour)
+	require.True(t, created)
+	assert.False(t, entry.done)
+
+	entry, created = store.reserve("key", "fingerprint", time.Hour)
+	require.False(t, created)
+	assert.False(t, entry.done, "in flight requests are reported")
+
+	capture := newResponseCapture()
+	capture.WriteHeader(http.StatusInternalServerError)
+	store.complete("key", capture)
+
+	_, created = store.reserve("key", "fingerprint", -time.Second)
+	assert.True(t, created, "server errors are not stored")
+
+	capture = newResponseCapture()
+	body, err := json.Marshal(map[string]string{"id": "1"})
+	require.NoError(t, err)
+	_, _ = capture.Write(body)
+	store.complete("key", capture)
+
+	_, created = store.reserve("key", "fingerprint", time.Hour)
+	assert.True(t, created, "expired keys are forgotten")
+}
+
+func Test_idempotencyStore_pending(t *testing.T) {
+	store := idempotencyStore{}
+
+	_, created := store.reserve("key", "fingerprint", -time.Second)
+	require.True(t, created)
+
+	_, created = store.reserve("key", "fingerprint", time.Hour)
+	assert.True(t, created, "expired pending keys are forgotten")
+
+	store.release("key")
+	_, created = store.reserve("key", "fingerprint", time.Hour)
+	assert.True(t, created, "released keys are forgotten")
+
+	store.complete("key", newResponseCapture())
+	store.release("key")
+	_, created = store.reserve("key", "fingerprint", time.Hour)
+	assert.False(t, created, "completed keys are kept")
+}
+
+func Test_idempotencyMiddleware_panic(t *testing.T) {
+	a := &api{}
+
+	panicking := a.idempotencyMiddleware()(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/weather", strings.NewReader(`{"city":"Lyon"}`))
+	req.Header.Set(headerIdempotencyKey, "key-1")
+	assert.Panics(t, func() { panicking.ServeHTTP(httptest.NewRecorder(), req) })
+
+	handler := a.idempotencyMiddleware()(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	req = httptest.NewRequest(http.MethodPost, "/weather", strings.NewReader(`{"city":"Lyon"}`))
+	req.Header.Set(headerIdempotencyKey, "key-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Headers Traefik's PassTLSClientCert middleware forwards the client
+// certificate chain and its parsed information in.
+const (
+	clientCertHeader     = "X-Forwarded-Tls-Client-Cert"
+	clientCertInfoHeader = "X-Forwarded-Tls-Client-Cert-Info"
+)
+
+// identityConfig holds the names of the headers the gateway forwards the
+// caller identity in.
+type identityConfig struct {
+	GroupsHeader   string `yaml:"groupsHeader"`
+	UserIDHeader   string `yaml:"userIdHeader"`
+	ConsumerHeader string `yaml:"consumerHeader"`
+	PlanHeader     string `yaml:"planHeader"`
+}
+
+func (c identityConfig) withDefaults() identityConfig {
+	if c.GroupsHeader == "" {
+		c.GroupsHeader = "X-Hub-Groups"
+	}
+	if c.UserIDHeader == "" {
+		c.UserIDHeader = "X-Hub-User-Id"
+	}
+	if c.ConsumerHeader == "" {
+		c.ConsumerHeader = "X-Hub-Consumer"
+	}
+	if c.PlanHeader == "" {
+		c.PlanHeader = "X-Hub-Plan"
+	}
+
+	return c
+}
+
+type identityReport struct {
+	Token                 *tokenReport        `json:"token,omitempty"`
+	BasicUser             string              `json:"basicUser,omitempty"`
+	Forwarded             forwardedIdentity   `json:"forwarded"`
+	ClientCertificates    []certificateReport `json:"clientCertificates,omitempty"`
+	ClientCertificateInfo string              `json:"clientCertificateInfo,omitempty"`
+}
+
+// tokenReport is the content of a JWT. Verified tells whether the configured
+// keys verify it, it is decoded either way.
+type tokenReport struct {
+	Header   map[string]interface{} `json:"header"`
+	Claims   map[string]interface{} `json:"claims"`
+	Verified bool                   `json:"verified"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+type forwardedIdentity struct {
+	Groups   []string `json:"groups,omitempty"`
+	UserID   string   `json:"userId,omitempty"`
+	Consumer string   `json:"consumer,omitempty"`
+	Plan     string   `json:"plan,omitempty"`
+}
+
+type certificateReport struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serialNumber"`
+	NotBefore         time.Time `json:"notBefore"`
+	NotAfter          time.Time `json:"notAfter"`
+	DNSNames          []string  `json:"dnsNames,omitempty"`
+	EmailAddresses    []string  `json:"emailAddresses,omitempty"`
+	URIs              []string  `json:"uris,omitempty"`
+	SHA256Fingerprint string    `json:"sha256Fingerprint"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// handleIdentity reports the identity of the caller as seen by the backend:
+// the decoded bearer token, the identity headers injected by the gateway and
+// the client certificate chain.
+func (a *api) handleIdentity(rw http.ResponseWriter, req *http.Request) {
+	headers := a.identity.withDefaults()
+
+	report := identityReport{
+		Forwarded: forwardedIdentity{
+			Groups:   splitList(req.Header.Get(headers.GroupsHeader)),
+			UserID:   req.Header.Get(headers.UserIDHeader),
+			Consumer: req.Header.Get(headers.ConsumerHeader),
+			Plan:     req.Header.Get(headers.PlanHeader),
+		},
+		ClientCertificateInfo: unescapeHeader(req.Header.Get(clientCertInfoHeader)),
+	}
+
+	if token, ok := bearerToken(req); ok {
+		report.Token = decodeToken(token)
+		if a.auth != nil && report.Token.Error == "" {
+			_, err := a.auth.verifyToken(token)
+			report.Token.Verified = err == nil
+		}
+	}
+
+	if username, _, ok := req.BasicAuth(); ok {
+		report.BasicUser = username
+	}
+
+	if req.TLS != nil {
+		for _, cert := range req.TLS.PeerCertificates {
+			report.ClientCertificates = append(report.ClientCertificates, newCertificateReport(cert))
+		}
+	}
+	report.ClientCertificates = append(report.ClientCertificates, forwardedCertificates(req.Header.Get(clientCertHeader))...)
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(body)
+}
+
+func decodeToken(token string) *tokenReport {
+	claims := jwt.MapClaims{}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return &tokenReport{Error: err.Error()}
+	}
+
+	return &tokenReport{Header: parsed.Header, Claims: claims}
+}
+
+// forwardedCertificates parses the certificate chain forwarded by the
+// PassTLSClientCert middleware: URL escaped, comma separated, base64 encoded
+// DER certificates.
+func forwardedCertificates(value string) []certificateReport {
+	if value == "" {
+		return nil
+	}
+
+	// Certificates are base64 encoded, "+" must not be read as an escaped space.
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		unescaped = value
+	}
+
+	var reports []certificateReport
+	for _, encoded := range strings.Split(unescaped, ",") {
+		encoded = strings.TrimPrefix(strings.TrimSpace(encoded), "-----BEGIN CERTIFICATE-----")
+		encoded = strings.TrimSuffix(encoded, "-----END CERTIFICATE-----")
+		encoded = strings.Join(strings.Fields(encoded), "")
+
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			reports = append(reports, certificateReport{Error: err.Error()})
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			reports = append(reports, certificateReport{Error: err.Error()})
+			continue
+		}
+
+		reports = append(reports, newCertificateReport(cert))
+	}
+
+	return reports
+}
+
+func newCertificateReport(cert *x509.Certificate) certificateReport {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	report := certificateReport{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      cert.SerialNumber.String(),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		DNSNames:          cert.DNSNames,
+		EmailAddresses:    cert.EmailAddresses,
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	for _, uri := range cert.URIs {
+		report.URIs = append(report.URIs, uri.String())
+	}
+
+	return report
+}
+
+func unescapeHeader(value string) string {
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		return value
+	}
+
+	return unescaped
+}
+
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// clientIdentity names the caller of a request, from the most to the least
+// trustworthy source: the authenticated principal, the identity forwarded by
+// the gateway, the credentials sent along, and finally the client address.
+func (a *api) clientIdentity(req *http.Request) string {
+	if p := principalFromContext(req.Context()); p != nil && p.Subject != "" {
+		return p.Subject
+	}
+
+	headers := a.identity.withDefaults()
+	for _, header := range []string{headers.ConsumerHeader, headers.UserIDHeader} {
+		if value := req.Header.Get(header); value != "" {
+			return value
+		}
+	}
+
+	if token, ok := bearerToken(req); ok {
+		if report := decodeToken(token); report.Error == "" {
+			if sub, ok := report.Claims["sub"].(string); ok && sub != "" {
+				return sub
+			}
+		}
+	}
+
+	if username, _, ok := req.BasicAuth(); ok {
+		return username
+	}
+
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		client, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(client)
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
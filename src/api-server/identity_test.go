@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handleIdentity(t *testing.T) {
+	a := api{}
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "groups": []string{"admin"}}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/_identity", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Hub-Groups", "admin, support")
+	req.Header.Set("X-Hub-User-Id", "42")
+	req.Header.Set("X-Hub-Consumer", "alice")
+	req.Header.Set("X-Hub-Plan", "premium")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report identityReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	require.NotNil(t, report.Token)
+	assert.False(t, report.Token.Verified)
+	assert.Equal(t, "HS256", report.Token.Header["alg"])
+	assert.Equal(t, "alice", report.Token.Claims["sub"])
+	assert.Equal(t, forwardedIdentity{
+		Groups:   []string{"admin", "support"},
+		UserID:   "42",
+		Consumer: "alice",
+		Plan:     "premium",
+	}, report.Forwarded)
+}
+
+func Test_handleIdentity_verifiedToken(t *testing.T) {
+	_, srv := newTestServer(t, &config{Auth: &authConfig{JWT: jwtConfig{Secret: "secret"}}})
+
+	verified := func(secret string) bool {
+		t.Helper()
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte(secret))
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/_identity", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		var report identityReport
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		require.NotNil(t, report.Token)
+
+		return report.Token.Verified
+	}
+
+	assert.True(t, verified("secret"))
+	assert.False(t, verified("other"))
+}
+
+func Test_handleIdentity_customHeaders(t *testing.T) {
+	a := api{}
+	require.NoError(t, a.configure(&config{Identity: identityConfig{GroupsHeader: "grp"}}))
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/_identity", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("grp", "external")
+	req.SetBasicAuth("bob", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var report identityReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	assert.Nil(t, report.Token)
+	assert.Equal(t, "bob", report.BasicUser)
+	assert.Equal(t, []string{"external"}, report.Forwarded.Groups)
+}
+
+func Test_handleIdentity_forwardedClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject:      pkix.Name{CommonName: "alice"},
+		DNSNames:     []string{"alice.localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	a := api{}
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/_identity", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-Tls-Client-Cert", url.QueryEscape(base64.StdEncoding.EncodeToString(der)))
+	req.Header.Set("X-Forwarded-Tls-Client-Cert-Info", url.QueryEscape(`Subject="CN=alice"`))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var report identityReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	require.Len(t, report.ClientCertificates, 1)
+	assert.Equal(t, "CN=alice", report.ClientCertificates[0].Subject)
+	assert.Equal(t, "1234", report.ClientCertificates[0].SerialNumber)
+	assert.Equal(t, []string{"alice.localhost"}, report.ClientCertificates[0].DNSNames)
+	assert.Empty(t, report.ClientCertificates[0].Error)
+	assert.Equal(t, `Subject="CN=alice"`, report.ClientCertificateInfo)
+}
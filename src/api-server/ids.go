@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	idStrategyUUID     = "uuid"
+	idStrategyUUIDv7   = "uuidv7"
+	idStrategySequence = "sequence"
+	idStrategyULID     = "ulid"
+	idStrategyKSUID    = "ksuid"
+	idStrategyField    = "field"
+)
+
+var errMissingNaturalKey = errors.New("missing natural key")
+
+// idConfig is how the IDs of the records of a collection are generated.
+type idConfig struct {
+	// Strategy is one of uuid (the default), uuidv7, sequence, ulid, ksuid
+	// and field.
+	Strategy string `yaml:"strategy"`
+	// Field holds the ID of the records with the field strategy.
+	Field string `yaml:"field"`
+	// Upsert lets clients create records with the ID of their choice, by
+	// updating a missing record.
+	Upsert bool `yaml:"upsert"`
+}
+
+func validateIDs(ids map[string]idConfig) error {
+	for objType, cfg := range ids {
+		switch cfg.Strategy {
+		case "", idStrategyUUID, idStrategyUUIDv7, idStrategySequence, idStrategyULID, idStrategyKSUID:
+		case idStrategyField:
+			if cfg.Field == "" {
+				return fmt.Errorf("ids of %q: field is required with the field strategy", objType)
+			}
+		default:
+			return fmt.Errorf("ids of %q: unknown strategy %q", objType, cfg.Strategy)
+		}
+	}
+
+	return nil
+}
+
+// newID returns the ID of a record about to be created in objType.
+func (a *api) newID(objType string, obj map[string]interface{}) (string, error) {
+	switch a.ids[objType].Strategy {
+	case idStrategyUUIDv7:
+		id, err := uuid.NewV7()
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+
+	case idStrategySequence:
+		return a.nextSequence(objType), nil
+
+	case idStrategyULID:
+		return ulids.next(time.Now())
+
+	case idStrategyKSUID:
+		return newKSUID(time.Now())
+
+	case idStrategyField:
+		field := a.ids[objType].Field
+		value, ok := obj[field]
+		if !ok || value == nil || value == "" {
+			return "", fmt.Errorf("%w: %s is required", errMissingNaturalKey, field)
+		}
+		return fmt.Sprint(value), nil
+
+	default:
+		return uuid.New().String(), nil
+	}
+}
+
+// nextSequence returns the integer following the greatest integer ID ever
+// seen in objType, so that deleted IDs are not reused.
+func (a *api) nextSequence(objType string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sequences == nil {
+		a.sequences = map[string]int64{}
+	}
+
+	last := a.sequences[objType]
+	for id := range a.data[objType] {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && n > last {
+			last = n
+		}
+	}
+
+	a.sequences[objType] = last + 1
+
+	return strconv.FormatInt(last+1, 10)
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates monotonic ULIDs: IDs generated within the same
+// millisecond increment the random part of the previous one, so that they
+// still sort in generation order.
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	lastRnd [10]byte
+}
+
+var ulids ulidGenerator
+
+func (g *ulidGenerator) next(now time.Time) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= g.lastMs {
+		ms = g.lastMs
+		if !increment(g.lastRnd[:]) {
+			return "", errors.New("ulid: random part overflow")
+		}
+	} else {
+		if _, err := rand.Read(g.lastRnd[:]); err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+
+	var raw [16]byte
+	binary.BigEndian.PutUint16(raw[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(raw[2:6], uint32(ms))
+	copy(raw[6:], g.lastRnd[:])
+
+	// 128 bits in 26 base32 characters, the first one only holding 3 bits.
+	n := new(big.Int).SetBytes(raw[:])
+	out := make([]byte, 26)
+	mask := big.NewInt(31)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+
+	return string(out), nil
+}
+
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	ksuidEpoch    = 1400000000
+	base62Charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// newKSUID returns a K-Sortable Unique IDentifier: 4 bytes of seconds since
+// the KSUID epoch followed by 16 random bytes, in 27 base62 characters.
+func newKSUID(now time.Time) (string, error) {
+	var raw [20]byte
+	binary.BigEndian.PutUint32(raw[0:4], uint32(now.Unix()-ksuidEpoch))
+	if _, err := rand.Read(raw[4:]); err != nil {
+		return "", err
+	}
+
+	n := new(big.Int).SetBytes(raw[:])
+	base := big.NewInt(62)
+	mod := new(big.Int)
+	out := make([]byte, 27)
+	for i := len(out) - 1; i >= 0; i-- {
+		n.DivMod(n, base, mod)
+		out[i] = base62Charset[mod.Int64()]
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newIDsAPI(t *testing.T, ids map[string]idConfig) (*api, *httptest.Server) {
+	t.Helper()
+
+	return newTestServer(t, &config{IDs: ids})
+}
+
+func createdID(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var obj map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&obj))
+
+	return obj["id"].(string)
+}
+
+func Test_validateIDs(t *testing.T) {
+	assert.NoError(t, validateIDs(map[string]idConfig{"weather": {Strategy: "ulid"}}))
+	assert.Error(t, validateIDs(map[string]idConfig{"weather": {Strategy: "snowflake"}}))
+	assert.Error(t, validateIDs(map[string]idConfig{"weather": {Strategy: "field"}}))
+}
+
+func Test_handlePost_idStrategies(t *testing.T) {
+	tests := []struct {
+		desc     string
+		strategy string
+		expected *regexp.Regexp
+	}{
+		{desc: "uuid", strategy: "", expected: regexp.MustCompile(`^[0-9a-f-]{36}$`)},
+		{desc: "uuidv7", strategy: "uuidv7", expected: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7`)},
+		{desc: "ulid", strategy: "ulid", expected: regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)},
+		{desc: "ksuid", strategy: "ksuid", expected: regexp.MustCompile(`^[0-9A-Za-z]{27}$`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, srv := newIDsAPI(t, map[string]idConfig{"weather": {Strategy: test.strategy}})
+
+			resp := doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Lyon"}`)
+			assert.Regexp(t, test.expected, createdID(t, resp))
+		})
+	}
+}
+
+func Test_handlePost_sequence(t *testing.T) {
+	_, srv := newIDsAPI(t, map[string]idConfig{"weather": {Strategy: "sequence"}})
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Lyon"}`)
+	assert.Equal(t, "3", createdID(t, resp))
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/weather/3", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Lyon"}`)
+	assert.Equal(t, "4", createdID(t, resp), "deleted IDs are not reused")
+}
+
+func Test_handlePost_naturalKey(t *testing.T) {
+	a, srv := newIDsAPI(t, map[string]idConfig{"cities": {Strategy: "field", Field: "code"}})
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/cities", "application/json", `{"code":"LYS","name":"Lyon"}`)
+	assert.Equal(t, "LYS", createdID(t, resp))
+
+	raw, err := a.getObject("cities", "LYS")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"code":"LYS","name":"Lyon"}`, string(raw))
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/cities", "application/json", `{"code":"LYS","name":"Lyon"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/cities", "application/json", `{"name":"Paris"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func Test_handlePut_upsert(t *testing.T) {
+	a, srv := newIDsAPI(t, map[string]idConfig{"weather": {Strategy: "sequence", Upsert: true}})
+
+	resp := doRequest(t, http.MethodPut, srv.URL+"/weather/10", "application/json", `{"city":"Lyon"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/weather/10", "application/json", `{"city":"Paris"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	raw, err := a.getObject("weather", "10")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city":"Paris"}`, string(raw))
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Lyon"}`)
+	assert.Equal(t, "11", createdID(t, resp))
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/cities/LYS", "application/json", `{"name":"Lyon"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_ulidGenerator(t *testing.T) {
+	g := &ulidGenerator{}
+	now := time.UnixMilli(1700000000000)
+
+	var ids []string
+	for range 100 {
+		id, err := g.next(now)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	assert.True(t, sort.StringsAreSorted(ids), "ULIDs of the same millisecond are monotonic")
+	assert.Equal(t, "01HF7YAT00", ids[0][:10])
+}
+
+func Test_newKSUID(t *testing.T) {
+	first, err := newKSUID(time.Unix(1700000000, 0))
+	require.NoError(t, err)
+	second, err := newKSUID(time.Unix(1700000001, 0))
+	require.NoError(t, err)
+
+	assert.Len(t, first, 27)
+	assert.Less(t, first, second)
+}
@@ -1,28 +1,65 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math/rand/v2"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-openapi/loads"
-	"github.com/google/uuid"
-	"gopkg.in/yaml.v3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// shutdownTimeout is the time given to the requests in flight on shutdown.
+const shutdownTimeout = 5 * time.Second
+
 type api struct {
-	openAPISpec *loads.Document
+	mu          sync.RWMutex
+	openAPISpec *openAPIDocument
+	specDoc     *specDocument
 	data        map[string]map[string]json.RawMessage
 	latency     time.Duration
 	errorRate   int
+	auth        *authenticator
+	identity    identityConfig
+
+	deprecation  deprecationConfig
+	deprecations deprecationUsage
+	relations    []relationConfig
+	ids          map[string]idConfig
+	sequences    map[string]int64
+
+	idempotency     idempotencyConfig
+	idempotencyKeys idempotencyStore
+
+	eventsConfig eventsConfig
+	events       eventBus
+	webhooks     webhookRegistry
+	graphql      graphqlConfig
+	scenarios    scenarioEngine
+	rateLimits   *rateLimiter
+	// trustedProxies are the proxies whose X-Forwarded-For header is trusted.
+	trustedProxies []netip.Prefix
+	history        recordHistory
+	audit          auditLog
+	indexes        searchIndexes
+	generators     generatorEngine
+
+	templateRoutes []*templateRoute
 }
 
 type apiError struct {
@@ -34,6 +71,8 @@ func main() {
 	datafile := flag.String("data", "", "file to put data in")
 	latency := flag.Duration("latency", 0, "latency to add")
 	errorrate := flag.Int("errorrate", 0, "latency to add")
+	configfile := flag.String("config", "", "configuration file of optional features")
+	watch := flag.Bool("watch", false, "reload data and openapispec files when they change")
 	flag.Parse()
 
 	a := api{}
@@ -52,6 +91,20 @@ func main() {
 		}
 	}
 
+	var cfg *config
+	if configfile != nil && *configfile != "" {
+		var err error
+		cfg, err = loadConfig(*configfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = a.configure(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if latency != nil && *latency > 0 {
 		a.latency = *latency
 	}
@@ -60,32 +113,153 @@ func main() {
 		a.errorRate = *errorrate
 	}
 
-	server := &http.Server{Addr: ":3000", Handler: a.getRouter()}
-	if err := server.ListenAndServe(); err != nil {
+	handler := a.getRouter()
+	store := &a
+
+	if cfg != nil && cfg.Proxy != nil {
+		if *openapispec != "" || *datafile != "" || cfg.Versioning != nil {
+			log.Print("a proxy is configured, ignoring -openapi, -data and versions")
+		}
+
+		p, err := newProxy(*cfg.Proxy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = p
+		store = nil
+	} else if cfg != nil && cfg.Versioning != nil {
+		if *openapispec != "" || *datafile != "" {
+			log.Print("versions are configured, ignoring -openapi and -data")
+		}
+
+		versions, err := newVersionRouter(cfg, &a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = versions
+		store = versions.store()
+
+		if watch != nil && *watch {
+			err = versions.watchFiles()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else if cfg != nil && cfg.Tenants != nil {
+		tenants, err := newTenantRouter(cfg, &a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = tenants
+		// The records of the tenants are not served over gRPC, which would
+		// serve the base dataset.
+		store = nil
+
+		if watch != nil && *watch {
+			log.Print("tenants are configured, ignoring -watch")
+		}
+		if cfg.GRPC.Enabled {
+			log.Print("tenants are configured, ignoring grpc")
+		}
+	} else {
+		if watch != nil && *watch {
+			_, err := a.watchFiles(*openapispec, *datafile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// Only the instances serving the requests run the generators.
+		a.generators.start(&a)
+	}
+
+	var rec *recorder
+	if cfg != nil && cfg.Recording.Enabled {
+		var err error
+		rec, err = newRecorder(cfg.Recording)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Exchanges are recorded as they reach the server, before versions
+		// strip their prefix.
+		handler = rec.middleware(handler, a.adminMiddleware())
+	}
+
+	if cfg != nil && cfg.GRPC.Enabled && store != nil {
+		grpcServer, err := store.newGRPCServer()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// gRPC is served over cleartext HTTP/2, next to the REST API.
+		handler = h2c.NewHandler(grpcHandler(grpcServer, handler), &http2.Server{})
+	}
+
+	server := &http.Server{Addr: ":3000", Handler: handler}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+
+	if rec != nil {
+		rec.close()
+	}
 }
 
 func (a *api) loadOpenAPISpec(path string) error {
-	openAPISpec, err := loads.Spec(path)
+	openAPISpec, err := loadOpenAPIDocument(path)
+	if err != nil {
+		return err
+	}
+
+	specDoc, err := parseSpecDocument(openAPISpec.Raw())
 	if err != nil {
 		return err
 	}
 
+	a.mu.Lock()
 	a.openAPISpec = openAPISpec
+	a.specDoc = specDoc
+	a.mu.Unlock()
 	return nil
 }
 
 func (a *api) loadData(path string) error {
-	rawData, err := os.ReadFile(path)
+	data, err := readData(path)
 	if err != nil {
 		return err
 	}
 
+	a.mu.Lock()
+	a.data = data
+	a.indexes.reset()
+	a.history.reset(data)
+	a.audit.reset(data)
+	a.mu.Unlock()
+	return nil
+}
+
+func readData(path string) (map[string]map[string]json.RawMessage, error) {
+	rawData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
 	data := map[string]map[string]json.RawMessage{}
 	err = json.Unmarshal(rawData, &data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, obj := range data {
@@ -93,25 +267,84 @@ func (a *api) loadData(path string) error {
 			var doc map[string]interface{}
 			err := json.Unmarshal(v, &doc)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
-	a.data = data
-	return nil
+	return data, nil
 }
 
 func (a *api) getRouter() http.Handler {
 	router := chi.NewRouter()
 
+	// The routes of the API, templated ones included, are authorized, rate
+	// limited and audited alike.
+	middlewares := chi.Middlewares{
+		a.authMiddleware(),
+		a.rateLimitMiddleware(),
+		a.auditMiddleware(),
+		a.scenarioMiddleware(),
+		a.deprecationMiddleware(),
+		a.idempotencyMiddleware(),
+	}
+	if len(a.templateRoutes) > 0 {
+		router.Use(a.templateMiddleware(middlewares))
+	}
+
 	router.With(a.errorRateMiddleWare()).With(a.latencyMiddleWare()).Get("/openapi.y{[a]?}ml", a.handleOpenAPISpec)
-	router.Get("/{objType}", a.handleGetAll)
-	router.Get("/{objType}/{objId}", a.handleGet)
-	router.Post("/{objType}", a.handlePost)
-	router.Delete("/{objType}/{objId}", a.handleDelete)
-	router.Put("/{objType}/{objId}", a.handlePut)
-	router.Patch("/{objType}/{objId}", a.handlePatch)
+	router.With(a.errorRateMiddleWare()).With(a.latencyMiddleWare()).Get("/openapi.json", a.handleOpenAPISpec)
+	router.With(a.errorRateMiddleWare()).With(a.latencyMiddleWare()).Get("/openapi", a.handleOpenAPISpec)
+	router.Get("/_identity", a.handleIdentity)
+	router.Group(func(r chi.Router) {
+		r.Use(a.adminMiddleware())
+
+		r.Get("/_webhooks", a.handleGetWebhooks)
+		r.Post("/_webhooks", a.handlePostWebhook)
+		r.Get("/_webhooks/{webhookId}", a.handleGetWebhook)
+		r.Delete("/_webhooks/{webhookId}", a.handleDeleteWebhook)
+		r.Get("/_webhooks/{webhookId}/deliveries", a.handleGetWebhookDeliveries)
+		r.Get("/_scenarios", a.handleGetScenarios)
+		r.Post("/_scenarios/reset", a.handleResetScenarios)
+		r.Get("/_scenarios/{scenario}", a.handleGetScenario)
+		r.Put("/_scenarios/{scenario}/state", a.handlePutScenarioState)
+		r.Get("/_audit", a.handleGetAudit)
+		r.Get("/_deprecations", a.handleDeprecations)
+		r.Get("/_generators", a.handleGetGenerators)
+		r.Post("/_generators/generate", a.handleGenerate)
+	})
+	router.Post(batchPath, a.batchHandler(router))
+	router.Group(func(r chi.Router) {
+		r.Use(middlewares...)
+
+		if a.graphql.Enabled {
+			r.Get("/graphql", a.handleGraphQL)
+			r.Post("/graphql", a.handleGraphQL)
+		}
+
+		if a.history.enabled {
+			r.Get("/{objType}/_deleted", a.handleGetDeleted)
+			r.Get("/{objType}/{objId}/_history", a.handleGetHistory)
+			r.Post("/{objType}/{objId}/_restore", a.handleRestore)
+		}
+
+		r.Get("/{objType}", a.handleGetAll)
+		r.Get("/{objType}/_events", a.handleEvents)
+		r.Get("/{objType}/_search", a.handleSearch)
+		r.Post("/{objType}/_search", a.handleSearch)
+		r.Get("/{objType}/{objId}", a.handleGet)
+		r.Post("/{objType}", a.handlePost)
+		r.Post("/{objType}/_bulk", a.handleBulk)
+		r.Delete("/{objType}/{objId}", a.handleDelete)
+		r.Put("/{objType}/{objId}", a.handlePut)
+		r.Patch("/{objType}/{objId}", a.handlePatch)
+		r.Get("/{objType}/{objId}/{relation}", a.handleGetRelated)
+		r.Post("/{objType}/{objId}/{relation}", a.handlePostRelated)
+		r.Get("/{objType}/{objId}/{relation}/{childId}", a.handleRelated)
+		r.Put("/{objType}/{objId}/{relation}/{childId}", a.handleRelated)
+		r.Patch("/{objType}/{objId}/{relation}/{childId}", a.handleRelated)
+		r.Delete("/{objType}/{objId}/{relation}/{childId}", a.handleRelated)
+	})
 
 	return router
 }
@@ -141,32 +374,31 @@ func (a *api) errorRateMiddleWare() func(http.Handler) http.Handler {
 	}
 }
 
-func (a *api) handleOpenAPISpec(rw http.ResponseWriter, req *http.Request) {
-	var jsonObj interface{}
-	if a.openAPISpec == nil {
-		JSONError(rw, http.StatusNotImplemented, "No OpenAPISpec available")
-		return
-	}
+func (a *api) handleGetAll(rw http.ResponseWriter, req *http.Request) {
+	objType := chi.URLParam(req, "objType")
 
-	err := yaml.Unmarshal(a.openAPISpec.Raw(), &jsonObj)
+	c, err := responseCodec(req, true)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		JSONError(rw, http.StatusNotAcceptable, err.Error())
 		return
 	}
 
-	out, err := yaml.Marshal(jsonObj)
+	at, timeTravel, err := asOf(req)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		JSONError(rw, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	_, _ = rw.Write(out)
-}
-
-func (a *api) handleGetAll(rw http.ResponseWriter, req *http.Request) {
-	objType := chi.URLParam(req, "objType")
+	val, ok := a.listObjects(objType)
+	if timeTravel {
+		val, ok, err = a.listObjectsAsOf(objType, at)
+		if err != nil {
+			JSONError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
-	if val, ok := a.data[objType]; ok {
+	if ok {
 		var allDocs []map[string]interface{}
 		for k, v := range val {
 			var doc map[string]interface{}
@@ -176,20 +408,17 @@ func (a *api) handleGetAll(rw http.ResponseWriter, req *http.Request) {
 				return
 			}
 			doc["id"] = k
-			allDocs = append(allDocs, doc)
-		}
-		body, err := json.Marshal(allDocs)
-		if err != nil {
-			JSONError(rw, http.StatusInternalServerError, err.Error())
-			return
-		}
 
-		_, err = rw.Write(body)
-		if err != nil {
-			JSONError(rw, http.StatusInternalServerError, err.Error())
-			return
+			err = a.embed(objType, k, doc, includes(req))
+			if err != nil {
+				JSONError(rw, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			allDocs = append(allDocs, doc)
 		}
 
+		c.write(rw, http.StatusOK, allDocs)
 		return
 	}
 
@@ -200,102 +429,111 @@ func (a *api) handleGet(rw http.ResponseWriter, req *http.Request) {
 	objType := chi.URLParam(req, "objType")
 	objId := chi.URLParam(req, "objId")
 
-	objRaw, err := a.getObject(objType, objId)
+	c, err := responseCodec(req, false)
+	if err != nil {
+		JSONError(rw, http.StatusNotAcceptable, err.Error())
+		return
+	}
+
+	at, timeTravel, err := asOf(req)
+	if err != nil {
+		JSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var objRaw json.RawMessage
+	if timeTravel {
+		objRaw, err = a.getObjectAsOf(objType, objId, at)
+		if errors.Is(err, errHistoryDisabled) {
+			JSONError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		objRaw, err = a.getObject(objType, objId)
+	}
 	if err != nil {
 		JSONError(rw, http.StatusNotFound, err.Error())
 		return
 	}
 
-	obj, err := json.Marshal(objRaw)
+	var obj map[string]interface{}
+	err = json.Unmarshal(objRaw, &obj)
 	if err != nil {
 		JSONError(rw, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	_, err = rw.Write(obj)
+	err = a.embed(objType, objId, obj, includes(req))
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		JSONError(rw, http.StatusBadRequest, err.Error())
 		return
 	}
+
+	c.write(rw, http.StatusOK, obj)
 }
 
 func (a *api) handlePost(rw http.ResponseWriter, req *http.Request) {
 	objType := chi.URLParam(req, "objType")
 
-	var objRaw map[string]interface{}
-
-	err := json.NewDecoder(req.Body).Decode(&objRaw)
+	c, err := responseCodec(req, false)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		JSONError(rw, http.StatusNotAcceptable, err.Error())
 		return
 	}
 
-	objId := uuid.New().String()
-	objRaw["id"] = objId
-
-	output, err := json.Marshal(objRaw)
+	objRaw, err := decodeObject(req)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		bodyError(rw, err)
 		return
 	}
 
-	delete(objRaw, "id")
-
-	data, err := json.Marshal(objRaw)
+	objId, err := a.createRecord(req.Context(), objType, objRaw)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		JSONError(rw, recordErrorStatus(err), err.Error())
 		return
 	}
-	a.data[objType][objId] = data
 
-	rw.WriteHeader(http.StatusCreated)
-	_, err = rw.Write(output)
-	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
-		return
-	}
+	objRaw["id"] = objId
+	c.write(rw, http.StatusCreated, objRaw)
 }
 
 func (a *api) handleDelete(rw http.ResponseWriter, req *http.Request) {
 	objType := chi.URLParam(req, "objType")
 	objId := chi.URLParam(req, "objId")
 
-	rw.WriteHeader(http.StatusNoContent)
-
-	_, err := a.getObject(objType, objId)
+	err := a.deleteRecord(req.Context(), objType, objId)
 	if err != nil {
+		JSONError(rw, recordErrorStatus(err), err.Error())
 		return
 	}
 
-	delete(a.data[objType], objId)
+	rw.WriteHeader(http.StatusNoContent)
 }
 
 func (a *api) handlePut(rw http.ResponseWriter, req *http.Request) {
 	objType := chi.URLParam(req, "objType")
 	objId := chi.URLParam(req, "objId")
 
-	_, err := a.getObject(objType, objId)
-	if err != nil {
+	if _, err := a.getObject(objType, objId); err != nil && !a.ids[objType].Upsert {
 		JSONError(rw, http.StatusNotFound, err.Error())
 		return
 	}
 
-	var objRaw map[string]interface{}
-
-	err = json.NewDecoder(req.Body).Decode(&objRaw)
+	objRaw, err := decodeObject(req)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		bodyError(rw, err)
 		return
 	}
 
-	delete(objRaw, "id")
-
-	data, err := json.Marshal(objRaw)
+	created, err := a.replaceRecord(req.Context(), objType, objId, objRaw)
 	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+		JSONError(rw, recordErrorStatus(err), err.Error())
 		return
 	}
-	a.data[objType][objId] = data
+
+	if created {
+		rw.WriteHeader(http.StatusCreated)
+	}
 }
 
 func (a *api) handlePatch(rw http.ResponseWriter, req *http.Request) {
@@ -308,6 +546,11 @@ func (a *api) handlePatch(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !isJSONPatch(req.Header.Get("Content-Type")) {
+		JSONError(rw, http.StatusUnsupportedMediaType, fmt.Sprintf("%s, expecting %s", errUnsupportedMediaType, mediaTypeJSONPatch))
+		return
+	}
+
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		JSONError(rw, http.StatusInternalServerError, err.Error())
@@ -333,19 +576,63 @@ func (a *api) handlePatch(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	delete(objRaw, "id")
-
-	data, err := json.Marshal(objRaw)
-	if err != nil {
-		JSONError(rw, http.StatusInternalServerError, err.Error())
+	if _, err := a.replaceRecord(req.Context(), objType, objId, objRaw); err != nil {
+		JSONError(rw, recordErrorStatus(err), err.Error())
 		return
 	}
-	a.data[objType][objId] = data
 
 	rw.WriteHeader(http.StatusNoContent)
 }
 
+func (a *api) getOpenAPISpec() *openAPIDocument {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.openAPISpec
+}
+
+func (a *api) getSpecDocument() *specDocument {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.specDoc
+}
+
+func (a *api) listObjects(objType string) (map[string]json.RawMessage, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	objs, ok := a.data[objType]
+	if !ok {
+		return nil, false
+	}
+
+	list := make(map[string]json.RawMessage, len(objs))
+	for k, v := range objs {
+		list[k] = v
+	}
+
+	return list, true
+}
+
+// collectionNames returns the names of the collections holding records.
+func (a *api) collectionNames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := make([]string, 0, len(a.data))
+	for name := range a.data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
 func (a *api) getObject(objType, objId string) (json.RawMessage, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
 	if objs, ok := a.data[objType]; ok {
 		obj, ok := objs[objId]
 		if ok {
@@ -356,6 +643,71 @@ func (a *api) getObject(objType, objId string) (json.RawMessage, error) {
 	return nil, fmt.Errorf("%s/%s not found", objType, objId)
 }
 
+// insertObject stores obj unless objType/objId already exists, and reports
+// whether it did.
+func (a *api) insertObject(ctx context.Context, objType, objId string, obj json.RawMessage) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.data[objType][objId]; ok {
+		return false
+	}
+
+	if a.data == nil {
+		a.data = map[string]map[string]json.RawMessage{}
+	}
+	if _, ok := a.data[objType]; !ok {
+		a.data[objType] = map[string]json.RawMessage{}
+	}
+
+	a.data[objType][objId] = obj
+	a.events.publish(ctx, eventCreated, objType, objId, obj)
+
+	return true
+}
+
+func (a *api) setObject(ctx context.Context, objType, objId string, obj json.RawMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.storeObject(ctx, objType, objId, obj)
+}
+
+// storeObject is setObject, for callers holding the lock of the records.
+func (a *api) storeObject(ctx context.Context, objType, objId string, obj json.RawMessage) {
+	if a.data == nil {
+		a.data = map[string]map[string]json.RawMessage{}
+	}
+	if _, ok := a.data[objType]; !ok {
+		a.data[objType] = map[string]json.RawMessage{}
+	}
+
+	typ := eventUpdated
+	if _, ok := a.data[objType][objId]; !ok {
+		typ = eventCreated
+	}
+
+	a.data[objType][objId] = obj
+	a.events.publish(ctx, typ, objType, objId, obj)
+}
+
+func (a *api) deleteObject(ctx context.Context, objType, objId string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.removeObject(ctx, objType, objId)
+}
+
+// removeObject is deleteObject, for callers holding the lock of the records.
+func (a *api) removeObject(ctx context.Context, objType, objId string) {
+	if _, ok := a.data[objType][objId]; !ok {
+		return
+	}
+
+	delete(a.data[objType], objId)
+	a.events.publish(ctx, eventDeleted, objType, objId, nil)
+}
+
 func JSONError(rw http.ResponseWriter, code int, errMsg string) {
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Header().Set("X-Content-Type-Options", "nosniff")
@@ -15,6 +15,25 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// newTestServer serves the fixture data with an API configured with cfg, which
+// is left unconfigured when cfg is nil.
+func newTestServer(t *testing.T, cfg *config) (*api, *httptest.Server) {
+	t.Helper()
+
+	a := &api{}
+	require.NoError(t, a.loadData("fixtures/data.json"))
+	if cfg != nil {
+		require.NoError(t, a.configure(cfg))
+		a.generators.start(a)
+		t.Cleanup(a.generators.shutdown)
+	}
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	return a, srv
+}
+
 func Test_loadOpenAPISpec(t *testing.T) {
 	a := api{}
 	err := a.loadOpenAPISpec("fixtures/openapi.yaml")
@@ -151,12 +170,7 @@ func Test_handleGetOpenAPISpecWithoutSpec(t *testing.T) {
 }
 
 func Test_handleGetAll(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather", http.NoBody)
 	require.NoError(t, err)
@@ -194,12 +208,7 @@ func Test_handleGetAll(t *testing.T) {
 }
 
 func Test_handleGetAll_unknownType(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodGet, srv.URL+"/obj", http.NoBody)
 	require.NoError(t, err)
@@ -211,12 +220,7 @@ func Test_handleGetAll_unknownType(t *testing.T) {
 }
 
 func Test_handleGet(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/0", http.NoBody)
 	require.NoError(t, err)
@@ -241,12 +245,7 @@ func Test_handleGet(t *testing.T) {
 }
 
 func Test_handleGet_unknown(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/4", http.NoBody)
 	require.NoError(t, err)
@@ -258,12 +257,7 @@ func Test_handleGet_unknown(t *testing.T) {
 }
 
 func Test_handlePost(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather", bytes.NewBuffer([]byte(`{"data": "test"}`)))
 	require.NoError(t, err)
@@ -290,12 +284,7 @@ func Test_handlePost(t *testing.T) {
 }
 
 func Test_handlePost_invalidJSON(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather", bytes.NewBuffer([]byte(`{"data`)))
 	require.NoError(t, err)
@@ -307,12 +296,7 @@ func Test_handlePost_invalidJSON(t *testing.T) {
 }
 
 func Test_handleDelete(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/weather/0", http.NoBody)
 	require.NoError(t, err)
@@ -324,12 +308,7 @@ func Test_handleDelete(t *testing.T) {
 }
 
 func Test_handlePut(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	a, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPut, srv.URL+"/weather/0", bytes.NewBuffer([]byte(`{"data": "test"}`)))
 	require.NoError(t, err)
@@ -342,12 +321,7 @@ func Test_handlePut(t *testing.T) {
 }
 
 func Test_handlePut_invalidJSON(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPut, srv.URL+"/weather/0", bytes.NewBuffer([]byte(`{"data": "test"`)))
 	require.NoError(t, err)
@@ -359,12 +333,7 @@ func Test_handlePut_invalidJSON(t *testing.T) {
 }
 
 func Test_handlePatch(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	a, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPatch, srv.URL+"/weather/0", bytes.NewBuffer([]byte(`[{"op": "add", "path": "/country", "value": "France"},{"op": "replace", "path": "/city", "value": "Lyon"}]`)))
 	require.NoError(t, err)
@@ -377,12 +346,7 @@ func Test_handlePatch(t *testing.T) {
 }
 
 func Test_handlePatch_invalidPatch(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPatch, srv.URL+"/weather/0", bytes.NewBuffer([]byte(`[{"data": "test"}]`)))
 	require.NoError(t, err)
@@ -394,12 +358,7 @@ func Test_handlePatch_invalidPatch(t *testing.T) {
 }
 
 func Test_handlePatch_invalidJSON(t *testing.T) {
-	a := api{}
-
-	err := a.loadData("fixtures/data.json")
-	require.NoError(t, err)
-
-	srv := httptest.NewServer(a.getRouter())
+	_, srv := newTestServer(t, nil)
 
 	req, err := http.NewRequest(http.MethodPatch, srv.URL+"/weather/0", bytes.NewBuffer([]byte(`[{"data": "test"]`)))
 	require.NoError(t, err)
@@ -409,3 +368,30 @@ func Test_handlePatch_invalidJSON(t *testing.T) {
 
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+func Test_handlePatch_contentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    int
+	}{
+		{contentType: mediaTypeJSONPatch, expected: http.StatusNoContent},
+		{contentType: "application/json", expected: http.StatusNoContent},
+		{contentType: "application/x-www-form-urlencoded", expected: http.StatusNoContent},
+		{contentType: "text/csv", expected: http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.contentType, func(t *testing.T) {
+			_, srv := newTestServer(t, nil)
+
+			req, err := http.NewRequest(http.MethodPatch, srv.URL+"/weather/0", bytes.NewBuffer([]byte(`[{"op": "replace", "path": "/city", "value": "Lyon"}]`)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", test.contentType)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+		})
+	}
+}
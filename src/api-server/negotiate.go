@@ -0,0 +1,95 @@
+package main
+
+import (
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type acceptedType struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media types of an Accept header, most preferred
+// first. Media types with a zero quality are left out.
+func parseAccept(accept string) []acceptedType {
+	var accepted []acceptedType
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if rawQ, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(rawQ, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		accepted = append(accepted, acceptedType{mediaType: mediaType, q: q})
+	}
+
+	// More specific media types win over wildcards of the same quality.
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if accepted[i].q != accepted[j].q {
+			return accepted[i].q > accepted[j].q
+		}
+		return strings.Count(accepted[i].mediaType, "*") < strings.Count(accepted[j].mediaType, "*")
+	})
+
+	return accepted
+}
+
+// negotiate picks the offer best matching the Accept header. The first offer
+// is returned when the header is empty, and an empty string when nothing is
+// acceptable.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	for _, accepted := range parseAccept(accept) {
+		for _, offer := range offers {
+			if accepted.mediaType == offer {
+				return offer
+			}
+		}
+
+		for _, offer := range offers {
+			if matchMediaType(accepted.mediaType, offer) {
+				return offer
+			}
+		}
+	}
+
+	return ""
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType || suffixMediaType(pattern) == mediaType {
+		return true
+	}
+
+	typ, subtype, _ := strings.Cut(pattern, "/")
+	offerType, _, _ := strings.Cut(mediaType, "/")
+
+	return subtype == "*" && typ == offerType
+}
+
+// suffixMediaType returns the media type of the structured syntax suffix of
+// mediaType, "application/json" for "application/vnd.weather.v2+json".
+func suffixMediaType(mediaType string) string {
+	_, suffix, ok := strings.Cut(mediaType, "+")
+	if !ok {
+		return ""
+	}
+
+	return "application/" + suffix
+}
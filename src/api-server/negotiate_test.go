@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_negotiate(t *testing.T) {
+	offers := []string{"application/json", "application/yaml"}
+
+	tests := []struct {
+		desc     string
+		accept   string
+		expected string
+	}{
+		{desc: "empty", accept: "", expected: "application/json"},
+		{desc: "exact", accept: "application/yaml", expected: "application/yaml"},
+		{desc: "wildcard", accept: "*/*", expected: "application/json"},
+		{desc: "subtype wildcard", accept: "application/*", expected: "application/json"},
+		{desc: "quality", accept: "application/json;q=0.2, application/yaml;q=0.8", expected: "application/yaml"},
+		{desc: "specific over wildcard", accept: "*/*, application/yaml", expected: "application/yaml"},
+		{desc: "refused", accept: "application/yaml;q=0, text/html", expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, negotiate(test.accept, offers))
+		})
+	}
+}
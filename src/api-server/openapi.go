@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-openapi/swag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	mediaTypeJSON        = "application/json"
+	mediaTypeYAML        = "application/yaml"
+	mediaTypeOpenAPI     = "application/vnd.oai.openapi"
+	mediaTypeOpenAPIJSON = "application/vnd.oai.openapi+json"
+)
+
+// openAPIDocument is a loaded OpenAPI document. It is kept as a YAML node so
+// that it is served with the key order of the original file.
+type openAPIDocument struct {
+	node *yaml.Node
+	raw  json.RawMessage
+}
+
+// loadOpenAPIDocument loads an OpenAPI 3.0, 3.1 or Swagger 2.0 document, in
+// YAML or JSON, from a file or a URL. References to other files are inlined.
+func loadOpenAPIDocument(path string) (*openAPIDocument, error) {
+	loader := &refLoader{files: map[string]*yaml.Node{}, hoisted: map[string]*hoistedRef{}}
+
+	root, err := loader.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("openapispec is not an object")
+	}
+
+	version := mappingValue(root, "openapi")
+	if version == nil {
+		version = mappingValue(root, "swagger")
+	}
+	if version == nil || version.Kind != yaml.ScalarNode {
+		return nil, errors.New("openapispec has no openapi nor swagger version")
+	}
+	if !strings.HasPrefix(version.Value, "3.0") && !strings.HasPrefix(version.Value, "3.1") && version.Value != "2.0" {
+		return nil, fmt.Errorf("unsupported openapispec version %q", version.Value)
+	}
+
+	loader.swagger = mappingValue(root, "swagger") != nil
+	loader.names = componentNames(root, loader.swagger)
+
+	root, err = loader.inline(root, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = loader.bundle(root); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = writeJSON(&buf, root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openAPIDocument{node: root, raw: buf.Bytes()}, nil
+}
+
+// Raw returns the document as JSON.
+func (d *openAPIDocument) Raw() json.RawMessage {
+	return d.raw
+}
+
+// withServer returns a copy of the document pointing its servers to baseURL.
+// The scheme and host of the servers are replaced, and their declared path is
+// kept under the path of baseURL.
+func (d *openAPIDocument) withServer(baseURL *url.URL) *yaml.Node {
+	root := *d.node
+	root.Content = append([]*yaml.Node(nil), d.node.Content...)
+
+	if mappingValue(&root, "swagger") != nil {
+		setMappingValue(&root, "host", stringNode(baseURL.Host))
+		basePath := baseURL.Path
+		if declared := mappingValue(&root, "basePath"); declared != nil && declared.Kind == yaml.ScalarNode {
+			basePath += strings.TrimSuffix(declared.Value, "/")
+		}
+		if basePath == "" {
+			basePath = "/"
+		}
+		setMappingValue(&root, "basePath", stringNode(basePath))
+		setMappingValue(&root, "schemes", &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{stringNode(baseURL.Scheme)}})
+
+		return &root
+	}
+
+	var (
+		servers []*yaml.Node
+		seen    = map[string]bool{}
+	)
+	if declared := mappingValue(&root, "servers"); declared != nil && declared.Kind == yaml.SequenceNode {
+		for _, declaredServer := range declared.Content {
+			serverURL := mappingValue(declaredServer, "url")
+			if serverURL == nil || serverURL.Kind != yaml.ScalarNode {
+				continue
+			}
+			u, err := url.Parse(serverURL.Value)
+			if err != nil {
+				// Templated URLs, such as {scheme}://{host}, are served as
+				// declared.
+				servers = append(servers, declaredServer)
+				continue
+			}
+
+			value := serverURLWithBase(baseURL, u.Path)
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+
+			server := *declaredServer
+			server.Content = append([]*yaml.Node(nil), declaredServer.Content...)
+			setMappingValue(&server, "url", stringNode(value))
+			servers = append(servers, &server)
+		}
+	}
+	if len(servers) == 0 {
+		server := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(server, "url", stringNode(baseURL.String()))
+		servers = append(servers, server)
+	}
+	setMappingValue(&root, "servers", &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: servers})
+
+	return &root
+}
+
+// serverURLWithBase returns the URL of a server whose declared path is
+// served under baseURL.
+func serverURLWithBase(baseURL *url.URL, declaredPath string) string {
+	u := *baseURL
+	u.Path += strings.TrimSuffix(declaredPath, "/")
+
+	return u.String()
+}
+
+func (a *api) handleOpenAPISpec(rw http.ResponseWriter, req *http.Request) {
+	openAPISpec := a.getOpenAPISpec()
+	if openAPISpec == nil {
+		JSONError(rw, http.StatusNotImplemented, "No OpenAPISpec available")
+		return
+	}
+
+	var offers []string
+	switch filepath.Ext(req.URL.Path) {
+	case ".json":
+		offers = []string{mediaTypeJSON, mediaTypeOpenAPIJSON}
+	case ".yaml", ".yml":
+		offers = []string{mediaTypeYAML, mediaTypeOpenAPI, "application/x-yaml", "text/yaml"}
+	default:
+		offers = []string{mediaTypeJSON, mediaTypeYAML, mediaTypeOpenAPIJSON, mediaTypeOpenAPI, "application/x-yaml", "text/yaml"}
+	}
+
+	contentType := negotiate(req.Header.Get("Accept"), offers)
+	if contentType == "" {
+		if filepath.Ext(req.URL.Path) == "" {
+			JSONError(rw, http.StatusNotAcceptable, fmt.Sprintf("supported media types: %s", strings.Join(offers, ", ")))
+			return
+		}
+
+		// The extension of the path is explicit enough to ignore the header.
+		contentType = offers[0]
+	}
+
+	doc := openAPISpec.withServer(forwardedBaseURL(req))
+
+	var (
+		out []byte
+		err error
+	)
+	switch contentType {
+	case mediaTypeJSON, mediaTypeOpenAPIJSON:
+		var buf bytes.Buffer
+		err = writeJSON(&buf, doc)
+		if err == nil {
+			var indented bytes.Buffer
+			err = json.Indent(&indented, buf.Bytes(), "", "  ")
+			out = append(indented.Bytes(), '\n')
+		}
+	default:
+		out, err = yaml.Marshal(plainStyle(doc))
+	}
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Add("Vary", "Accept")
+	_, _ = rw.Write(out)
+}
+
+// forwardedBaseURL returns the URL the client used to reach the server,
+// honouring the X-Forwarded-* headers set by proxies.
+func forwardedBaseURL(req *http.Request) *url.URL {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := firstHeaderValue(req, "X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	host := req.Host
+	if fwdHost := firstHeaderValue(req, "X-Forwarded-Host"); fwdHost != "" {
+		host = fwdHost
+	}
+	if port := firstHeaderValue(req, "X-Forwarded-Port"); port != "" && !strings.Contains(host, ":") {
+		if (scheme == "http" && port != "80") || (scheme == "https" && port != "443") {
+			host += ":" + port
+		}
+	}
+
+	return &url.URL{
+		Scheme: scheme,
+		Host:   host,
+		Path:   strings.TrimSuffix(req.Header.Get("X-Forwarded-Prefix"), "/"),
+	}
+}
+
+func firstHeaderValue(req *http.Request, name string) string {
+	value, _, _ := strings.Cut(req.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// refLoader inlines references to other files.
+type refLoader struct {
+	files map[string]*yaml.Node
+	// swagger tells whether the main document is a Swagger 2.0 one, which
+	// holds its schemas in definitions rather than components.
+	swagger bool
+	// hoisted maps the recursive external references to the components of
+	// the main document they are moved to, as they cannot be inlined.
+	hoisted map[string]*hoistedRef
+	// names holds the component names in use, per section.
+	names map[string]map[string]bool
+}
+
+// hoistedRef is a recursive external reference, moved to a component of the
+// main document.
+type hoistedRef struct {
+	ref     string
+	section string
+	name    string
+	node    *yaml.Node
+}
+
+func (l *refLoader) load(path string) (*yaml.Node, error) {
+	if node, ok := l.files[path]; ok {
+		return node, nil
+	}
+
+	content, err := swag.LoadFromFileOrHTTP(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty document", path)
+	}
+
+	l.files[path] = doc.Content[0]
+	return doc.Content[0], nil
+}
+
+// inline returns a copy of node where references to other files are replaced
+// by their target. References local to those files are inlined as well,
+// because they would not resolve once moved to the main document. stack holds
+// the references being resolved, to detect cycles.
+func (l *refLoader) inline(node *yaml.Node, base string, stack []string) (*yaml.Node, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return l.inline(node.Alias, base, stack)
+
+	case yaml.MappingNode:
+		if ref := mappingValue(node, "$ref"); ref != nil && ref.Kind == yaml.ScalarNode {
+			resolved, err := l.resolve(node, ref.Value, base, stack)
+			if err != nil || resolved != nil {
+				return resolved, err
+			}
+		}
+
+		fallthrough
+
+	case yaml.SequenceNode, yaml.DocumentNode:
+		out := *node
+		out.Content = make([]*yaml.Node, len(node.Content))
+		for i, child := range node.Content {
+			inlined, err := l.inline(child, base, stack)
+			if err != nil {
+				return nil, err
+			}
+			out.Content[i] = inlined
+		}
+		return &out, nil
+	}
+
+	return node, nil
+}
+
+// resolve returns the target of an external reference, or nil for references
+// to be kept as they are.
+func (l *refLoader) resolve(node *yaml.Node, ref, base string, stack []string) (*yaml.Node, error) {
+	file, pointer, _ := strings.Cut(ref, "#")
+
+	external := len(stack) > 0
+	if file == "" && !external {
+		// Local references of the main document are valid as they are.
+		return nil, nil
+	}
+	if strings.Contains(file, "://") {
+		return nil, nil
+	}
+
+	target := base
+	if file != "" {
+		target = resolveFile(base, file)
+	}
+
+	key := target + "#" + pointer
+	for _, seen := range stack {
+		if seen == key {
+			// Recursive targets cannot be inlined, they are moved to the main
+			// document and referenced locally.
+			return l.hoist(key, ref, pointer, target), nil
+		}
+	}
+
+	root, err := l.load(target)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", ref, err)
+	}
+
+	resolved, err := resolvePointer(root, pointer)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", ref, err)
+	}
+
+	resolved, err = l.inline(resolved, target, append(stack, key))
+	if err != nil {
+		return nil, err
+	}
+	if hoisted, ok := l.hoisted[key]; ok && hoisted.node == nil {
+		hoisted.node = resolved
+	}
+
+	// OpenAPI 3.1 allows summary and description next to a reference, they
+	// override the ones of the target.
+	if len(node.Content) > 2 && resolved.Kind == yaml.MappingNode {
+		merged := *resolved
+		merged.Content = append([]*yaml.Node(nil), resolved.Content...)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != "$ref" {
+				setMappingValue(&merged, node.Content[i].Value, node.Content[i+1])
+			}
+		}
+		resolved = &merged
+	}
+
+	return resolved, nil
+}
+
+// hoist returns a local reference to the component the target of the
+// recursive reference key is moved to.
+func (l *refLoader) hoist(key, ref, pointer, target string) *yaml.Node {
+	hoisted, ok := l.hoisted[key]
+	if !ok {
+		section := "schemas"
+		tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+		if len(tokens) == 3 && tokens[0] == "components" {
+			section = tokens[1]
+		}
+		if l.swagger {
+			section = "definitions"
+		}
+
+		name := tokens[len(tokens)-1]
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(target), filepath.Ext(target))
+		}
+		if l.names[section] == nil {
+			l.names[section] = map[string]bool{}
+		}
+		unique := name
+		for i := 2; l.names[section][unique]; i++ {
+			unique = fmt.Sprintf("%s%d", name, i)
+		}
+		l.names[section][unique] = true
+
+		hoisted = &hoistedRef{ref: ref, section: section, name: unique}
+		l.hoisted[key] = hoisted
+	}
+
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		stringNode("$ref"), stringNode(hoisted.localRef(l.swagger)),
+	}}
+}
+
+func (h *hoistedRef) localRef(swagger bool) string {
+	if swagger {
+		return "#/definitions/" + h.name
+	}
+
+	return "#/components/" + h.section + "/" + h.name
+}
+
+// bundle adds the hoisted targets to the components of root.
+func (l *refLoader) bundle(root *yaml.Node) error {
+	for _, key := range sortedKeys(l.hoisted) {
+		hoisted := l.hoisted[key]
+
+		// A reference only resolving to itself has no target at all.
+		if ref := mappingValue(hoisted.node, "$ref"); ref != nil && len(hoisted.node.Content) == 2 && ref.Value == hoisted.localRef(l.swagger) {
+			return fmt.Errorf("circular reference %q", hoisted.ref)
+		}
+
+		var section *yaml.Node
+		if l.swagger {
+			section = childMapping(root, "definitions")
+		} else {
+			section = childMapping(childMapping(root, "components"), hoisted.section)
+		}
+		setMappingValue(section, hoisted.name, hoisted.node)
+	}
+
+	return nil
+}
+
+// childMapping returns the mapping under key, adding it when missing.
+func childMapping(node *yaml.Node, key string) *yaml.Node {
+	child := mappingValue(node, key)
+	if child == nil || child.Kind != yaml.MappingNode {
+		child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(node, key, child)
+	}
+
+	return child
+}
+
+// componentNames returns the names of the components of root, per section.
+func componentNames(root *yaml.Node, swagger bool) map[string]map[string]bool {
+	names := map[string]map[string]bool{}
+	add := func(section string, node *yaml.Node) {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return
+		}
+		names[section] = map[string]bool{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			names[section][node.Content[i].Value] = true
+		}
+	}
+
+	if swagger {
+		add("definitions", mappingValue(root, "definitions"))
+		return names
+	}
+
+	if components := mappingValue(root, "components"); components != nil && components.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(components.Content); i += 2 {
+			add(components.Content[i].Value, components.Content[i+1])
+		}
+	}
+
+	return names
+}
+
+// resolveFile resolves the path of a referenced file relative to the file or
+// URL referencing it.
+func resolveFile(base, file string) string {
+	if strings.Contains(base, "://") {
+		baseURL, err := url.Parse(base)
+		if err == nil {
+			if fileURL, err := url.Parse(file); err == nil {
+				return baseURL.ResolveReference(fileURL).String()
+			}
+		}
+	}
+
+	return filepath.Join(filepath.Dir(base), filepath.FromSlash(file))
+}
+
+func resolvePointer(node *yaml.Node, pointer string) (*yaml.Node, error) {
+	if pointer == "" || pointer == "/" {
+		return node, nil
+	}
+
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		if unescaped, err := url.PathUnescape(token); err == nil {
+			token = unescaped
+		}
+
+		switch node.Kind {
+		case yaml.MappingNode:
+			node = mappingValue(node, token)
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				return nil, fmt.Errorf("invalid index %q", token)
+			}
+			node = node.Content[i]
+		default:
+			node = nil
+		}
+
+		if node == nil {
+			return nil, fmt.Errorf("%q not found", pointer)
+		}
+	}
+
+	return node, nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+
+	node.Content = append(node.Content, stringNode(key), value)
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// plainStyle returns a copy of node without the quoting style of the original
+// file, letting the encoder quote only what needs to be.
+func plainStyle(node *yaml.Node) *yaml.Node {
+	out := *node
+	out.Style = 0
+	if node.Kind == yaml.AliasNode {
+		return plainStyle(node.Alias)
+	}
+
+	out.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		out.Content[i] = plainStyle(child)
+	}
+
+	return &out
+}
+
+// writeJSON encodes a YAML node as JSON, keeping the order of mapping keys.
+func writeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeJSON(buf, node.Content[0])
+
+	case yaml.AliasNode:
+		return writeJSON(buf, node.Alias)
+
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, node.Content[i].Value)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, node.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, child := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, child); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!null":
+			buf.WriteString("null")
+		case "!!bool", "!!int", "!!float":
+			var v interface{}
+			if err := node.Decode(&v); err != nil {
+				return err
+			}
+			if f, ok := v.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+				return fmt.Errorf("line %d: %s cannot be represented in JSON", node.Line, node.Value)
+			}
+			out, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			buf.Write(out)
+		default:
+			writeJSONString(buf, node.Value)
+		}
+	}
+
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	// Encode appends a newline.
+	buf.Truncate(buf.Len() - 1)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handleOpenAPISpec_json(t *testing.T) {
+	a := api{}
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi.yaml"))
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/openapi.json")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &doc))
+	assert.Equal(t, "3.0.0", doc["openapi"])
+
+	// Keys are served in the order of the original document.
+	openapi := strings.Index(string(body), `"openapi"`)
+	info := strings.Index(string(body), `"info"`)
+	paths := strings.Index(string(body), `"paths"`)
+	components := strings.Index(string(body), `"components"`)
+	assert.True(t, openapi < info && info < paths && paths < components)
+}
+
+func Test_handleOpenAPISpec_negotiation(t *testing.T) {
+	a := api{}
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi.yaml"))
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		desc        string
+		path        string
+		accept      string
+		expected    int
+		contentType string
+	}{
+		{desc: "default", path: "/openapi", expected: http.StatusOK, contentType: "application/json"},
+		{desc: "yaml", path: "/openapi", accept: "application/yaml", expected: http.StatusOK, contentType: "application/yaml"},
+		{
+			desc:        "openapi json",
+			path:        "/openapi",
+			accept:      "application/vnd.oai.openapi+json",
+			expected:    http.StatusOK,
+			contentType: "application/vnd.oai.openapi+json",
+		},
+		{
+			desc:        "quality",
+			path:        "/openapi",
+			accept:      "application/json;q=0.5, text/yaml",
+			expected:    http.StatusOK,
+			contentType: "text/yaml",
+		},
+		{desc: "not acceptable", path: "/openapi", accept: "text/html", expected: http.StatusNotAcceptable},
+		{desc: "explicit extension", path: "/openapi.yml", accept: "text/html", expected: http.StatusOK, contentType: "application/yaml"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+test.path, http.NoBody)
+			require.NoError(t, err)
+			req.Header.Set("Accept", test.accept)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+			if test.contentType != "" {
+				assert.Equal(t, test.contentType, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func Test_handleOpenAPISpec_forwardedServer(t *testing.T) {
+	a := api{}
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi.yaml"))
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/openapi.json", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "api.docker.localhost")
+	req.Header.Set("X-Forwarded-Prefix", "/weather")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var doc struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+
+	require.Len(t, doc.Servers, 1)
+	assert.Equal(t, "https://api.docker.localhost/weather", doc.Servers[0].URL)
+}
+
+func Test_openAPIDocument_withServer(t *testing.T) {
+	baseURL := &url.URL{Scheme: "https", Host: "api.docker.localhost", Path: "/weather"}
+
+	tests := []struct {
+		desc     string
+		content  string
+		expected string
+	}{
+		{
+			desc:     "no server",
+			content:  "openapi: 3.0.0\n",
+			expected: `"servers":[{"url":"https://api.docker.localhost/weather"}]`,
+		},
+		{
+			desc:     "declared path",
+			content:  "openapi: 3.0.0\nservers:\n  - url: http://localhost:8080/v1/\n    description: local\n  - url: https://staging.example.com/v1\n",
+			expected: `"servers":[{"url":"https://api.docker.localhost/weather/v1","description":"local"}]`,
+		},
+		{
+			desc:     "relative server",
+			content:  "openapi: 3.0.0\nservers:\n  - url: /v1\n",
+			expected: `"servers":[{"url":"https://api.docker.localhost/weather/v1"}]`,
+		},
+		{
+			desc:     "swagger base path",
+			content:  "swagger: '2.0'\nbasePath: /v1\n",
+			expected: `"basePath":"/weather/v1","host":"api.docker.localhost","schemes":["https"]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			specPath := filepath.Join(t.TempDir(), "openapi.yaml")
+			require.NoError(t, os.WriteFile(specPath, []byte(test.content), 0o600))
+
+			doc, err := loadOpenAPIDocument(specPath)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, writeJSON(&buf, doc.withServer(baseURL)))
+			assert.Contains(t, buf.String(), test.expected)
+		})
+	}
+}
+
+func Test_loadOpenAPIDocument_openAPI31(t *testing.T) {
+	specPath := filepath.Join(t.TempDir(), "openapi.json")
+	require.NoError(t, os.WriteFile(specPath, []byte(`{
+  "openapi": "3.1.0",
+  "info": {"title": "Weather", "version": "1.0.0", "license": {"name": "Apache 2.0", "identifier": "Apache-2.0"}},
+  "paths": {
+    "/weather/{id}": {
+      "get": {
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": ["integer", "null"], "exclusiveMinimum": 0}}],
+        "responses": {"200": {"description": "A weather"}}
+      }
+    }
+  },
+  "webhooks": {"newWeather": {"post": {"responses": {"200": {"description": "ok"}}}}}
+}`), 0o600))
+
+	doc, err := loadOpenAPIDocument(specPath)
+	require.NoError(t, err)
+
+	specDoc, err := parseSpecDocument(doc.Raw())
+	require.NoError(t, err)
+	assert.NotNil(t, specDoc.findOperation(http.MethodGet, "/weather/1"))
+}
+
+func Test_loadOpenAPIDocument_relativeRefs(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "schemas"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "openapi.yaml"), []byte(`openapi: 3.0.0
+info:
+  title: Weather
+  version: 1.0.0
+paths:
+  /weather:
+    get:
+      responses:
+        '200':
+          $ref: '#/components/responses/weather'
+components:
+  responses:
+    weather:
+      description: A weather
+      content:
+        application/json:
+          schema:
+            $ref: './schemas/weather.yaml#/weather'
+`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "schemas", "weather.yaml"), []byte(`weather:
+  type: object
+  properties:
+    city:
+      $ref: '#/city'
+city:
+  type: string
+`), 0o600))
+
+	doc, err := loadOpenAPIDocument(filepath.Join(dir, "openapi.yaml"))
+	require.NoError(t, err)
+
+	var raw struct {
+		Paths      map[string]interface{} `json:"paths"`
+		Components struct {
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema map[string]interface{} `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(doc.Raw(), &raw))
+
+	assert.Equal(t, map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"city": map[string]interface{}{"type": "string"},
+		},
+	}, raw.Components.Responses["weather"].Content["application/json"].Schema)
+
+	// Local references of the main document are kept.
+	assert.Contains(t, string(doc.Raw()), `"$ref":"#/components/responses/weather"`)
+}
+
+func Test_loadOpenAPIDocument_recursiveRefs(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "openapi.yaml"), []byte(`openapi: 3.0.0
+info:
+  title: Regions
+  version: 1.0.0
+paths:
+  /regions:
+    get:
+      responses:
+        '200':
+          description: The regions
+          content:
+            application/json:
+              schema:
+                $ref: './regions.yaml#/region'
+components:
+  schemas:
+    region:
+      type: string
+`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "regions.yaml"), []byte(`region:
+  type: object
+  properties:
+    name:
+      type: string
+    children:
+      type: array
+      items:
+        $ref: '#/region'
+`), 0o600))
+
+	doc, err := loadOpenAPIDocument(filepath.Join(dir, "openapi.yaml"))
+	require.NoError(t, err)
+
+	var raw struct {
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(doc.Raw(), &raw))
+
+	// The recursive schema is moved to the components, under a name which is
+	// not taken yet.
+	assert.Equal(t, map[string]interface{}{"type": "string"}, raw.Components.Schemas["region"])
+	assert.Equal(t, map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+			"children": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"$ref": "#/components/schemas/region2"},
+			},
+		},
+	}, raw.Components.Schemas["region2"])
+}
+
+func Test_loadOpenAPIDocument_invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		desc     string
+		content  string
+		expected string
+	}{
+		{desc: "not an object", content: `test`, expected: "openapispec is not an object"},
+		{desc: "no version", content: `info: {}`, expected: "openapispec has no openapi nor swagger version"},
+		{desc: "unsupported version", content: `openapi: 4.0.0`, expected: `unsupported openapispec version "4.0.0"`},
+		{
+			desc:     "circular reference",
+			content:  "openapi: 3.0.0\npaths:\n  $ref: 'other.yaml#/a'\n",
+			expected: `circular reference "#/a"`,
+		},
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("a:\n  $ref: '#/a'\n"), 0o600))
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			specPath := filepath.Join(dir, "openapi.yaml")
+			require.NoError(t, os.WriteFile(specPath, []byte(test.content), 0o600))
+
+			_, err := loadOpenAPIDocument(specPath)
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
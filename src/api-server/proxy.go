@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	proxyModeRecord = "record"
+	proxyModeReplay = "replay"
+
+	proxyFallbackNotFound = "notFound"
+	proxyFallbackUpstream = "upstream"
+	proxyFallbackRecord   = "record"
+
+	matchHeaderPrefix = "header:"
+)
+
+// defaultProxyMatch is what a request and a recorded one must have in common
+// to be replayed.
+var defaultProxyMatch = []string{"method", "path", "query", "body"}
+
+type proxyConfig struct {
+	// Upstream is the URL of the proxied API.
+	Upstream string `yaml:"upstream"`
+	// Mode is either record, to forward the requests upstream and record the
+	// exchanges, or replay, to answer with the recorded ones.
+	Mode string `yaml:"mode"`
+	// Cassette is the file holding the recorded exchanges, as JSON Lines.
+	// Recordings exported with ?format=jsonl can be replayed.
+	Cassette string `yaml:"cassette"`
+	// Match lists what must be equal for a recorded exchange to be replayed:
+	// method, path, query, body or header:<name>. All but headers by
+	// default.
+	Match []string `yaml:"match"`
+	// Fallback tells how to answer requests matching no recorded exchange in
+	// replay mode: with a 404 (notFound, the default), by forwarding them
+	// upstream (upstream), or by forwarding and recording them (record).
+	Fallback string       `yaml:"fallback"`
+	Redact   redactConfig `yaml:"redact"`
+}
+
+func (c proxyConfig) validate() error {
+	if c.Cassette == "" {
+		return errors.New("proxy: missing cassette")
+	}
+
+	switch c.Mode {
+	case proxyModeRecord, proxyModeReplay:
+	default:
+		return fmt.Errorf("proxy: unknown mode %q, expecting %q or %q", c.Mode, proxyModeRecord, proxyModeReplay)
+	}
+
+	switch c.Fallback {
+	case "", proxyFallbackNotFound:
+	case proxyFallbackUpstream, proxyFallbackRecord:
+		if c.Mode == proxyModeRecord {
+			return fmt.Errorf("proxy: fallback %q is only used in %q mode", c.Fallback, proxyModeReplay)
+		}
+	default:
+		return fmt.Errorf("proxy: unknown fallback %q", c.Fallback)
+	}
+
+	for _, m := range c.Match {
+		switch {
+		case m == "method", m == "path", m == "query", m == "body":
+		case strings.HasPrefix(m, matchHeaderPrefix) && len(m) > len(matchHeaderPrefix):
+		default:
+			return fmt.Errorf("proxy: unknown matcher %q", m)
+		}
+	}
+
+	if c.forwards() {
+		u, err := url.Parse(c.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("proxy: invalid upstream %q", c.Upstream)
+		}
+	}
+
+	return nil
+}
+
+// forwards tells whether requests may be forwarded upstream.
+func (c proxyConfig) forwards() bool {
+	return c.Mode == proxyModeRecord || c.Fallback == proxyFallbackUpstream || c.Fallback == proxyFallbackRecord
+}
+
+// proxy forwards requests to an upstream API while recording the exchanges
+// in a cassette, or replays the exchanges of the cassette.
+type proxy struct {
+	cfg      proxyConfig
+	upstream http.Handler
+
+	mu        sync.Mutex
+	exchanges []exchange
+	// replayed counts the replays of each exchange.
+	replayed []int
+	file     *os.File
+}
+
+func newProxy(cfg proxyConfig) (*proxy, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Match) == 0 {
+		cfg.Match = defaultProxyMatch
+	}
+
+	p := &proxy{cfg: cfg}
+
+	if cfg.forwards() {
+		target, _ := url.Parse(cfg.Upstream)
+		p.upstream = &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.SetXForwarded()
+			},
+		}
+	}
+
+	exchanges, err := readCassette(cfg.Cassette)
+	if err != nil && (cfg.Mode == proxyModeReplay || !errors.Is(err, os.ErrNotExist)) {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	p.exchanges = exchanges
+	p.replayed = make([]int, len(exchanges))
+
+	if cfg.Mode == proxyModeRecord || cfg.Fallback == proxyFallbackRecord {
+		p.file, err = os.OpenFile(cfg.Cassette, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+func readCassette(path string) ([]exchange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var exchanges []exchange
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, math.MaxInt32)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var e exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("cassette %q, line %d: %w", path, line, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+
+	return exchanges, scanner.Err()
+}
+
+func (p *proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.cfg.Mode == proxyModeRecord {
+		p.record(rw, req)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		JSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if e, ok := p.match(req, body); ok {
+		replayExchange(rw, e)
+		return
+	}
+
+	switch p.cfg.Fallback {
+	case proxyFallbackUpstream:
+		p.upstream.ServeHTTP(rw, req)
+	case proxyFallbackRecord:
+		p.record(rw, req)
+	default:
+		JSONError(rw, http.StatusNotFound, fmt.Sprintf("no recorded exchange matches %s %s", req.Method, req.URL.RequestURI()))
+	}
+}
+
+// record forwards req upstream, and adds the exchange to the cassette.
+func (p *proxy) record(rw http.ResponseWriter, req *http.Request) {
+	// Bodies are kept whole, so that they can be replayed.
+	e := captureExchange(p.upstream, rw, req, math.MaxInt)
+	p.cfg.Redact.apply(&e)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.exchanges = append(p.exchanges, e)
+	p.replayed = append(p.replayed, 0)
+
+	if err := json.NewEncoder(p.file).Encode(e); err != nil {
+		log.Printf("Unable to write cassette: %v", err)
+	}
+}
+
+// match returns the exchange to replay for req. Identical requests are
+// answered with the exchanges recorded for them in turn, then with the last
+// one.
+func (p *proxy) match(req *http.Request, body []byte) (exchange, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last := -1
+	for i := range p.exchanges {
+		if !p.matches(&p.exchanges[i], req, body) {
+			continue
+		}
+		if p.replayed[i] == 0 {
+			last = i
+			break
+		}
+		last = i
+	}
+	if last < 0 {
+		return exchange{}, false
+	}
+
+	p.replayed[last]++
+
+	return p.exchanges[last], true
+}
+
+func (p *proxy) matches(e *exchange, req *http.Request, body []byte) bool {
+	recordedURL, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return false
+	}
+
+	for _, m := range p.cfg.Match {
+		switch m {
+		case "method":
+			if e.Request.Method != req.Method {
+				return false
+			}
+		case "path":
+			if recordedURL.Path != req.URL.Path {
+				return false
+			}
+		case "query":
+			if !equalValues(recordedURL.Query(), req.URL.Query()) {
+				return false
+			}
+		case "body":
+			recordedBody, err := e.Request.body()
+			if err != nil || !equalBodies(recordedBody, body) {
+				return false
+			}
+		default:
+			name := strings.TrimPrefix(m, matchHeaderPrefix)
+			if !equalValues(url.Values{name: e.Request.Header.Values(name)}, url.Values{name: req.Header.Values(name)}) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func equalValues(a, b url.Values) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, va := range a {
+		vb := b[k]
+		if len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if va[i] != vb[i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// equalBodies compares JSON bodies by value, and other bodies byte per byte.
+func equalBodies(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+
+	return bytes.Equal(ja, jb)
+}
+
+func replayExchange(rw http.ResponseWriter, e exchange) {
+	body, err := e.Response.body()
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for k, v := range e.Response.Header {
+		rw.Header()[k] = v
+	}
+	// Bodies may have been truncated when recorded.
+	rw.Header().Del("Content-Length")
+
+	status := e.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newProxyServer(t *testing.T, cfg proxyConfig) *httptest.Server {
+	t.Helper()
+
+	p, err := newProxy(cfg)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func newUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	_, upstream := newTestServer(t, nil)
+
+	return upstream
+}
+
+func Test_proxyConfig_validate(t *testing.T) {
+	assert.NoError(t, proxyConfig{Mode: "record", Cassette: "c.jsonl", Upstream: "http://localhost"}.validate())
+	assert.NoError(t, proxyConfig{Mode: "replay", Cassette: "c.jsonl", Match: []string{"method", "header:Accept"}}.validate())
+	assert.Error(t, proxyConfig{Mode: "record", Cassette: "c.jsonl"}.validate())
+	assert.Error(t, proxyConfig{Mode: "mock", Cassette: "c.jsonl"}.validate())
+	assert.Error(t, proxyConfig{Mode: "replay"}.validate())
+	assert.Error(t, proxyConfig{Mode: "replay", Cassette: "c.jsonl", Fallback: "upstream"}.validate())
+	assert.Error(t, proxyConfig{Mode: "replay", Cassette: "c.jsonl", Match: []string{"header:"}}.validate())
+}
+
+func Test_proxy_recordAndReplay(t *testing.T) {
+	upstream := newUpstream(t)
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	srv := newProxyServer(t, proxyConfig{Mode: proxyModeRecord, Upstream: upstream.URL, Cassette: cassette})
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Lyon","weather":"Foggy"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	created, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/42", "", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	upstream.Close()
+
+	srv = newProxyServer(t, proxyConfig{Mode: proxyModeReplay, Cassette: cassette})
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city":"City of Gophers","weather":"Sunny"}`, string(body))
+
+	// JSON bodies are matched by value.
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{ "weather": "Foggy", "city": "Lyon" }`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(created), string(body))
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Paris"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/42", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1?units=metric", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_proxy_replaySequence(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	writeCassette(t, cassette,
+		exchange{Request: recordedMessage{Method: http.MethodGet, URL: "http://api/jobs/1"}, Response: recordedMessage{Status: http.StatusAccepted, Body: "pending"}},
+		exchange{Request: recordedMessage{Method: http.MethodGet, URL: "http://api/jobs/1"}, Response: recordedMessage{Status: http.StatusOK, Body: "done"}},
+	)
+
+	srv := newProxyServer(t, proxyConfig{Mode: proxyModeReplay, Cassette: cassette, Match: []string{"method", "path"}})
+
+	for _, want := range []int{http.StatusAccepted, http.StatusOK, http.StatusOK} {
+		resp := doRequest(t, http.MethodGet, srv.URL+"/jobs/1?ignored=true", "", "")
+		assert.Equal(t, want, resp.StatusCode)
+	}
+}
+
+func Test_proxy_matchHeader(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	writeCassette(t, cassette,
+		exchange{Request: recordedMessage{Method: http.MethodGet, URL: "http://api/", Header: http.Header{"Accept-Language": {"fr"}}}, Response: recordedMessage{Status: http.StatusOK, Body: "bonjour"}},
+		exchange{Request: recordedMessage{Method: http.MethodGet, URL: "http://api/", Header: http.Header{"Accept-Language": {"en"}}}, Response: recordedMessage{Status: http.StatusOK, Body: "hello"}},
+	)
+
+	srv := newProxyServer(t, proxyConfig{Mode: proxyModeReplay, Cassette: cassette, Match: []string{"path", "header:Accept-Language"}})
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Language", "en")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func Test_proxy_fallback(t *testing.T) {
+	upstream := newUpstream(t)
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	writeCassette(t, cassette,
+		exchange{Request: recordedMessage{Method: http.MethodGet, URL: "http://api/weather/1"}, Response: recordedMessage{Status: http.StatusOK, Body: `{"city":"Recorded"}`}},
+	)
+
+	srv := newProxyServer(t, proxyConfig{Mode: proxyModeReplay, Cassette: cassette, Upstream: upstream.URL, Fallback: proxyFallbackRecord})
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city":"Recorded"}`, string(body))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/2", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	exchanges, err := readCassette(cassette)
+	require.NoError(t, err)
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, srv.URL+"/weather/2", exchanges[1].Request.URL)
+
+	upstream.Close()
+
+	// The new exchange is replayed.
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/2", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func writeCassette(t *testing.T, path string, exchanges ...exchange) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	for _, e := range exchanges {
+		require.NoError(t, json.NewEncoder(file).Encode(e))
+	}
+}
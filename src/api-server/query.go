@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// queryExpr is a filter expression, evaluated against records.
+//
+// The language compares record fields, given as dotted paths, with literals
+// or other fields:
+//
+//	weather == "Sunny" and (temperature >= 20 or city in ["Lyon", "Paris"])
+//	not (tags contains "storm") && city =~ "^Gopher"
+//
+// Comparison operators are ==, !=, <, <=, > and >=. Missing fields are null.
+// contains tests substrings and array elements, matches (or =~) tests a
+// regular expression, and in tests the membership to a list. Expressions are
+// combined with and (&&), or (||) and not (!).
+type queryExpr interface {
+	eval(doc map[string]interface{}) bool
+}
+
+type (
+	andExpr struct{ left, right queryExpr }
+	orExpr  struct{ left, right queryExpr }
+	notExpr struct{ expr queryExpr }
+
+	compareExpr struct {
+		op          string
+		left, right queryOperand
+	}
+	inExpr struct {
+		left   queryOperand
+		values queryOperand
+	}
+	containsExpr struct{ left, right queryOperand }
+	matchesExpr  struct {
+		left queryOperand
+		re   *regexp.Regexp
+	}
+)
+
+func (e andExpr) eval(doc map[string]interface{}) bool {
+	return e.left.eval(doc) && e.right.eval(doc)
+}
+
+func (e orExpr) eval(doc map[string]interface{}) bool {
+	return e.left.eval(doc) || e.right.eval(doc)
+}
+
+func (e notExpr) eval(doc map[string]interface{}) bool {
+	return !e.expr.eval(doc)
+}
+
+func (e compareExpr) eval(doc map[string]interface{}) bool {
+	left, right := e.left.value(doc), e.right.value(doc)
+
+	switch e.op {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+
+	cmp, ok := compareValues(left, right)
+	if !ok {
+		return false
+	}
+
+	switch e.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func (e inExpr) eval(doc map[string]interface{}) bool {
+	values, ok := e.values.value(doc).([]interface{})
+	if !ok {
+		return false
+	}
+
+	left := e.left.value(doc)
+	for _, v := range values {
+		if reflect.DeepEqual(left, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e containsExpr) eval(doc map[string]interface{}) bool {
+	right := e.right.value(doc)
+
+	switch left := e.left.value(doc).(type) {
+	case string:
+		s, ok := right.(string)
+		return ok && strings.Contains(left, s)
+	case []interface{}:
+		for _, v := range left {
+			if reflect.DeepEqual(v, right) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (e matchesExpr) eval(doc map[string]interface{}) bool {
+	s, ok := e.left.value(doc).(string)
+
+	return ok && e.re.MatchString(s)
+}
+
+// compareValues orders numbers and strings. It reports false for values which
+// cannot be ordered.
+func compareValues(left, right interface{}) (int, bool) {
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(l, r), true
+	default:
+		return 0, false
+	}
+}
+
+// queryOperand is a field of the records or a literal.
+type queryOperand interface {
+	value(doc map[string]interface{}) interface{}
+}
+
+type (
+	fieldOperand   struct{ path []string }
+	literalOperand struct{ v interface{} }
+	listOperand    struct{ items []queryOperand }
+)
+
+func (o fieldOperand) value(doc map[string]interface{}) interface{} {
+	return lookupField(doc, o.path)
+}
+
+func (o literalOperand) value(map[string]interface{}) interface{} {
+	return o.v
+}
+
+func (o listOperand) value(doc map[string]interface{}) interface{} {
+	values := make([]interface{}, len(o.items))
+	for i, item := range o.items {
+		values[i] = item.value(doc)
+	}
+
+	return values
+}
+
+// lookupField returns the value at path in doc, or nil when missing. Path
+// segments index objects by key and arrays by position.
+func lookupField(doc map[string]interface{}, path []string) interface{} {
+	var v interface{} = doc
+	for _, segment := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+
+	return v
+}
+
+// parseQuery parses a filter expression.
+func parseQuery(src string) (queryExpr, error) {
+	tokens, err := lexQuery(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+	}
+
+	return expr, nil
+}
+
+type queryTokenKind int
+
+const (
+	tokenEOF queryTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+}
+
+func (t queryToken) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+
+	return strconv.Quote(t.text)
+}
+
+// is reports whether t is the given symbol or keyword. Keywords are case
+// insensitive.
+func (t queryToken) is(s string) bool {
+	switch t.kind {
+	case tokenSymbol:
+		return t.text == s
+	case tokenIdent:
+		return strings.EqualFold(t.text, s)
+	default:
+		return false
+	}
+}
+
+var querySymbols = []string{"==", "!=", "<=", ">=", "=~", "&&", "||", "<", ">", "=", "!", "(", ")", "[", "]", ","}
+
+func lexQuery(src string) ([]queryToken, error) {
+	var tokens []queryToken
+
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(src) && src[end] != src[i] {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+
+			text := src[i+1 : end]
+			if c == '"' {
+				var err error
+				if text, err = strconv.Unquote(src[i : end+1]); err != nil {
+					return nil, fmt.Errorf("invalid string at offset %d: %w", i, err)
+				}
+			} else {
+				text = strings.ReplaceAll(text, `\'`, `'`)
+			}
+			tokens = append(tokens, queryToken{kind: tokenString, text: text, pos: i})
+			i = end + 1
+
+		case c == '-' || c >= '0' && c <= '9':
+			end := i + 1
+			for end < len(src) && strings.ContainsRune("0123456789.eE+-", rune(src[end])) {
+				if (src[end] == '+' || src[end] == '-') && src[end-1] != 'e' && src[end-1] != 'E' {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, queryToken{kind: tokenNumber, text: src[i:end], pos: i})
+			i = end
+
+		case c == '_' || c == '$' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(src) && (src[end] == '_' || src[end] == '$' || src[end] == '.' || src[end] == '-' ||
+				unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			tokens = append(tokens, queryToken{kind: tokenIdent, text: src[i:end], pos: i})
+			i = end
+
+		default:
+			var symbol string
+			for _, s := range querySymbols {
+				if strings.HasPrefix(src[i:], s) {
+					symbol = s
+					break
+				}
+			}
+			if symbol == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			tokens = append(tokens, queryToken{kind: tokenSymbol, text: symbol, pos: i})
+			i += len(symbol)
+		}
+	}
+
+	return append(tokens, queryToken{kind: tokenEOF, pos: len(src)}), nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+func (p *queryParser) expect(s string) error {
+	if tok := p.next(); !tok.is(s) {
+		return fmt.Errorf("expecting %q at offset %d, got %s", s, tok.pos, tok)
+	}
+
+	return nil
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("or") || p.peek().is("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("and") || p.peek().is("&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	if p.peek().is("not") || p.peek().is("!") {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr: expr}, nil
+	}
+
+	if p.peek().is("(") {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (queryExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch {
+	case op.is("==") || op.is("="):
+		right, err := p.parseOperand()
+		return compareExpr{op: "==", left: left, right: right}, err
+
+	case op.is("!=") || op.is("<") || op.is("<=") || op.is(">") || op.is(">="):
+		right, err := p.parseOperand()
+		return compareExpr{op: op.text, left: left, right: right}, err
+
+	case op.is("in"):
+		values, err := p.parseOperand()
+		return inExpr{left: left, values: values}, err
+
+	case op.is("contains"):
+		right, err := p.parseOperand()
+		return containsExpr{left: left, right: right}, err
+
+	case op.is("matches") || op.is("=~"):
+		tok := p.next()
+		if tok.kind != tokenString {
+			return nil, fmt.Errorf("expecting a regular expression at offset %d, got %s", tok.pos, tok)
+		}
+		re, err := regexp.Compile(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at offset %d: %w", tok.pos, err)
+		}
+		return matchesExpr{left: left, re: re}, nil
+
+	default:
+		return nil, fmt.Errorf("expecting an operator at offset %d, got %s", op.pos, op)
+	}
+}
+
+func (p *queryParser) parseOperand() (queryOperand, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenString:
+		return literalOperand{v: tok.text}, nil
+
+	case tokenNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at offset %d", tok, tok.pos)
+		}
+		return literalOperand{v: n}, nil
+
+	case tokenIdent:
+		switch {
+		case tok.is("true"):
+			return literalOperand{v: true}, nil
+		case tok.is("false"):
+			return literalOperand{v: false}, nil
+		case tok.is("null"):
+			return literalOperand{v: nil}, nil
+		}
+		if !validFieldPath(tok.text) {
+			return nil, fmt.Errorf("invalid field %s at offset %d", tok, tok.pos)
+		}
+		return fieldOperand{path: strings.Split(tok.text, ".")}, nil
+
+	case tokenSymbol:
+		if tok.is("[") {
+			return p.parseList()
+		}
+	}
+
+	return nil, fmt.Errorf("expecting a field or a value at offset %d, got %s", tok.pos, tok)
+}
+
+func (p *queryParser) parseList() (queryOperand, error) {
+	list := listOperand{}
+	if p.peek().is("]") {
+		p.next()
+		return list, nil
+	}
+
+	for {
+		item, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		list.items = append(list.items, item)
+
+		tok := p.next()
+		if tok.is("]") {
+			return list, nil
+		}
+		if !tok.is(",") {
+			return nil, fmt.Errorf("expecting \",\" or \"]\" at offset %d, got %s", tok.pos, tok)
+		}
+	}
+}
+
+// literal returns the value of o when it does not depend on the records.
+func literal(o queryOperand) (interface{}, bool) {
+	switch o := o.(type) {
+	case literalOperand:
+		return o.v, true
+	case listOperand:
+		values := make([]interface{}, len(o.items))
+		for i, item := range o.items {
+			v, ok := literal(item)
+			if !ok {
+				return nil, false
+			}
+			values[i] = v
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseQuery(t *testing.T) {
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"city": "GopherCity",
+		"weather": "Moderate rain",
+		"temperature": 12.5,
+		"tags": ["rain", "wind"],
+		"station": {"name": "North", "active": true},
+		"readings": [3, 4]
+	}`), &doc))
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: `city == "GopherCity"`, want: true},
+		{expr: `city = 'GopherCity'`, want: true},
+		{expr: `city != "GopherCity"`, want: false},
+		{expr: `temperature > 10`, want: true},
+		{expr: `temperature <= 12.5`, want: true},
+		{expr: `temperature < -1`, want: false},
+		{expr: `temperature >= 1e2`, want: false},
+		{expr: `city < "H"`, want: true},
+		{expr: `city > 3`, want: false},
+		{expr: `station.name == "North" && station.active == true`, want: true},
+		{expr: `readings.1 == 4`, want: true},
+		{expr: `missing == null`, want: true},
+		{expr: `missing != null`, want: false},
+		{expr: `city in ["Lyon", "GopherCity"]`, want: true},
+		{expr: `city IN []`, want: false},
+		{expr: `"rain" in tags`, want: true},
+		{expr: `tags contains "wind"`, want: true},
+		{expr: `weather contains "rain"`, want: true},
+		{expr: `weather contains 3`, want: false},
+		{expr: `city matches "^Gopher"`, want: true},
+		{expr: `city =~ "(?i)^gopher"`, want: true},
+		{expr: `temperature =~ "12"`, want: false},
+		{expr: `city == "Lyon" or temperature > 10`, want: true},
+		{expr: `city == "Lyon" || temperature > 20`, want: false},
+		{expr: `not city == "Lyon"`, want: true},
+		{expr: `!(city == "Lyon" or tags contains "rain")`, want: false},
+		{expr: `city == "Lyon" and temperature > 10 or tags contains "wind"`, want: true},
+		{expr: `city == "Lyon" and (temperature > 10 or tags contains "wind")`, want: false},
+		{expr: `station.name == city`, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := parseQuery(test.expr)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.want, expr.eval(doc))
+		})
+	}
+}
+
+func Test_parseQuery_invalid(t *testing.T) {
+	tests := []string{
+		``,
+		`city`,
+		`city ==`,
+		`city == "Lyon`,
+		`city == "Lyon" and`,
+		`(city == "Lyon"`,
+		`city == "Lyon")`,
+		`city ~ "Lyon"`,
+		`city matches name`,
+		`city matches "("`,
+		`city in ["Lyon" "Paris"]`,
+		`city.. == 1`,
+		`temperature > 1.2.3`,
+	}
+
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			_, err := parseQuery(test)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitKeyIP      = "ip"
+	rateLimitKeyAPIKey  = "apiKey"
+	rateLimitKeySubject = "subject"
+	rateLimitKeyClient  = "client"
+	rateLimitKeyHeader  = "header:"
+
+	defaultAPIKeyHeader = "X-Api-Key"
+
+	// rateLimitSweepInterval is the number of requests between two sweeps
+	// of the buckets back to full capacity.
+	rateLimitSweepInterval = 1000
+)
+
+// rateLimitConfig is a token bucket limit, applied to each client.
+type rateLimitConfig struct {
+	Name string `yaml:"name"`
+	// Key identifies the clients: ip (the address of the client, behind the
+	// trusted proxies), apiKey (one of the configured keys, as sent for the
+	// apiKey security schemes of the spec, or in the X-Api-Key header),
+	// subject (of the authenticated principal), client (the authenticated
+	// principal, or else the API key) or header:<name>. Clients without
+	// verified principal or key are identified by their address.
+	Key string `yaml:"key"`
+	// Rate is the number of requests allowed per period.
+	Rate   int           `yaml:"rate"`
+	Period time.Duration `yaml:"period"`
+	// Burst is the capacity of the buckets, the rate by default.
+	Burst int `yaml:"burst"`
+	// Methods and Path restrict the requests counted, all by default. Path
+	// is a pattern, as understood by path.Match.
+	Methods []string `yaml:"methods"`
+	Path    string   `yaml:"path"`
+}
+
+func (c rateLimitConfig) period() time.Duration {
+	if c.Period <= 0 {
+		return time.Second
+	}
+
+	return c.Period
+}
+
+func (c rateLimitConfig) burst() int {
+	if c.Burst <= 0 {
+		return c.Rate
+	}
+
+	return c.Burst
+}
+
+func validateRateLimits(limits []rateLimitConfig) error {
+	names := map[string]bool{}
+	for _, l := range limits {
+		if l.Name == "" {
+			return errors.New("rate limit without name")
+		}
+		if names[l.Name] {
+			return fmt.Errorf("duplicated rate limit %q", l.Name)
+		}
+		names[l.Name] = true
+
+		if l.Rate <= 0 {
+			return fmt.Errorf("rate limit %q: rate must be positive", l.Name)
+		}
+
+		switch {
+		case l.Key == rateLimitKeyIP, l.Key == rateLimitKeyAPIKey, l.Key == rateLimitKeySubject, l.Key == rateLimitKeyClient:
+		case strings.HasPrefix(l.Key, rateLimitKeyHeader) && len(l.Key) > len(rateLimitKeyHeader):
+		default:
+			return fmt.Errorf("rate limit %q: unknown key %q", l.Name, l.Key)
+		}
+
+		if _, err := path.Match(l.Path, ""); err != nil {
+			return fmt.Errorf("rate limit %q: invalid path %q: %w", l.Name, l.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func (c rateLimitConfig) applies(req *http.Request) bool {
+	if len(c.Methods) > 0 && !slices.ContainsFunc(c.Methods, func(m string) bool { return strings.EqualFold(m, req.Method) }) {
+		return false
+	}
+	if c.Path != "" {
+		if ok, _ := path.Match(c.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rateLimitKey returns the key of the bucket of the client. Only verified
+// principals and keys are trusted, as unverified ones would let clients pick
+// their bucket.
+func (a *api) rateLimitKey(c rateLimitConfig, req *http.Request) string {
+	switch c.Key {
+	case rateLimitKeyIP:
+		return a.clientAddr(req)
+
+	case rateLimitKeyAPIKey:
+		if key := a.verifiedAPIKey(req); key != "" {
+			return key
+		}
+		return a.clientAddr(req)
+
+	case rateLimitKeySubject:
+		if p := principalFromContext(req.Context()); p != nil && p.Subject != "" {
+			return p.Subject
+		}
+		return a.clientAddr(req)
+
+	case rateLimitKeyClient:
+		if p := principalFromContext(req.Context()); p != nil && p.Subject != "" {
+			return p.Subject
+		}
+		if key := a.verifiedAPIKey(req); key != "" {
+			return key
+		}
+		return a.clientAddr(req)
+
+	default:
+		return req.Header.Get(strings.TrimPrefix(c.Key, rateLimitKeyHeader))
+	}
+}
+
+// verifiedAPIKey returns the API key of the request, as sent for the apiKey
+// security schemes of the spec or in the X-Api-Key header, if it is one of
+// the configured keys.
+func (a *api) verifiedAPIKey(req *http.Request) string {
+	if a.auth == nil {
+		return ""
+	}
+
+	var keys []string
+	if doc := a.getSpecDocument(); doc != nil {
+		schemes := doc.Components.SecuritySchemes
+		for _, name := range sortedKeys(schemes) {
+			if !strings.EqualFold(schemes[name].Type, "apiKey") {
+				continue
+			}
+			if key, err := apiKeyValue(req, schemes[name]); err == nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	keys = append(keys, req.Header.Get(defaultAPIKeyHeader))
+
+	for _, key := range keys {
+		if _, ok := a.auth.apiKeys[key]; ok {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// clientAddr returns the address of the client: the remote address, or the
+// rightmost address of X-Forwarded-For which is not a trusted proxy when the
+// request comes from one.
+func (a *api) clientAddr(req *http.Request) string {
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && a.trustedProxy(addr); i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			addr = hop
+		}
+	}
+
+	return addr
+}
+
+func (a *api) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range a.trustedProxies {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets of the clients, per limit.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  []rateLimitConfig
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+func newRateLimiter(limits []rateLimitConfig) *rateLimiter {
+	return &rateLimiter{limits: limits}
+}
+
+// rateLimitStatus is the state of the bucket of a client after a request.
+type rateLimitStatus struct {
+	limit rateLimitConfig
+	// remaining is the number of whole tokens left.
+	remaining int
+	// reset is the time until the bucket is full again.
+	reset time.Duration
+	// retryAfter is the time until the next token, when there is none left.
+	retryAfter time.Duration
+}
+
+// take takes a token from the bucket of each limit matching req, if all of
+// them have one. It returns the status of the most restrictive limit, and
+// whether the request is allowed. A nil limiter allows all the requests.
+func (l *rateLimiter) take(req *http.Request, keyOf func(rateLimitConfig, *http.Request) string) (*rateLimitStatus, bool) {
+	if l == nil {
+		return nil, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.limits) == 0 {
+		return nil, true
+	}
+
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+
+	l.calls++
+	if l.calls%rateLimitSweepInterval == 0 {
+		l.sweep(now)
+	}
+
+	type match struct {
+		limit  rateLimitConfig
+		bucket *tokenBucket
+	}
+
+	var matches []match
+	allowed := true
+	for _, limit := range l.limits {
+		if !limit.applies(req) {
+			continue
+		}
+
+		key := limit.Name + "\x00" + keyOf(limit, req)
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(limit.burst()), last: now}
+			l.buckets[key] = bucket
+		}
+		refill(limit, bucket, now)
+
+		if bucket.tokens < 1 {
+			allowed = false
+		}
+		matches = append(matches, match{limit: limit, bucket: bucket})
+	}
+
+	var status *rateLimitStatus
+	for _, m := range matches {
+		if allowed {
+			m.bucket.tokens--
+		}
+
+		s := bucketStatus(m.limit, m.bucket)
+		if status == nil || s.remaining < status.remaining || (s.remaining == status.remaining && s.retryAfter > status.retryAfter) {
+			status = &s
+		}
+	}
+
+	return status, allowed
+}
+
+// sweep forgets the buckets back to full capacity, which are the same as new
+// ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		name, _, _ := strings.Cut(key, "\x00")
+		for _, limit := range l.limits {
+			if limit.Name != name {
+				continue
+			}
+
+			refill(limit, bucket, now)
+			if bucket.tokens >= float64(limit.burst()) {
+				delete(l.buckets, key)
+			}
+		}
+	}
+}
+
+func refill(limit rateLimitConfig, bucket *tokenBucket, now time.Time) {
+	perSecond := float64(limit.Rate) / limit.period().Seconds()
+	bucket.tokens = math.Min(float64(limit.burst()), bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+}
+
+func bucketStatus(limit rateLimitConfig, bucket *tokenBucket) rateLimitStatus {
+	perSecond := float64(limit.Rate) / limit.period().Seconds()
+
+	s := rateLimitStatus{
+		limit:     limit,
+		remaining: int(math.Floor(bucket.tokens)),
+		reset:     time.Duration((float64(limit.burst()) - bucket.tokens) / perSecond * float64(time.Second)),
+	}
+	if bucket.tokens < 1 {
+		s.retryAfter = time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+
+	return s
+}
+
+// rateLimitMiddleware enforces the rate limits, and reports them with the
+// RateLimit-* headers of the IETF draft. Rejected requests are answered with
+// 429 and Retry-After.
+func (a *api) rateLimitMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			status, allowed := a.rateLimits.take(r, a.rateLimitKey)
+			if status == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(status.limit.burst()))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(status.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(status.reset)))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d;name=%q",
+				status.limit.Rate, ceilSeconds(status.limit.period()), status.limit.burst(), status.limit.Name))
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(status.retryAfter)))
+				JSONError(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit %q exceeded", status.limit.Name))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	recordingsPath = "/_recordings"
+
+	defaultRecordingSize        = 1000
+	defaultRecordingMaxBodySize = 64 << 10
+
+	redactedValue = "REDACTED"
+
+	mediaTypeHAR         = "application/har+json"
+	mediaTypeJSONLines   = "application/jsonl"
+	recordingFormatHAR   = "har"
+	recordingFormatLines = "jsonl"
+)
+
+// defaultRedactedHeaders are the credentials never written in the recordings.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+type recordingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Size is the number of exchanges kept in memory, 1000 by default.
+	Size int `yaml:"size"`
+	// MaxBodySize is the number of bytes of each body kept, 64KiB by default.
+	MaxBodySize int `yaml:"maxBodySize"`
+	// File receives the exchanges as they complete, as JSON Lines. When its
+	// extension is .har, it receives a HAR archive of the recorded exchanges
+	// instead, written on export and on shutdown.
+	File   string       `yaml:"file"`
+	Redact redactConfig `yaml:"redact"`
+}
+
+type redactConfig struct {
+	// Headers are redacted in addition to the authorization and cookie ones.
+	Headers []string `yaml:"headers"`
+	// Query lists the query parameters to redact.
+	Query []string `yaml:"query"`
+}
+
+// exchange is a recorded request and its response.
+type exchange struct {
+	ID       uint64          `json:"id"`
+	Started  time.Time       `json:"started"`
+	Duration time.Duration   `json:"duration"`
+	Request  recordedMessage `json:"request"`
+	Response recordedMessage `json:"response"`
+}
+
+type recordedMessage struct {
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	RemoteAddr string      `json:"remoteAddr,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Proto      string      `json:"proto"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+	// BodyEncoding is "base64" for bodies which are not valid UTF-8.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	BodySize     int64  `json:"bodySize"`
+	Truncated    bool   `json:"truncated,omitempty"`
+}
+
+// recorder keeps the latest exchanges handled by the server, with their
+// credentials redacted.
+type recorder struct {
+	cfg recordingConfig
+
+	mu        sync.Mutex
+	lastID    uint64
+	exchanges []exchange
+	file      *os.File
+}
+
+func newRecorder(cfg recordingConfig) (*recorder, error) {
+	if cfg.Size <= 0 {
+		cfg.Size = defaultRecordingSize
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = defaultRecordingMaxBodySize
+	}
+
+	r := &recorder{cfg: cfg}
+
+	if cfg.File != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if r.harFile() {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		}
+
+		file, err := os.OpenFile(cfg.File, flags, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("recording file: %w", err)
+		}
+		r.file = file
+	}
+
+	return r, nil
+}
+
+func (r *recorder) harFile() bool {
+	return strings.EqualFold(filepath.Ext(r.cfg.File), ".har")
+}
+
+// middleware records the exchanges handled by next, and serves the
+// recordings behind the admin middleware.
+func (r *recorder) middleware(next http.Handler, admin func(http.Handler) http.Handler) http.Handler {
+	recordings := admin(http.HandlerFunc(r.handleRecordings))
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == recordingsPath {
+			recordings.ServeHTTP(rw, req)
+			return
+		}
+
+		r.record(captureExchange(next, rw, req, r.cfg.MaxBodySize))
+	})
+}
+
+// captureExchange serves req with next, and returns the exchange, with bodies
+// limited to maxBodySize bytes.
+func captureExchange(next http.Handler, rw http.ResponseWriter, req *http.Request, maxBodySize int) exchange {
+	started := time.Now()
+	reqBody := &teeReadCloser{ReadCloser: req.Body, body: limitedBuffer{limit: maxBodySize}}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = reqBody
+	}
+
+	// The request is copied before being handled, as handlers may alter it.
+	recorded := exchange{
+		Started: started,
+		Request: recordedMessage{
+			Method:     req.Method,
+			URL:        requestURL(req),
+			RemoteAddr: req.RemoteAddr,
+			Proto:      req.Proto,
+			Header:     req.Header.Clone(),
+		},
+	}
+
+	w := &recordingResponseWriter{ResponseWriter: rw, body: limitedBuffer{limit: maxBodySize}}
+	next.ServeHTTP(w, req)
+
+	recorded.Duration = time.Since(started)
+	recorded.Request.setBody(&reqBody.body)
+	recorded.Response = recordedMessage{
+		Status: w.statusCode(),
+		Proto:  req.Proto,
+		Header: rw.Header().Clone(),
+	}
+	recorded.Response.setBody(&w.body)
+
+	return recorded
+}
+
+func (r *recorder) record(e exchange) {
+	r.cfg.Redact.apply(&e)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID++
+	e.ID = r.lastID
+
+	r.exchanges = append(r.exchanges, e)
+	if len(r.exchanges) > r.cfg.Size {
+		r.exchanges = append(r.exchanges[:0], r.exchanges[len(r.exchanges)-r.cfg.Size:]...)
+	}
+
+	// HAR archives cannot be appended to, they are written on export.
+	if r.file != nil && !r.harFile() {
+		if err := json.NewEncoder(r.file).Encode(e); err != nil {
+			log.Printf("Unable to write recording: %v", err)
+		}
+	}
+}
+
+// flush writes the HAR archive of the recorded exchanges to the recording
+// file, if it is one.
+func (r *recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil || !r.harFile() {
+		return
+	}
+	if err := r.writeHAR(); err != nil {
+		log.Printf("Unable to write recording: %v", err)
+	}
+}
+
+// close flushes the recording file and closes it.
+func (r *recorder) close() {
+	r.flush()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+}
+
+// writeHAR replaces the content of the recording file with the HAR archive
+// of the recorded exchanges. The recorder must be locked.
+func (r *recorder) writeHAR() error {
+	if err := r.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := r.file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(r.file).Encode(newHAR(r.exchanges))
+}
+
+// apply replaces the credentials of e with a placeholder.
+func (c redactConfig) apply(e *exchange) {
+	headers := append(append([]string{}, defaultRedactedHeaders...), c.Headers...)
+	for _, name := range headers {
+		for _, header := range []http.Header{e.Request.Header, e.Response.Header} {
+			if values := header.Values(name); len(values) > 0 {
+				header[http.CanonicalHeaderKey(name)] = []string{redactedValue}
+			}
+		}
+	}
+
+	if len(c.Query) == 0 {
+		return
+	}
+
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return
+	}
+
+	query := u.Query()
+	redacted := false
+	for _, name := range c.Query {
+		if query.Has(name) {
+			query.Set(name, redactedValue)
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+		e.Request.URL = u.String()
+	}
+}
+
+func (r *recorder) list() []exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]exchange{}, r.exchanges...)
+}
+
+func (r *recorder) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exchanges = nil
+}
+
+// handleRecordings exports the recorded exchanges as HAR, or as JSON Lines
+// with ?format=jsonl, and forgets them on DELETE.
+func (r *recorder) handleRecordings(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		r.clear()
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		JSONError(rw, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", req.Method))
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = recordingFormatHAR
+		if strings.Contains(req.Header.Get("Accept"), mediaTypeJSONLines) {
+			format = recordingFormatLines
+		}
+	}
+
+	r.flush()
+	exchanges := r.list()
+
+	switch format {
+	case recordingFormatHAR:
+		rw.Header().Set("Content-Type", mediaTypeHAR)
+		_ = json.NewEncoder(rw).Encode(newHAR(exchanges))
+
+	case recordingFormatLines:
+		rw.Header().Set("Content-Type", mediaTypeJSONLines)
+		enc := json.NewEncoder(rw)
+		for _, e := range exchanges {
+			_ = enc.Encode(e)
+		}
+
+	default:
+		JSONError(rw, http.StatusBadRequest, fmt.Sprintf("unknown format %q, expecting %q or %q", format, recordingFormatHAR, recordingFormatLines))
+	}
+}
+
+// requestURL returns the absolute URL the request was sent to.
+func requestURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+func (m *recordedMessage) setBody(b *limitedBuffer) {
+	m.BodySize = b.size
+	m.Truncated = b.size > int64(b.buf.Len())
+
+	if utf8.Valid(b.buf.Bytes()) {
+		m.Body = b.buf.String()
+		return
+	}
+
+	m.Body = base64.StdEncoding.EncodeToString(b.buf.Bytes())
+	m.BodyEncoding = "base64"
+}
+
+// body returns the decoded body of the message.
+func (m *recordedMessage) body() ([]byte, error) {
+	if m.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(m.Body)
+	}
+
+	return []byte(m.Body), nil
+}
+
+// limitedBuffer keeps the first bytes written to it, and counts the others.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	size  int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+
+	return len(p), nil
+}
+
+// teeReadCloser keeps the bytes of a request body as the handler reads them.
+type teeReadCloser struct {
+	io.ReadCloser
+	body limitedBuffer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	_, _ = t.body.Write(p[:n])
+
+	return n, err
+}
+
+// recordingResponseWriter keeps the response sent to the client. Streaming
+// and connection upgrades still work through it.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   limitedBuffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	_, _ = w.body.Write(b)
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, buf, err
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *recordingResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
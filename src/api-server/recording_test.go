@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRecordingAPI(t *testing.T, cfg recordingConfig) (*recorder, *httptest.Server) {
+	t.Helper()
+
+	a := &api{}
+	require.NoError(t, a.loadData("fixtures/data.json"))
+
+	rec, err := newRecorder(cfg)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rec.middleware(a.getRouter(), a.adminMiddleware()))
+	t.Cleanup(srv.Close)
+
+	return rec, srv
+}
+
+func Test_recorder(t *testing.T) {
+	rec, srv := newRecordingAPI(t, recordingConfig{
+		MaxBodySize: 16,
+		Redact:      redactConfig{Headers: []string{"X-Api-Key"}, Query: []string{"token"}},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather?token=secret&city=lyon", strings.NewReader(`{"city":"Lyon","weather":"Foggy"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Set("X-Forwarded-Prefix", "/api")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	exchanges := rec.list()
+	require.Len(t, exchanges, 1)
+
+	e := exchanges[0]
+	assert.Equal(t, uint64(1), e.ID)
+	assert.Equal(t, http.MethodPost, e.Request.Method)
+	assert.Equal(t, srv.URL+"/weather?city=lyon&token=REDACTED", e.Request.URL)
+	assert.Equal(t, redactedValue, e.Request.Header.Get("Authorization"))
+	assert.Equal(t, redactedValue, e.Request.Header.Get("X-Api-Key"))
+	assert.Equal(t, "/api", e.Request.Header.Get("X-Forwarded-Prefix"))
+	assert.Equal(t, `{"city":"Lyon","`, e.Request.Body)
+	assert.Equal(t, int64(33), e.Request.BodySize)
+	assert.True(t, e.Request.Truncated)
+
+	assert.Equal(t, http.StatusCreated, e.Response.Status)
+	assert.Equal(t, "application/json", e.Response.Header.Get("Content-Type"))
+	assert.NotEmpty(t, e.Response.Body)
+}
+
+func Test_recorder_size(t *testing.T) {
+	rec, srv := newRecordingAPI(t, recordingConfig{Size: 2})
+
+	for _, id := range []string{"0", "1", "2"} {
+		resp := doRequest(t, http.MethodGet, srv.URL+"/weather/"+id, "", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	exchanges := rec.list()
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, uint64(2), exchanges[0].ID)
+	assert.Equal(t, srv.URL+"/weather/1", exchanges[0].Request.URL)
+	assert.Equal(t, uint64(3), exchanges[1].ID)
+}
+
+func Test_handleRecordings(t *testing.T) {
+	_, srv := newRecordingAPI(t, recordingConfig{})
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/42", "", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_recordings", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, mediaTypeHAR, resp.Header.Get("Content-Type"))
+
+	var har harLog
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&har))
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 2)
+	assert.Equal(t, srv.URL+"/weather/1", har.Log.Entries[0].Request.URL)
+	assert.Equal(t, http.StatusOK, har.Log.Entries[0].Response.Status)
+	assert.JSONEq(t, `{"city":"City of Gophers","weather":"Sunny"}`, har.Log.Entries[0].Response.Content.Text)
+	assert.Equal(t, http.StatusNotFound, har.Log.Entries[1].Response.Status)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_recordings?format=jsonl", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, mediaTypeJSONLines, resp.Header.Get("Content-Type"))
+
+	var lines []exchange
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var e exchange
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		lines = append(lines, e)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, srv.URL+"/weather/42", lines[1].Request.URL)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_recordings?format=xml", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/_recordings", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/_recordings", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_recordings", "", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&har))
+	assert.Empty(t, har.Log.Entries)
+}
+
+func Test_recorder_file(t *testing.T) {
+	dir := t.TempDir()
+
+	linesFile := filepath.Join(dir, "recordings.jsonl")
+	_, srv := newRecordingAPI(t, recordingConfig{File: linesFile})
+	doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	doRequest(t, http.MethodGet, srv.URL+"/weather/2", "", "")
+
+	raw, err := os.ReadFile(linesFile)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(raw)), "\n"), 2)
+
+	harFile := filepath.Join(dir, "recordings.har")
+	rec, srv := newRecordingAPI(t, recordingConfig{File: harFile})
+	doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+
+	// The archive is written on export.
+	doRequest(t, http.MethodGet, srv.URL+recordingsPath, "", "")
+
+	raw, err = os.ReadFile(harFile)
+	require.NoError(t, err)
+
+	var har harLog
+	require.NoError(t, json.Unmarshal(raw, &har))
+	assert.Len(t, har.Log.Entries, 1)
+
+	// And on shutdown.
+	doRequest(t, http.MethodGet, srv.URL+"/weather/2", "", "")
+	rec.close()
+
+	raw, err = os.ReadFile(harFile)
+	require.NoError(t, err)
+
+	require.NoError(t, json.Unmarshal(raw, &har))
+	assert.Len(t, har.Log.Entries, 2)
+}
+
+func Test_recorder_admin(t *testing.T) {
+	a := &api{}
+	require.NoError(t, a.configure(&config{Auth: &authConfig{Users: []userCredential{{Username: "admin", Password: "secret", Scopes: []string{"admin"}}}}}))
+
+	rec, err := newRecorder(recordingConfig{})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rec.middleware(a.getRouter(), a.adminMiddleware()))
+	t.Cleanup(srv.Close)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+recordingsPath, "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+recordingsPath, http.NoBody)
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	errRecordNotFound = errors.New("not found")
+	errAlreadyExists  = errors.New("already exists")
+)
+
+// createRecord stores obj as a new record of objType, and returns its ID.
+func (a *api) createRecord(ctx context.Context, objType string, obj map[string]interface{}) (string, error) {
+	delete(obj, "id")
+
+	err := a.checkReferences(objType, obj)
+	if err != nil {
+		return "", err
+	}
+
+	objID, err := a.newID(objType, obj)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+
+	if !a.insertObject(ctx, objType, objID, data) {
+		return "", fmt.Errorf("%s/%s %w", objType, objID, errAlreadyExists)
+	}
+
+	return objID, nil
+}
+
+// replaceRecord replaces the objType/objID record with obj. The record is
+// created when missing if the collection allows upserts. It reports whether
+// the record was created.
+func (a *api) replaceRecord(ctx context.Context, objType, objID string, obj map[string]interface{}) (bool, error) {
+	_, err := a.getObject(objType, objID)
+	created := err != nil
+	if created && !a.ids[objType].Upsert {
+		return false, fmt.Errorf("%s/%s %w", objType, objID, errRecordNotFound)
+	}
+
+	delete(obj, "id")
+
+	err = a.checkReferences(objType, obj)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return false, err
+	}
+	a.setObject(ctx, objType, objID, data)
+
+	return created, nil
+}
+
+// restoreRecord stores obj as the objType/objID record, whether it exists or
+// not. It reports whether the record was created.
+func (a *api) restoreRecord(ctx context.Context, objType, objID string, obj map[string]interface{}) (bool, error) {
+	delete(obj, "id")
+
+	err := a.checkReferences(objType, obj)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = a.getObject(objType, objID)
+	a.setObject(ctx, objType, objID, data)
+
+	return err != nil, nil
+}
+
+// deleteRecord deletes the objType/objID record along with its cascading
+// children. Deleting a missing record is not an error.
+func (a *api) deleteRecord(ctx context.Context, objType, objID string) error {
+	if _, err := a.getObject(objType, objID); err != nil {
+		return nil
+	}
+
+	plan, err := a.deletionPlan(objType, objID, map[recordRef]bool{})
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range plan {
+		a.deleteObject(ctx, ref.objType, ref.id)
+	}
+
+	return nil
+}
+
+// recordErrorStatus returns the status code answering err, returned while
+// changing records.
+func recordErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errAlreadyExists), errors.Is(err, errRestricted):
+		return http.StatusConflict
+	case errors.Is(err, errBrokenReference), errors.Is(err, errMissingNaturalKey):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
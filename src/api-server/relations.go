@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	onDeleteRestrict = "restrict"
+	onDeleteCascade  = "cascade"
+)
+
+var (
+	errBrokenReference = errors.New("broken reference")
+	errRestricted      = errors.New("restricted")
+)
+
+// relationConfig declares that the records of the Child collection belong to
+// records of the Parent collection, through the ForeignKey field. Children are
+// exposed under /{parent}/{id}/{name}.
+type relationConfig struct {
+	Name       string `yaml:"name"`
+	Parent     string `yaml:"parent"`
+	Child      string `yaml:"child"`
+	ForeignKey string `yaml:"foreignKey"`
+	// Integrity rejects children referencing missing parents.
+	Integrity bool `yaml:"integrity"`
+	// OnDelete is what happens to the children of a deleted parent:
+	// "restrict" refuses the deletion, "cascade" deletes them too, and they
+	// are left as they are otherwise.
+	OnDelete string `yaml:"onDelete"`
+}
+
+func validateRelations(relations []relationConfig) error {
+	for _, rel := range relations {
+		if rel.Name == "" || rel.Parent == "" || rel.Child == "" || rel.ForeignKey == "" {
+			return fmt.Errorf("relation %q: name, parent, child and foreignKey are required", rel.Name)
+		}
+
+		switch rel.OnDelete {
+		case "", onDeleteRestrict, onDeleteCascade:
+		default:
+			return fmt.Errorf("relation %q: unknown onDelete %q", rel.Name, rel.OnDelete)
+		}
+	}
+
+	return nil
+}
+
+func (a *api) relation(parent, name string) (relationConfig, bool) {
+	for _, rel := range a.relations {
+		if rel.Parent == parent && rel.Name == name {
+			return rel, true
+		}
+	}
+
+	return relationConfig{}, false
+}
+
+// children returns the records of the relation belonging to parentID, with
+// their ID.
+func (a *api) children(rel relationConfig, parentID string) ([]map[string]interface{}, error) {
+	objs, _ := a.listObjects(rel.Child)
+
+	children := []map[string]interface{}{}
+	for id, raw := range objs {
+		var doc map[string]interface{}
+		err := json.Unmarshal(raw, &doc)
+		if err != nil {
+			return nil, err
+		}
+
+		if refersTo(doc[rel.ForeignKey], parentID) {
+			doc["id"] = id
+			children = append(children, doc)
+		}
+	}
+
+	return children, nil
+}
+
+// checkReferences verifies that obj, about to be stored in objType, only
+// references existing parents.
+func (a *api) checkReferences(objType string, obj map[string]interface{}) error {
+	for _, rel := range a.relations {
+		if rel.Child != objType || !rel.Integrity {
+			continue
+		}
+
+		value, ok := obj[rel.ForeignKey]
+		if !ok || value == nil {
+			return fmt.Errorf("%w: %s is required", errBrokenReference, rel.ForeignKey)
+		}
+
+		parentID := fmt.Sprint(value)
+		if _, err := a.getObject(rel.Parent, parentID); err != nil {
+			return fmt.Errorf("%w: %s", errBrokenReference, err)
+		}
+	}
+
+	return nil
+}
+
+type recordRef struct {
+	objType string
+	id      string
+}
+
+// deletionPlan returns the records to delete along with objType/id, following
+// cascading relations. It fails when a restricting relation still has
+// children.
+func (a *api) deletionPlan(objType, id string, seen map[recordRef]bool) ([]recordRef, error) {
+	ref := recordRef{objType: objType, id: id}
+	if seen[ref] {
+		return nil, nil
+	}
+	seen[ref] = true
+
+	plan := []recordRef{ref}
+	for _, rel := range a.relations {
+		if rel.Parent != objType || rel.OnDelete == "" {
+			continue
+		}
+
+		children, err := a.children(rel, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) == 0 {
+			continue
+		}
+
+		if rel.OnDelete == onDeleteRestrict {
+			return nil, fmt.Errorf("%w: %s/%s has %d %s", errRestricted, objType, id, len(children), rel.Name)
+		}
+
+		for _, child := range children {
+			childPlan, err := a.deletionPlan(rel.Child, fmt.Sprint(child["id"]), seen)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, childPlan...)
+		}
+	}
+
+	return plan, nil
+}
+
+// embed adds the related records named by the include query parameter to
+// doc, the objType/id record: the children of a relation of objType, or the
+// parent of objType.
+func (a *api) embed(objType, id string, doc map[string]interface{}, includes []string) error {
+	for _, include := range includes {
+		if rel, ok := a.relation(objType, include); ok {
+			children, err := a.children(rel, id)
+			if err != nil {
+				return err
+			}
+			doc[include] = children
+			continue
+		}
+
+		rel, ok := a.parentRelation(objType, include)
+		if !ok {
+			return fmt.Errorf("unknown relation %q", include)
+		}
+
+		doc[include] = nil
+
+		value, ok := doc[rel.ForeignKey]
+		if !ok || value == nil {
+			continue
+		}
+
+		parentID := fmt.Sprint(value)
+		raw, err := a.getObject(rel.Parent, parentID)
+		if err != nil {
+			continue
+		}
+
+		var parent map[string]interface{}
+		err = json.Unmarshal(raw, &parent)
+		if err != nil {
+			return err
+		}
+		parent["id"] = parentID
+		doc[include] = parent
+	}
+
+	return nil
+}
+
+func (a *api) parentRelation(child, parent string) (relationConfig, bool) {
+	for _, rel := range a.relations {
+		if rel.Child == child && rel.Parent == parent {
+			return rel, true
+		}
+	}
+
+	return relationConfig{}, false
+}
+
+func includes(req *http.Request) []string {
+	var names []string
+	for _, value := range req.URL.Query()["include"] {
+		names = append(names, splitList(value)...)
+	}
+
+	return names
+}
+
+func (a *api) handleGetRelated(rw http.ResponseWriter, req *http.Request) {
+	rel, parentID, ok := a.resolveRelation(rw, req)
+	if !ok {
+		return
+	}
+
+	c, err := responseCodec(req, true)
+	if err != nil {
+		JSONError(rw, http.StatusNotAcceptable, err.Error())
+		return
+	}
+
+	children, err := a.children(rel, parentID)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.write(rw, http.StatusOK, children)
+}
+
+func (a *api) handlePostRelated(rw http.ResponseWriter, req *http.Request) {
+	rel, parentID, ok := a.resolveRelation(rw, req)
+	if !ok {
+		return
+	}
+
+	if !a.authorizeChild(rw, req, "/"+url.PathEscape(rel.Child)) {
+		return
+	}
+
+	obj, err := decodeObject(req)
+	if err != nil {
+		bodyError(rw, err)
+		return
+	}
+
+	obj[rel.ForeignKey] = parentID
+	req, err = withJSONBody(req, obj)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.handlePost(rw, withObjectParams(req, rel.Child, ""))
+}
+
+// handleRelated serves the records of a relation the same way as the ones of
+// their collection, once checked they belong to the parent.
+func (a *api) handleRelated(rw http.ResponseWriter, req *http.Request) {
+	rel, parentID, ok := a.resolveRelation(rw, req)
+	if !ok {
+		return
+	}
+
+	childID := chi.URLParam(req, "childId")
+
+	if req.Method != http.MethodGet && !a.authorizeChild(rw, req, "/"+url.PathEscape(rel.Child)+"/"+url.PathEscape(childID)) {
+		return
+	}
+
+	raw, err := a.getObject(rel.Child, childID)
+	if err != nil {
+		JSONError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var child map[string]interface{}
+	err = json.Unmarshal(raw, &child)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !refersTo(child[rel.ForeignKey], parentID) {
+		JSONError(rw, http.StatusNotFound, fmt.Sprintf("%s/%s not found", rel.Child, childID))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		a.handleGet(rw, withObjectParams(req, rel.Child, childID))
+
+	case http.MethodPut:
+		obj, err := decodeObject(req)
+		if err != nil {
+			bodyError(rw, err)
+			return
+		}
+
+		obj[rel.ForeignKey] = parentID
+		req, err = withJSONBody(req, obj)
+		if err != nil {
+			JSONError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.handlePut(rw, withObjectParams(req, rel.Child, childID))
+
+	case http.MethodPatch:
+		req, err = withPinnedField(req, rel.ForeignKey, parentID)
+		if err != nil {
+			JSONError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.handlePatch(rw, withObjectParams(req, rel.Child, childID))
+
+	case http.MethodDelete:
+		a.handleDelete(rw, withObjectParams(req, rel.Child, childID))
+	}
+}
+
+// authorizeChild checks a write to a relation against the security
+// requirements of the same write to the child collection, at path. It answers
+// the request and returns false when the write is not authorized.
+func (a *api) authorizeChild(rw http.ResponseWriter, req *http.Request, path string) bool {
+	if _, err := a.authorizeOperation(req, req.Method, path); err != nil {
+		writeAuthError(rw, err)
+		return false
+	}
+
+	return true
+}
+
+func (a *api) resolveRelation(rw http.ResponseWriter, req *http.Request) (relationConfig, string, bool) {
+	objType := chi.URLParam(req, "objType")
+	objID := chi.URLParam(req, "objId")
+
+	rel, ok := a.relation(objType, chi.URLParam(req, "relation"))
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return relationConfig{}, "", false
+	}
+
+	if _, err := a.getObject(objType, objID); err != nil {
+		JSONError(rw, http.StatusNotFound, err.Error())
+		return relationConfig{}, "", false
+	}
+
+	return rel, objID, true
+}
+
+// withObjectParams returns a copy of req routed to objType/objID.
+func withObjectParams(req *http.Request, objType, objID string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("objType", objType)
+	if objID != "" {
+		rctx.URLParams.Add("objId", objID)
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func withJSONBody(req *http.Request, obj map[string]interface{}) (*http.Request, error) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Type", mediaTypeJSON)
+
+	return r, nil
+}
+
+// withPinnedField appends an operation to the JSON patch of req, so that
+// field keeps its value whatever the patch does.
+func withPinnedField(req *http.Request, field, value string) (*http.Request, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []json.RawMessage
+	if err = json.Unmarshal(body, &ops); err == nil {
+		op, err := json.Marshal(map[string]string{"op": "add", "path": "/" + escapePointer(field), "value": value})
+		if err != nil {
+			return nil, err
+		}
+
+		body, err = json.Marshal(append(ops, op))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Invalid patches are left for the patch handler to report.
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return r, nil
+}
+
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func refersTo(value interface{}, id string) bool {
+	return value != nil && fmt.Sprint(value) == id
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRelationsAPI(t *testing.T, onDelete string) (*api, *httptest.Server) {
+	t.Helper()
+
+	a := &api{
+		data: map[string]map[string]json.RawMessage{
+			"cities": {
+				"lyon":  json.RawMessage(`{"name":"Lyon"}`),
+				"paris": json.RawMessage(`{"name":"Paris"}`),
+			},
+			"forecasts": {
+				"1": json.RawMessage(`{"cityId":"lyon","weather":"Sunny"}`),
+				"2": json.RawMessage(`{"cityId":"lyon","weather":"Cloudy"}`),
+				"3": json.RawMessage(`{"cityId":"paris","weather":"Rainy"}`),
+			},
+		},
+	}
+	require.NoError(t, a.configure(&config{Relations: []relationConfig{{
+		Name:       "forecasts",
+		Parent:     "cities",
+		Child:      "forecasts",
+		ForeignKey: "cityId",
+		Integrity:  true,
+		OnDelete:   onDelete,
+	}}}))
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	return a, srv
+}
+
+func doRequest(t *testing.T, method, url, contentType, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	return resp
+}
+
+func Test_validateRelations(t *testing.T) {
+	assert.NoError(t, validateRelations([]relationConfig{{Name: "n", Parent: "p", Child: "c", ForeignKey: "f", OnDelete: "cascade"}}))
+	assert.Error(t, validateRelations([]relationConfig{{Name: "n", Parent: "p", Child: "c"}}))
+	assert.Error(t, validateRelations([]relationConfig{{Name: "n", Parent: "p", Child: "c", ForeignKey: "f", OnDelete: "nullify"}}))
+}
+
+func Test_handleGetRelated(t *testing.T) {
+	_, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/cities/lyon/forecasts", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var forecasts []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&forecasts))
+	assert.ElementsMatch(t, []map[string]interface{}{
+		{"id": "1", "cityId": "lyon", "weather": "Sunny"},
+		{"id": "2", "cityId": "lyon", "weather": "Cloudy"},
+	}, forecasts)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/cities/lyon/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/cities/nantes/forecasts", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_handlePostRelated(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/cities/paris/forecasts", "application/json", `{"cityId":"lyon","weather":"Windy"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var created map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+	raw, err := a.getObject("forecasts", created["id"].(string))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cityId":"paris","weather":"Windy"}`, string(raw))
+}
+
+func Test_handleRelated(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/cities/lyon/forecasts/1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/cities/lyon/forecasts/3", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/cities/lyon/forecasts/1", "application/json-patch+json",
+		`[{"op":"replace","path":"/cityId","value":"paris"},{"op":"replace","path":"/weather","value":"Foggy"}]`)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	raw, err := a.getObject("forecasts", "1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cityId":"lyon","weather":"Foggy"}`, string(raw))
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/cities/lyon/forecasts/2", "application/json", `{"weather":"Hot"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	raw, err = a.getObject("forecasts", "2")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cityId":"lyon","weather":"Hot"}`, string(raw))
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/cities/lyon/forecasts/2", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_, err = a.getObject("forecasts", "2")
+	assert.Error(t, err)
+}
+
+func Test_include(t *testing.T) {
+	_, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/cities/paris?include=forecasts", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var city map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&city))
+	assert.Equal(t, map[string]interface{}{
+		"name":      "Paris",
+		"forecasts": []interface{}{map[string]interface{}{"id": "3", "cityId": "paris", "weather": "Rainy"}},
+	}, city)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/forecasts/3?include=cities", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var forecast map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&forecast))
+	assert.Equal(t, map[string]interface{}{"id": "paris", "name": "Paris"}, forecast["cities"])
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/cities?include=unknown", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_referentialIntegrity(t *testing.T) {
+	_, srv := newRelationsAPI(t, "")
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/forecasts", "application/json", `{"cityId":"nantes","weather":"Sunny"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/forecasts/1", "application/json", `{"weather":"Sunny"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/forecasts/1", mediaTypeJSONPatch, `[{"op":"replace","path":"/cityId","value":"nantes"}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/forecasts/1", mediaTypeJSONPatch, `[{"op":"replace","path":"/cityId","value":"paris"}]`)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func Test_handleDelete_onDelete(t *testing.T) {
+	tests := []struct {
+		desc              string
+		onDelete          string
+		expected          int
+		expectedForecasts int
+	}{
+		{desc: "no action", expected: http.StatusNoContent, expectedForecasts: 3},
+		{desc: "restrict", onDelete: onDeleteRestrict, expected: http.StatusConflict, expectedForecasts: 3},
+		{desc: "cascade", onDelete: onDeleteCascade, expected: http.StatusNoContent, expectedForecasts: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			a, srv := newRelationsAPI(t, test.onDelete)
+
+			resp := doRequest(t, http.MethodDelete, srv.URL+"/cities/lyon", "", "")
+			assert.Equal(t, test.expected, resp.StatusCode)
+
+			forecasts, ok := a.listObjects("forecasts")
+			require.True(t, ok)
+			assert.Len(t, forecasts, test.expectedForecasts)
+		})
+	}
+}
+
+const relationsAuthSpec = `openapi: "3.0.0"
+info:
+  version: 1.0.0
+  title: Forecasts
+paths:
+  /forecasts:
+    post:
+      security:
+        - bearerAuth: []
+      responses:
+        '201':
+          description: The created forecast
+  /forecasts/{id}:
+    put:
+      security:
+        - bearerAuth: []
+      responses:
+        '200':
+          description: The forecast
+    patch:
+      security:
+        - bearerAuth: []
+      responses:
+        '204':
+          description: Patched
+    delete:
+      security:
+        - bearerAuth: []
+      responses:
+        '204':
+          description: Deleted
+components:
+  securitySchemes:
+    bearerAuth:
+      type: http
+      scheme: bearer
+`
+
+func Test_relations_authorization(t *testing.T) {
+	a, srv := newRelationsAPI(t, "")
+
+	var err error
+	a.auth, err = newAuthenticator(authConfig{})
+	require.NoError(t, err)
+
+	specPath := filepath.Join(t.TempDir(), "openapi.yaml")
+	require.NoError(t, os.WriteFile(specPath, []byte(relationsAuthSpec), 0o600))
+	require.NoError(t, a.loadOpenAPISpec(specPath))
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{method: http.MethodGet, path: "/cities/lyon/forecasts/1", expected: http.StatusOK},
+		{method: http.MethodPost, path: "/cities/lyon/forecasts", expected: http.StatusUnauthorized},
+		{method: http.MethodPut, path: "/cities/lyon/forecasts/1", expected: http.StatusUnauthorized},
+		{method: http.MethodPatch, path: "/cities/lyon/forecasts/1", expected: http.StatusUnauthorized},
+		{method: http.MethodDelete, path: "/cities/lyon/forecasts/1", expected: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			resp := doRequest(t, test.method, srv.URL+test.path, "application/json", `{"weather":"Hot"}`)
+			assert.Equal(t, test.expected, resp.StatusCode)
+		})
+	}
+
+	raw, err := a.getObject("forecasts", "1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cityId":"lyon","weather":"Sunny"}`, string(raw))
+	assert.Len(t, a.data["forecasts"], 3)
+}
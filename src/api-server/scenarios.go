@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// scenarioStarted is the state of the scenarios until their first
+// transition.
+const scenarioStarted = "Started"
+
+// scenarioConfig describes a state machine: its rules answer the requests
+// they match, or let them through, depending on the current state, and move
+// the scenario to a new state.
+type scenarioConfig struct {
+	Name string `yaml:"name"`
+	// States sets a timeout on some states, after which the scenario moves
+	// to another state by itself.
+	States map[string]scenarioStateConfig `yaml:"states"`
+	Rules  []scenarioRule                 `yaml:"rules"`
+}
+
+type scenarioStateConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+	Next    string        `yaml:"next"`
+}
+
+type scenarioRule struct {
+	// State is the state in which the rule applies, any state when empty.
+	State   string          `yaml:"state"`
+	Request scenarioRequest `yaml:"request"`
+	// Response answers the request. Without response, the request is
+	// handled by the API.
+	Response *scenarioResponse `yaml:"response"`
+	NewState string            `yaml:"newState"`
+}
+
+type scenarioRequest struct {
+	Method string `yaml:"method"`
+	// Path is a pattern, as understood by path.Match.
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type scenarioResponse struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is sent as is when it is a string, and encoded in JSON otherwise.
+	Body  interface{}   `yaml:"body"`
+	Delay time.Duration `yaml:"delay"`
+}
+
+func validateScenarios(scenarios []scenarioConfig) error {
+	names := map[string]bool{}
+	for _, s := range scenarios {
+		if s.Name == "" {
+			return errors.New("scenario without name")
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicated scenario %q", s.Name)
+		}
+		names[s.Name] = true
+
+		for state, stateCfg := range s.States {
+			if stateCfg.Timeout <= 0 || stateCfg.Next == "" {
+				return fmt.Errorf("scenario %q: state %q must have a timeout and a next state", s.Name, state)
+			}
+		}
+
+		for i, rule := range s.Rules {
+			if _, err := path.Match(rule.Request.Path, ""); err != nil {
+				return fmt.Errorf("scenario %q, rule %d: invalid path %q: %w", s.Name, i, rule.Request.Path, err)
+			}
+			if rule.Response != nil && rule.Response.Status != 0 && (rule.Response.Status < 100 || rule.Response.Status > 599) {
+				return fmt.Errorf("scenario %q, rule %d: invalid status %d", s.Name, i, rule.Response.Status)
+			}
+			if rule.Response == nil && rule.NewState == "" {
+				return fmt.Errorf("scenario %q, rule %d: a rule needs a response or a new state", s.Name, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r scenarioRequest) matches(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	for name, value := range r.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scenarioState is the state of a scenario, as reported by /_scenarios.
+type scenarioState struct {
+	Name  string    `json:"name"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// Expires is when the state times out, if it does.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// scenarioEngine holds the current state of the scenarios.
+type scenarioEngine struct {
+	mu        sync.Mutex
+	scenarios []scenarioConfig
+	states    map[string]*scenarioState
+}
+
+func (e *scenarioEngine) configure(scenarios []scenarioConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.scenarios = scenarios
+	e.reset(time.Now())
+}
+
+// reset moves all the scenarios back to their initial state.
+func (e *scenarioEngine) reset(now time.Time) {
+	e.states = make(map[string]*scenarioState, len(e.scenarios))
+	for _, s := range e.scenarios {
+		e.states[s.Name] = &scenarioState{Name: s.Name, State: scenarioStarted, Since: now}
+	}
+}
+
+// current returns the state of s, after the timeouts elapsed since the last
+// transition.
+func (e *scenarioEngine) current(s scenarioConfig, now time.Time) *scenarioState {
+	state := e.states[s.Name]
+
+	// Timeouts may chain, up to a loop of states.
+	for range len(s.States) + 1 {
+		stateCfg, ok := s.States[state.State]
+		if !ok || now.Sub(state.Since) < stateCfg.Timeout {
+			break
+		}
+
+		state.State = stateCfg.Next
+		state.Since = state.Since.Add(stateCfg.Timeout)
+	}
+
+	state.Expires = nil
+	if stateCfg, ok := s.States[state.State]; ok {
+		expires := state.Since.Add(stateCfg.Timeout)
+		state.Expires = &expires
+	}
+
+	return state
+}
+
+// apply moves each scenario according to its first rule matching req, and
+// returns the response of the first of these rules having one.
+func (e *scenarioEngine) apply(req *http.Request) *scenarioResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+
+	var resp *scenarioResponse
+	for _, s := range e.scenarios {
+		state := e.current(s, now)
+
+		for _, rule := range s.Rules {
+			if (rule.State != "" && rule.State != state.State) || !rule.Request.matches(req) {
+				continue
+			}
+
+			if rule.NewState != "" && rule.NewState != state.State {
+				state.State = rule.NewState
+				state.Since = now
+			}
+			if resp == nil {
+				resp = rule.Response
+			}
+			break
+		}
+	}
+
+	return resp
+}
+
+func (e *scenarioEngine) list() []scenarioState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	states := make([]scenarioState, 0, len(e.scenarios))
+	for _, s := range e.scenarios {
+		states = append(states, *e.current(s, now))
+	}
+
+	return states
+}
+
+func (e *scenarioEngine) get(name string) (scenarioState, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range e.scenarios {
+		if s.Name == name {
+			return *e.current(s, time.Now()), true
+		}
+	}
+
+	return scenarioState{}, false
+}
+
+func (e *scenarioEngine) set(name, state string) (scenarioState, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range e.scenarios {
+		if s.Name == name {
+			current := e.states[name]
+			current.State = state
+			current.Since = time.Now()
+
+			return *e.current(s, current.Since), true
+		}
+	}
+
+	return scenarioState{}, false
+}
+
+// scenarioMiddleware answers the requests with the responses of the
+// scenarios, and lets through the ones they do not answer.
+func (a *api) scenarioMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			resp := a.scenarios.apply(r)
+			if resp == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if resp.Delay > 0 {
+				select {
+				case <-time.After(resp.Delay):
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			writeScenarioResponse(w, resp)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func writeScenarioResponse(rw http.ResponseWriter, resp *scenarioResponse) {
+	var body []byte
+	switch b := resp.Body.(type) {
+	case nil:
+	case string:
+		body = []byte(b)
+	default:
+		var err error
+		body, err = json.Marshal(b)
+		if err != nil {
+			JSONError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+	}
+
+	for name, value := range resp.Headers {
+		rw.Header().Set(name, value)
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
+
+func (a *api) handleGetScenarios(rw http.ResponseWriter, _ *http.Request) {
+	writeJSONResponse(rw, http.StatusOK, a.scenarios.list())
+}
+
+func (a *api) handleGetScenario(rw http.ResponseWriter, req *http.Request) {
+	state, ok := a.scenarios.get(chi.URLParam(req, "scenario"))
+	if !ok {
+		JSONError(rw, http.StatusNotFound, "scenario not found")
+		return
+	}
+
+	writeJSONResponse(rw, http.StatusOK, state)
+}
+
+// handlePutScenarioState moves a scenario to the given state.
+func (a *api) handlePutScenarioState(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		JSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.State == "" {
+		JSONError(rw, http.StatusBadRequest, "missing state")
+		return
+	}
+
+	state, ok := a.scenarios.set(chi.URLParam(req, "scenario"), body.State)
+	if !ok {
+		JSONError(rw, http.StatusNotFound, "scenario not found")
+		return
+	}
+
+	writeJSONResponse(rw, http.StatusOK, state)
+}
+
+// handleResetScenarios moves all the scenarios back to their initial state.
+func (a *api) handleResetScenarios(rw http.ResponseWriter, _ *http.Request) {
+	a.scenarios.mu.Lock()
+	a.scenarios.reset(time.Now())
+	a.scenarios.mu.Unlock()
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func newScenariosAPI(t *testing.T, rawConfig string) (*api, *httptest.Server) {
+	t.Helper()
+
+	cfg := &config{}
+	require.NoError(t, yaml.Unmarshal([]byte(rawConfig), cfg))
+
+	return newTestServer(t, cfg)
+}
+
+func Test_validateScenarios(t *testing.T) {
+	assert.NoError(t, validateScenarios([]scenarioConfig{{Name: "s", Rules: []scenarioRule{{NewState: "next"}}}}))
+	assert.Error(t, validateScenarios([]scenarioConfig{{Rules: []scenarioRule{{NewState: "next"}}}}))
+	assert.Error(t, validateScenarios([]scenarioConfig{{Name: "s"}, {Name: "s"}}))
+	assert.Error(t, validateScenarios([]scenarioConfig{{Name: "s", Rules: []scenarioRule{{}}}}))
+	assert.Error(t, validateScenarios([]scenarioConfig{{Name: "s", Rules: []scenarioRule{{Request: scenarioRequest{Path: "/["}, NewState: "next"}}}}))
+	assert.Error(t, validateScenarios([]scenarioConfig{{Name: "s", Rules: []scenarioRule{{Response: &scenarioResponse{Status: 42}}}}}))
+	assert.Error(t, validateScenarios([]scenarioConfig{{Name: "s", States: map[string]scenarioStateConfig{"down": {Next: scenarioStarted}}}}))
+}
+
+func Test_scenarios_failThenSucceed(t *testing.T) {
+	_, srv := newScenariosAPI(t, `
+scenarios:
+  - name: flaky
+    rules:
+      - state: Started
+        request: {method: GET, path: /weather/*}
+        response: {status: 500, body: {error: boom}}
+        newState: failed-once
+      - state: failed-once
+        request: {method: GET, path: /weather/*}
+        response: {status: 502, body: bad gateway}
+        newState: recovered
+`)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"error":"boom"}`, string(body))
+
+	// Requests matching no rule are not counted.
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "bad gateway", string(body))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_scenarios/flaky", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var state scenarioState
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Equal(t, "recovered", state.State)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/_scenarios/reset", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func Test_scenarios_trigger(t *testing.T) {
+	_, srv := newScenariosAPI(t, `
+scenarios:
+  - name: maintenance
+    states:
+      down: {timeout: 30s, next: Started}
+    rules:
+      - request: {method: POST, path: /weather, headers: {X-Trigger: maintenance}}
+        response: {status: 202}
+        newState: down
+      - state: down
+        response:
+          status: 503
+          headers: {Retry-After: "30"}
+`)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/weather", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Trigger", "maintenance")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/_scenarios", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var states []scenarioState
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&states))
+	require.Len(t, states, 1)
+	assert.Equal(t, "down", states[0].State)
+	require.NotNil(t, states[0].Expires)
+	assert.Equal(t, states[0].Since.Add(30*time.Second), *states[0].Expires)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/_scenarios/maintenance/state", "application/json", `{"state":"Started"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/_scenarios/unknown/state", "application/json", `{"state":"Started"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/_scenarios/maintenance/state", "application/json", `{}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_scenarioEngine_timeouts(t *testing.T) {
+	var e scenarioEngine
+	e.configure([]scenarioConfig{{
+		Name: "s",
+		States: map[string]scenarioStateConfig{
+			scenarioStarted: {Timeout: time.Minute, Next: "a"},
+			"a":             {Timeout: time.Minute, Next: "b"},
+		},
+	}})
+
+	since := e.states["s"].Since
+
+	state := e.current(e.scenarios[0], since.Add(30*time.Second))
+	assert.Equal(t, scenarioStarted, state.State)
+
+	state = e.current(e.scenarios[0], since.Add(90*time.Second))
+	assert.Equal(t, "a", state.State)
+	assert.Equal(t, since.Add(time.Minute), state.Since)
+
+	state = e.current(e.scenarios[0], since.Add(time.Hour))
+	assert.Equal(t, "b", state.State)
+	assert.Equal(t, since.Add(2*time.Minute), state.Since)
+	assert.Nil(t, state.Expires)
+}
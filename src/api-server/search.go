@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// searchRequest is a query of /{objType}/_search, given as the JSON body of a
+// POST, or with the filter, groupBy and count query parameters of a GET.
+type searchRequest struct {
+	// Filter is an expression selecting the records, as parsed by
+	// parseQuery. All records are selected without filter.
+	Filter string `json:"filter"`
+	// GroupBy lists the fields to group the selected records by, which are
+	// then counted per group.
+	GroupBy []string `json:"groupBy"`
+	// Count only counts the selected records.
+	Count bool `json:"count"`
+}
+
+type searchGroup struct {
+	Group map[string]interface{} `json:"group"`
+	Count int                    `json:"count"`
+}
+
+func validateIndexes(indexes map[string][]string) error {
+	for collection, fields := range indexes {
+		for _, field := range fields {
+			if !validFieldPath(field) {
+				return fmt.Errorf("index of %q: invalid field %q", collection, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validFieldPath reports whether field is a dotted path of record fields.
+func validFieldPath(field string) bool {
+	return field != "" && !strings.HasPrefix(field, ".") && !strings.HasSuffix(field, ".") && !strings.Contains(field, "..")
+}
+
+// searchIndexes indexes the records of some collections by the values of some
+// of their fields, to speed up the searches on equality. They are built on
+// first use and kept up to date by the event bus.
+type searchIndexes struct {
+	mu     sync.Mutex
+	fields map[string][]string
+	// values maps the collections to the fields to the JSON encoded values to
+	// the IDs of the records.
+	values map[string]map[string]map[string]map[string]bool
+}
+
+func (s *searchIndexes) configure(indexes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fields = indexes
+	s.values = map[string]map[string]map[string]map[string]bool{}
+}
+
+func (s *searchIndexes) enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.fields) > 0
+}
+
+// reset drops the indexes, which are built again on next use.
+func (s *searchIndexes) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = map[string]map[string]map[string]map[string]bool{}
+}
+
+// record updates the indexes with evt. It is called by the event bus while the
+// records are locked.
+func (s *searchIndexes) record(evt event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index, ok := s.values[evt.Collection]
+	if !ok {
+		return
+	}
+
+	for _, ids := range index {
+		for key, set := range ids {
+			delete(set, evt.ObjectID)
+			if len(set) == 0 {
+				delete(ids, key)
+			}
+		}
+	}
+
+	if evt.Type == eventDeleted {
+		return
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(evt.Object, &doc); err != nil {
+		return
+	}
+	s.add(evt.Collection, evt.ObjectID, doc)
+}
+
+func (s *searchIndexes) add(collection, id string, doc map[string]interface{}) {
+	doc["id"] = id
+	for _, field := range s.fields[collection] {
+		key := indexKey(lookupField(doc, strings.Split(field, ".")))
+		ids := s.values[collection][field]
+		if ids[key] == nil {
+			ids[key] = map[string]bool{}
+		}
+		ids[key][id] = true
+	}
+}
+
+// lookup returns the IDs of the records of collection whose field holds one
+// of values. It reports false when the field is not indexed. The records
+// must be locked, so that the index is built from their current state.
+func (s *searchIndexes) lookup(collection, field string, values []interface{}, objs map[string]json.RawMessage) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexed := false
+	for _, f := range s.fields[collection] {
+		indexed = indexed || f == field
+	}
+	if !indexed {
+		return nil, false
+	}
+
+	if _, ok := s.values[collection]; !ok {
+		s.values[collection] = map[string]map[string]map[string]bool{}
+		for _, f := range s.fields[collection] {
+			s.values[collection][f] = map[string]map[string]bool{}
+		}
+		for id, obj := range objs {
+			var doc map[string]interface{}
+			if err := json.Unmarshal(obj, &doc); err != nil {
+				continue
+			}
+			s.add(collection, id, doc)
+		}
+	}
+
+	seen := map[string]bool{}
+	var ids []string
+	for _, v := range values {
+		for id := range s.values[collection][field][indexKey(v)] {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, true
+}
+
+// indexKey returns the key of a value in the indexes. Values decoded from JSON
+// always encode.
+func indexKey(v interface{}) string {
+	key, _ := json.Marshal(v)
+
+	return string(key)
+}
+
+// indexTerm is a term of a filter, which the records matching the filter
+// must match: their field holds one of the values.
+type indexTerm struct {
+	field  string
+	values []interface{}
+}
+
+// indexTerms returns the terms of expr which an index can resolve.
+func indexTerms(expr queryExpr) []indexTerm {
+	switch e := expr.(type) {
+	case andExpr:
+		return append(indexTerms(e.left), indexTerms(e.right)...)
+
+	case compareExpr:
+		if e.op != "==" {
+			return nil
+		}
+		field, isField := e.left.(fieldOperand)
+		value, isLiteral := literal(e.right)
+		if !isField || !isLiteral {
+			field, isField = e.right.(fieldOperand)
+			value, isLiteral = literal(e.left)
+		}
+		if isField && isLiteral {
+			return []indexTerm{{field: strings.Join(field.path, "."), values: []interface{}{value}}}
+		}
+
+	case inExpr:
+		field, isField := e.left.(fieldOperand)
+		values, isLiteral := literal(e.values)
+		if list, isList := values.([]interface{}); isField && isLiteral && isList {
+			return []indexTerm{{field: strings.Join(field.path, "."), values: list}}
+		}
+	}
+
+	return nil
+}
+
+// search returns the records of objType matching filter, sorted by ID. It
+// reports false when the collection does not exist.
+func (a *api) search(objType string, filter queryExpr) ([]map[string]interface{}, bool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	objs, ok := a.data[objType]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var ids []string
+	indexed := false
+	if filter != nil && a.indexes.enabled() {
+		for _, term := range indexTerms(filter) {
+			if ids, indexed = a.indexes.lookup(objType, term.field, term.values, objs); indexed {
+				break
+			}
+		}
+	}
+	if !indexed {
+		ids = make([]string, 0, len(objs))
+		for id := range objs {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	docs := []map[string]interface{}{}
+	for _, id := range ids {
+		obj, ok := objs[id]
+		if !ok {
+			continue
+		}
+
+		var doc map[string]interface{}
+		if err := json.Unmarshal(obj, &doc); err != nil {
+			return nil, true, err
+		}
+		doc["id"] = id
+
+		if filter == nil || filter.eval(doc) {
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs, true, nil
+}
+
+// groupRecords counts the records per value of the fields.
+func groupRecords(docs []map[string]interface{}, fields []string) []searchGroup {
+	paths := make([][]string, len(fields))
+	for i, field := range fields {
+		paths[i] = strings.Split(field, ".")
+	}
+
+	var keys []string
+	groups := map[string]*searchGroup{}
+	for _, doc := range docs {
+		group := make(map[string]interface{}, len(fields))
+		for i, field := range fields {
+			group[field] = lookupField(doc, paths[i])
+		}
+
+		key := indexKey(group)
+		if _, ok := groups[key]; !ok {
+			groups[key] = &searchGroup{Group: group}
+			keys = append(keys, key)
+		}
+		groups[key].Count++
+	}
+
+	sort.Strings(keys)
+
+	result := make([]searchGroup, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *groups[key])
+	}
+
+	return result
+}
+
+func parseSearchRequest(req *http.Request) (searchRequest, error) {
+	var search searchRequest
+
+	if req.Method == http.MethodPost {
+		if err := json.NewDecoder(req.Body).Decode(&search); err != nil {
+			return search, fmt.Errorf("invalid search: %w", err)
+		}
+		return search, nil
+	}
+
+	query := req.URL.Query()
+	search.Filter = query.Get("filter")
+	for _, value := range query["groupBy"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				search.GroupBy = append(search.GroupBy, field)
+			}
+		}
+	}
+	if value := query.Get("count"); value != "" {
+		count, err := strconv.ParseBool(value)
+		if err != nil {
+			return search, fmt.Errorf("invalid count %q", value)
+		}
+		search.Count = count
+	}
+
+	return search, nil
+}
+
+// handleSearch lists the records of a collection matching a filter
+// expression, or counts them, possibly per group.
+func (a *api) handleSearch(rw http.ResponseWriter, req *http.Request) {
+	objType := chi.URLParam(req, "objType")
+
+	search, err := parseSearchRequest(req)
+	if err != nil {
+		JSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var filter queryExpr
+	if strings.TrimSpace(search.Filter) != "" {
+		filter, err = parseQuery(search.Filter)
+		if err != nil {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid filter: %v", err))
+			return
+		}
+	}
+	for _, field := range search.GroupBy {
+		if !validFieldPath(field) {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid groupBy field %q", field))
+			return
+		}
+	}
+
+	c, err := responseCodec(req, true)
+	if err != nil {
+		JSONError(rw, http.StatusNotAcceptable, err.Error())
+		return
+	}
+
+	docs, ok, err := a.search(objType, filter)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		JSONError(rw, http.StatusNotFound, fmt.Sprintf("collection %s %s", objType, errRecordNotFound))
+		return
+	}
+
+	switch {
+	case len(search.GroupBy) > 0:
+		writeJSONResponse(rw, http.StatusOK, groupRecords(docs, search.GroupBy))
+
+	case search.Count:
+		writeJSONResponse(rw, http.StatusOK, map[string]int{"count": len(docs)})
+
+	default:
+		for _, doc := range docs {
+			if err := a.embed(objType, doc["id"].(string), doc, includes(req)); err != nil {
+				JSONError(rw, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		c.write(rw, http.StatusOK, docs)
+	}
+}
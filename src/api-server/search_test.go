@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSearchAPI(t *testing.T, indexes map[string][]string) (*api, *httptest.Server) {
+	t.Helper()
+
+	a := &api{
+		data: map[string]map[string]json.RawMessage{
+			"weather": {
+				"0": json.RawMessage(`{"city":"GopherCity","weather":"Moderate rain","temperature":12}`),
+				"1": json.RawMessage(`{"city":"City of Gophers","weather":"Sunny","temperature":24}`),
+				"2": json.RawMessage(`{"city":"GopherRocks","weather":"Cloudy","temperature":17}`),
+				"3": json.RawMessage(`{"city":"GopherCity","weather":"Sunny","temperature":21}`),
+			},
+		},
+	}
+	require.NoError(t, a.configure(&config{Indexes: indexes}))
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	return a, srv
+}
+
+func searchIDs(t *testing.T, resp *http.Response) []string {
+	t.Helper()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var docs []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&docs))
+
+	ids := []string{}
+	for _, doc := range docs {
+		ids = append(ids, doc["id"].(string))
+	}
+
+	return ids
+}
+
+func Test_search(t *testing.T) {
+	_, srv := newSearchAPI(t, nil)
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{filter: ``, want: []string{"0", "1", "2", "3"}},
+		{filter: `weather == "Sunny"`, want: []string{"1", "3"}},
+		{filter: `weather == "Sunny" and temperature > 22`, want: []string{"1"}},
+		{filter: `city =~ "^Gopher" and not weather in ["Sunny", "Cloudy"]`, want: []string{"0"}},
+		{filter: `city contains "Gophers" or id == "2"`, want: []string{"1", "2"}},
+		{filter: `temperature < 0`, want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			resp := doRequest(t, http.MethodGet, srv.URL+"/weather/_search?filter="+url.QueryEscape(test.filter), "", "")
+			assert.Equal(t, test.want, searchIDs(t, resp))
+
+			body, err := json.Marshal(searchRequest{Filter: test.filter})
+			require.NoError(t, err)
+
+			resp = doRequest(t, http.MethodPost, srv.URL+"/weather/_search", mediaTypeJSON, string(body))
+			assert.Equal(t, test.want, searchIDs(t, resp))
+		})
+	}
+}
+
+func Test_search_aggregate(t *testing.T) {
+	_, srv := newSearchAPI(t, nil)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/_search?count=true&filter="+url.QueryEscape(`temperature >= 17`), "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var count map[string]int
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&count))
+	assert.Equal(t, map[string]int{"count": 3}, count)
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/weather/_search", mediaTypeJSON, `{"filter":"city != \"GopherRocks\"","groupBy":["city","weather"]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var groups []searchGroup
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&groups))
+	assert.Equal(t, []searchGroup{
+		{Group: map[string]interface{}{"city": "City of Gophers", "weather": "Sunny"}, Count: 1},
+		{Group: map[string]interface{}{"city": "GopherCity", "weather": "Moderate rain"}, Count: 1},
+		{Group: map[string]interface{}{"city": "GopherCity", "weather": "Sunny"}, Count: 1},
+	}, groups)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/_search?groupBy=weather", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	groups = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&groups))
+	assert.Equal(t, []searchGroup{
+		{Group: map[string]interface{}{"weather": "Cloudy"}, Count: 1},
+		{Group: map[string]interface{}{"weather": "Moderate rain"}, Count: 1},
+		{Group: map[string]interface{}{"weather": "Sunny"}, Count: 2},
+	}, groups)
+}
+
+func Test_search_invalid(t *testing.T) {
+	_, srv := newSearchAPI(t, nil)
+
+	tests := []struct {
+		desc   string
+		method string
+		query  string
+		body   string
+		status int
+	}{
+		{desc: "invalid filter", method: http.MethodGet, query: "?filter=" + url.QueryEscape(`city ==`), status: http.StatusBadRequest},
+		{desc: "invalid count", method: http.MethodGet, query: "?count=maybe", status: http.StatusBadRequest},
+		{desc: "invalid groupBy", method: http.MethodGet, query: "?groupBy=city..name", status: http.StatusBadRequest},
+		{desc: "invalid body", method: http.MethodPost, body: `filter`, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			resp := doRequest(t, test.method, srv.URL+"/weather/_search"+test.query, mediaTypeJSON, test.body)
+			assert.Equal(t, test.status, resp.StatusCode)
+		})
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/unknown/_search", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_search_indexes(t *testing.T) {
+	assert.Error(t, validateIndexes(map[string][]string{"weather": {"city."}}))
+
+	a, srv := newSearchAPI(t, map[string][]string{"weather": {"city", "station.name"}})
+
+	objs := a.data["weather"]
+	ids, ok := a.indexes.lookup("weather", "city", []interface{}{"GopherCity", "GopherRocks"}, objs)
+	require.True(t, ok)
+	assert.ElementsMatch(t, []string{"0", "2", "3"}, ids)
+
+	ids, ok = a.indexes.lookup("weather", "station.name", []interface{}{nil}, objs)
+	require.True(t, ok)
+	assert.Len(t, ids, 4)
+
+	_, ok = a.indexes.lookup("weather", "weather", []interface{}{"Sunny"}, objs)
+	assert.False(t, ok)
+
+	filter := url.QueryEscape(`city == "GopherCity" and weather == "Sunny"`)
+	resp := doRequest(t, http.MethodGet, srv.URL+"/weather/_search?filter="+filter, "", "")
+	assert.Equal(t, []string{"3"}, searchIDs(t, resp))
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/weather/1", mediaTypeJSON, `{"city":"GopherCity","weather":"Sunny"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/weather/3", "", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/_search?filter="+filter, "", "")
+	assert.Equal(t, []string{"1"}, searchIDs(t, resp))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/_search?filter="+url.QueryEscape(`city in ["City of Gophers"]`), "", "")
+	assert.Equal(t, []string{}, searchIDs(t, resp))
+}
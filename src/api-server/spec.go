@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var specMethods = []string{
+	http.MethodGet,
+	http.MethodPut,
+	http.MethodPost,
+	http.MethodDelete,
+	http.MethodOptions,
+	http.MethodHead,
+	http.MethodPatch,
+	http.MethodTrace,
+}
+
+// specDocument is the subset of an OpenAPI document the server acts upon.
+type specDocument struct {
+	Security   []securityRequirement `json:"security"`
+	Components struct {
+		SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+	} `json:"components"`
+
+	operations []*specOperation
+}
+
+// securityRequirement maps security scheme names to the scopes they require.
+type securityRequirement map[string][]string
+
+type securityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+	Name   string `json:"name"`
+	In     string `json:"in"`
+}
+
+type specOperation struct {
+	Method      string                 `json:"-"`
+	Path        string                 `json:"-"`
+	OperationID string                 `json:"operationId"`
+	Security    *[]securityRequirement `json:"security"`
+	Deprecated  bool                   `json:"deprecated"`
+
+	// DeprecationDate, Sunset and SuccessorVersion come from the
+	// x-deprecation-date, x-sunset and x-successor-version extensions.
+	DeprecationDate  string `json:"x-deprecation-date"`
+	Sunset           string `json:"x-sunset"`
+	SuccessorVersion string `json:"x-successor-version"`
+
+	segments []string
+}
+
+func parseSpecDocument(raw json.RawMessage) (*specDocument, error) {
+	var doc struct {
+		specDocument
+
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(raw, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for path, item := range doc.Paths {
+		for _, method := range specMethods {
+			rawOp, ok := item[strings.ToLower(method)]
+			if !ok {
+				continue
+			}
+
+			op := &specOperation{}
+			err = json.Unmarshal(rawOp, op)
+			if err != nil {
+				return nil, err
+			}
+
+			op.Method = method
+			op.Path = path
+			op.segments = strings.Split(strings.Trim(path, "/"), "/")
+			doc.operations = append(doc.operations, op)
+		}
+	}
+
+	// Literal segments take precedence over templated ones, so that
+	// "/weather/current" is preferred to "/weather/{id}".
+	sort.SliceStable(doc.operations, func(i, j int) bool {
+		return literalSegments(doc.operations[i].segments) > literalSegments(doc.operations[j].segments)
+	})
+
+	return &doc.specDocument, nil
+}
+
+// findOperation returns the operation declared for the given method and
+// request path, if any.
+func (d *specDocument) findOperation(method, path string) *specOperation {
+	if d == nil {
+		return nil
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, op := range d.operations {
+		if op.Method == method && matchSegments(op.segments, segments) {
+			return op
+		}
+	}
+
+	return nil
+}
+
+// securityFor returns the security requirements applying to the operation.
+// Operation level requirements override the document level ones.
+func (d *specDocument) securityFor(op *specOperation) []securityRequirement {
+	if op != nil && op.Security != nil {
+		return *op.Security
+	}
+
+	return d.Security
+}
+
+func matchSegments(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+
+	for i, segment := range template {
+		if isTemplateSegment(segment) {
+			continue
+		}
+		if segment != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func literalSegments(segments []string) int {
+	var n int
+	for _, segment := range segments {
+		if !isTemplateSegment(segment) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func isTemplateSegment(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_findOperation(t *testing.T) {
+	a := api{}
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi-auth.yaml"))
+
+	tests := []struct {
+		desc     string
+		method   string
+		path     string
+		expected string
+	}{
+		{desc: "collection", method: http.MethodGet, path: "/weather", expected: "getAll"},
+		{desc: "templated", method: http.MethodGet, path: "/weather/0", expected: "get"},
+		{desc: "literal over templated", method: http.MethodGet, path: "/weather/public", expected: "getPublic"},
+		{desc: "unknown method", method: http.MethodDelete, path: "/weather/0"},
+		{desc: "unknown path", method: http.MethodGet, path: "/forecast"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			op := a.specDoc.findOperation(test.method, test.path)
+			if test.expected == "" {
+				assert.Nil(t, op)
+				return
+			}
+
+			require.NotNil(t, op)
+			assert.Equal(t, test.expected, op.OperationID)
+		})
+	}
+}
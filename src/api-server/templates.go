@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// templateRouteConfig is a route whose response is rendered from Go
+// templates, to mimic an API without writing code. Status, headers and body
+// are templates executed with templateData, along with the functions of
+// templateFuncs.
+type templateRouteConfig struct {
+	// Method restricts the route to a method, all of them by default.
+	Method string `yaml:"method"`
+	// Path is a pattern whose {name} segments are parameters, and whose
+	// trailing * matches the rest of the path.
+	Path string `yaml:"path"`
+	// Status is the status code, 200 by default.
+	Status  string            `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// ContentType is the media type of the body, application/json when it is
+	// JSON and text/plain otherwise by default.
+	ContentType string        `yaml:"contentType"`
+	Delay       time.Duration `yaml:"delay"`
+}
+
+// templateData is what the templates of a route are executed with.
+type templateData struct {
+	Method string
+	Path   string
+	// Params holds the parameters of the path.
+	Params  map[string]string
+	Query   url.Values
+	Headers http.Header
+	// Claims holds the claims of the bearer token, which is not verified.
+	Claims map[string]interface{}
+	// Body is the decoded JSON body, if any, and RawBody the body as sent.
+	Body    interface{}
+	RawBody string
+	// Tenant is the tenant the request is served for, if any.
+	Tenant string
+}
+
+type templateRoute struct {
+	cfg      templateRouteConfig
+	segments []string
+	status   *template.Template
+	headers  map[string]*template.Template
+	body     *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"now":  time.Now,
+	"uuid": func() string { return uuid.New().String() },
+	"randomInt": func(lower, upper int) int {
+		if upper <= lower {
+			return lower
+		}
+		return lower + rand.IntN(upper-lower)
+	},
+	"randomFloat": func(lower, upper float64) float64 {
+		return lower + rand.Float64()*(upper-lower)
+	},
+	"randomItem": func(items ...interface{}) interface{} {
+		if len(items) == 0 {
+			return nil
+		}
+		return items[rand.IntN(len(items))]
+	},
+	// default returns value unless it is empty, in the template sense.
+	"default": func(def, value interface{}) interface{} {
+		if truth, ok := template.IsTrue(value); !ok || !truth {
+			return def
+		}
+		return value
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+func newTemplateRoutes(routes []templateRouteConfig) ([]*templateRoute, error) {
+	var parsed []*templateRoute
+	for i, cfg := range routes {
+		route, err := newTemplateRoute(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s %s): %w", i, cfg.Method, cfg.Path, err)
+		}
+		parsed = append(parsed, route)
+	}
+
+	return parsed, nil
+}
+
+func newTemplateRoute(cfg templateRouteConfig) (*templateRoute, error) {
+	if !strings.HasPrefix(cfg.Path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+
+	route := &templateRoute{
+		cfg:      cfg,
+		segments: strings.Split(strings.TrimPrefix(cfg.Path, "/"), "/"),
+		headers:  map[string]*template.Template{},
+	}
+	for i, segment := range route.segments {
+		if segment == "*" && i != len(route.segments)-1 {
+			return nil, errors.New("* must be the last segment of the path")
+		}
+	}
+
+	var err error
+	if route.status, err = parseTemplate("status", cfg.Status); err != nil {
+		return nil, err
+	}
+	if route.body, err = parseTemplate("body", cfg.Body); err != nil {
+		return nil, err
+	}
+	for name, value := range cfg.Headers {
+		if route.headers[name], err = parseTemplate("header "+name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return route, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	return tmpl, nil
+}
+
+// match returns the parameters of the path if req matches the route.
+func (r *templateRoute) match(req *http.Request) (map[string]string, bool) {
+	if r.cfg.Method != "" && !strings.EqualFold(r.cfg.Method, req.Method) {
+		return nil, false
+	}
+
+	segments := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	params := map[string]string{}
+	for i, pattern := range r.segments {
+		if pattern == "*" {
+			params["*"] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+
+		if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[pattern[1:len(pattern)-1]] = segments[i]
+			continue
+		}
+		if pattern != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, len(segments) == len(r.segments)
+}
+
+func render(tmpl *template.Template, data *templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// serve renders the response of the route to req.
+func (r *templateRoute) serve(rw http.ResponseWriter, req *http.Request, data *templateData) {
+	status := http.StatusOK
+	value, err := render(r.status, data)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if value = strings.TrimSpace(value); value != "" {
+		if status, err = strconv.Atoi(value); err != nil || status < 100 || status > 999 {
+			JSONError(rw, http.StatusInternalServerError, fmt.Sprintf("invalid status %q", value))
+			return
+		}
+	}
+
+	headers := http.Header{}
+	for name, tmpl := range r.headers {
+		value, err := render(tmpl, data)
+		if err != nil {
+			JSONError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// Headers rendered empty, such as echoes of missing headers, are left
+		// out.
+		if value != "" {
+			headers.Set(name, value)
+		}
+	}
+
+	body, err := render(r.body, data)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	contentType := r.cfg.ContentType
+	if contentType == "" && body != "" {
+		contentType = "text/plain; charset=utf-8"
+		if json.Valid([]byte(body)) {
+			contentType = mediaTypeJSON
+		}
+	}
+
+	if r.cfg.Delay > 0 {
+		timer := time.NewTimer(r.cfg.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			// The client is gone.
+			return
+		}
+	}
+
+	for name, values := range headers {
+		rw.Header()[name] = values
+	}
+	if contentType != "" && rw.Header().Get("Content-Type") == "" {
+		rw.Header().Set("Content-Type", contentType)
+	}
+	rw.WriteHeader(status)
+	_, _ = io.WriteString(rw, body)
+}
+
+// newTemplateData returns the data the templates are executed with for req.
+func newTemplateData(req *http.Request, params map[string]string) (*templateData, error) {
+	data := &templateData{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Params:  params,
+		Query:   req.URL.Query(),
+		Headers: req.Header,
+		Claims:  map[string]interface{}{},
+		Tenant:  tenantFromContext(req.Context()),
+	}
+
+	if token, ok := bearerToken(req); ok {
+		if report := decodeToken(token); report.Error == "" {
+			data.Claims = report.Claims
+		}
+	}
+
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		data.RawBody = string(body)
+
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if len(body) > 0 && (mediaType == "" || isJSONMediaType(mediaType)) {
+			// Bodies which are not JSON are only available raw.
+			_ = json.Unmarshal(body, &data.Body)
+		}
+	}
+
+	return data, nil
+}
+
+// templateMiddleware serves the templated routes, before the routes of the
+// API, through the middlewares of the API.
+func (a *api) templateMiddleware(middlewares chi.Middlewares) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for _, route := range a.templateRoutes {
+				params, ok := route.match(r)
+				if !ok {
+					continue
+				}
+
+				middlewares.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					data, err := newTemplateData(r, params)
+					if err != nil {
+						JSONError(w, http.StatusBadRequest, err.Error())
+						return
+					}
+
+					route.serve(w, r, data)
+				}).ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
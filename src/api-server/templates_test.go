@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const templatesConfig = `
+routes:
+  - method: POST
+    path: /payments/{id}/capture
+    status: 201
+    headers:
+      X-Correlation-Id: '{{ .Headers.Get "X-Correlation-Id" }}'
+      Location: '/payments/{{ .Params.id }}'
+    body: |
+      {"id": {{ json .Params.id }}, "amount": {{ .Body.amount }}, "currency": {{ json (upper .Body.currency) }}, "by": {{ json (default "anonymous" .Claims.sub) }}}
+  - path: /status/{code}
+    status: '{{ .Params.code }}'
+    body: 'status {{ .Params.code }}{{ with .Query.Get "reason" }}: {{ . }}{{ end }}'
+  - path: /legacy/*
+    contentType: application/xml
+    body: '<path>{{ index .Params "*" }}</path>'
+  - path: /whoami
+    body: '{"tenant": {{ json .Tenant }}, "id": {{ json uuid }}, "year": {{ now.Year }}, "dice": {{ randomInt 1 7 }}}'
+  - path: /broken
+    body: '{{ .Missing.Field }}'
+`
+
+func newTemplatesAPI(t *testing.T) (*config, *api) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(templatesConfig), 0o600))
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+
+	a := &api{}
+	require.NoError(t, a.loadData("fixtures/data.json"))
+	require.NoError(t, a.configure(cfg))
+
+	return cfg, a
+}
+
+func Test_templateRoutes(t *testing.T) {
+	_, a := newTemplatesAPI(t)
+
+	srv := httptest.NewServer(a.getRouter())
+	t.Cleanup(srv.Close)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/payments/pay_42/capture", strings.NewReader(`{"amount":12.5,"currency":"eur"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mediaTypeJSON)
+	req.Header.Set("X-Correlation-Id", "corr-1")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "corr-1", resp.Header.Get("X-Correlation-Id"))
+	assert.Equal(t, "/payments/pay_42", resp.Header.Get("Location"))
+	assert.Equal(t, mediaTypeJSON, resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"pay_42","amount":12.5,"currency":"EUR","by":"alice"}`, string(body))
+
+	// Missing headers are not echoed, and missing claims fall back to their
+	// default.
+	resp = doRequest(t, http.MethodPost, srv.URL+"/payments/pay_43/capture", mediaTypeJSON, `{"amount":1,"currency":"usd"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_, echoed := resp.Header["X-Correlation-Id"]
+	assert.False(t, echoed)
+
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"pay_43","amount":1,"currency":"USD","by":"anonymous"}`, string(body))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/status/418?reason=teapot", "", "")
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "status 418: teapot", string(body))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/status/teapot", "", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/legacy/v1/users/42", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/xml", resp.Header.Get("Content-Type"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<path>v1/users/42</path>", string(body))
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/broken", "", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// Requests matching no route reach the API.
+	resp = doRequest(t, http.MethodGet, srv.URL+"/payments/pay_42/capture", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_templateRoutes_tenant(t *testing.T) {
+	cfg, a := newTemplatesAPI(t)
+	cfg.Tenants = &tenantsConfig{}
+
+	tenants, err := newTenantRouter(cfg, a)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tenants)
+	t.Cleanup(srv.Close)
+
+	resp := tenantRequest(t, http.MethodGet, srv.URL+"/whoami", "X-Tenant", "acme", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var got map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, "acme", got["tenant"])
+	assert.NotEmpty(t, got["id"])
+	assert.Greater(t, got["year"], 2000.0)
+	assert.GreaterOrEqual(t, got["dice"], 1.0)
+	assert.LessOrEqual(t, got["dice"], 6.0)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/whoami", "", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	got = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, "", got["tenant"])
+}
+
+func Test_templateRoutes_middlewares(t *testing.T) {
+	cfg, _ := newTemplatesAPI(t)
+	cfg.Auth = &authConfig{Users: []userCredential{{Username: "alice", Password: "secret"}}}
+	cfg.RateLimits = []rateLimitConfig{{Name: "per-ip", Key: rateLimitKeyIP, Rate: 1, Period: time.Hour}}
+
+	a, srv := newTestServer(t, cfg)
+	require.NoError(t, a.loadOpenAPISpec("fixtures/openapi-auth.yaml"))
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/status/200", "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/status/200", http.NoBody)
+		require.NoError(t, err)
+		req.SetBasicAuth("alice", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, expected, resp.StatusCode)
+	}
+}
+
+func Test_templateRoute_delayCanceled(t *testing.T) {
+	route, err := newTemplateRoute(templateRouteConfig{Path: "/slow", Body: "done", Delay: time.Hour})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		route.serve(rec, httptest.NewRequest(http.MethodGet, "/slow", http.NoBody).WithContext(ctx), &templateData{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the delay outlived the request")
+	}
+	assert.Empty(t, rec.Body.String())
+}
+
+func Test_newTemplateRoutes_invalid(t *testing.T) {
+	tests := []struct {
+		desc  string
+		route templateRouteConfig
+	}{
+		{desc: "relative path", route: templateRouteConfig{Path: "status"}},
+		{desc: "wildcard in the middle", route: templateRouteConfig{Path: "/legacy/*/users"}},
+		{desc: "invalid status", route: templateRouteConfig{Path: "/status", Status: "{{ .Params.code "}},
+		{desc: "invalid header", route: templateRouteConfig{Path: "/status", Headers: map[string]string{"X-Id": "{{ uuid"}}},
+		{desc: "invalid body", route: templateRouteConfig{Path: "/status", Body: "{{ unknown }}"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := newTemplateRoutes([]templateRouteConfig{test.route})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tenantsPath = "/_tenants"
+
+	defaultTenantHeader = "X-Tenant"
+	headerTenant        = "Api-Tenant"
+
+	defaultMaxTenants = 100
+)
+
+var (
+	tenantNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+	errTenantNotFound   = errors.New("tenant not found")
+	errTenantNotAllowed = errors.New("tenant not allowed")
+	errTooManyTenants   = errors.New("too many tenants")
+)
+
+// tenantsConfig partitions the records per tenant. Each tenant gets its own
+// copy of the template dataset on first use.
+type tenantsConfig struct {
+	// Header names the tenant, X-Tenant by default.
+	Header string `yaml:"header"`
+	// Claim is a claim of the bearer token naming the tenant, used when the
+	// header is missing. The token is not verified: it is expected to be
+	// verified by the gateway.
+	Claim string `yaml:"claim"`
+	// Data is the template dataset of the tenants, the -data file by
+	// default.
+	Data string `yaml:"data"`
+	// Required rejects the requests naming no tenant. Otherwise, they share
+	// the records of the -data file.
+	Required bool `yaml:"required"`
+	// Allowed lists the tenants which may be used, any by default.
+	Allowed []string `yaml:"allowed"`
+	// Max is the number of tenants kept at once, 100 by default. New tenants
+	// are rejected until some are purged.
+	Max int `yaml:"max"`
+}
+
+func (c tenantsConfig) max() int {
+	if c.Max <= 0 {
+		return defaultMaxTenants
+	}
+
+	return c.Max
+}
+
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant a request is served for, if any.
+func tenantFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+type tenant struct {
+	name      string
+	api       *api
+	handler   http.Handler
+	createdAt time.Time
+}
+
+// tenantReport describes a tenant, as listed by /_tenants.
+type tenantReport struct {
+	Name        string         `json:"name"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	Collections map[string]int `json:"collections"`
+}
+
+// tenantRouter dispatches requests to the partition of their tenant, which
+// is created from the template dataset the first time it is used.
+type tenantRouter struct {
+	cfg      tenantsConfig
+	features *config
+	base     *api
+	handler  http.Handler
+	admin    http.Handler
+	template map[string]map[string]json.RawMessage
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+}
+
+func newTenantRouter(cfg *config, base *api) (*tenantRouter, error) {
+	t := &tenantRouter{
+		cfg:      *cfg.Tenants,
+		features: cfg,
+		base:     base,
+		handler:  base.getRouter(),
+		tenants:  map[string]*tenant{},
+	}
+	t.admin = base.adminMiddleware()(http.HandlerFunc(t.handleTenants))
+	if t.cfg.Header == "" {
+		t.cfg.Header = defaultTenantHeader
+	}
+
+	if t.cfg.Data != "" {
+		template, err := readData(t.cfg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("tenants: %w", err)
+		}
+		t.template = template
+	} else {
+		base.mu.RLock()
+		t.template = cloneData(base.data)
+		base.mu.RUnlock()
+	}
+
+	return t, nil
+}
+
+func (t *tenantRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == tenantsPath || strings.HasPrefix(req.URL.Path, tenantsPath+"/") {
+		t.admin.ServeHTTP(rw, req)
+		return
+	}
+
+	rw.Header().Add("Vary", t.cfg.Header)
+
+	name := t.tenantName(req)
+	if name == "" {
+		if t.cfg.Required {
+			JSONError(rw, http.StatusBadRequest, "no tenant selected")
+			return
+		}
+
+		t.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if !tenantNameRegexp.MatchString(name) {
+		JSONError(rw, http.StatusBadRequest, fmt.Sprintf("invalid tenant %q", name))
+		return
+	}
+
+	tn, err := t.tenant(name)
+	switch {
+	case errors.Is(err, errTenantNotAllowed):
+		JSONError(rw, http.StatusForbidden, fmt.Sprintf("tenant %q not allowed", name))
+		return
+	case errors.Is(err, errTooManyTenants):
+		JSONError(rw, http.StatusServiceUnavailable, err.Error())
+		return
+	case err != nil:
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw.Header().Set(headerTenant, name)
+	tn.handler.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), tenantKey{}, name)))
+}
+
+func (t *tenantRouter) tenantName(req *http.Request) string {
+	if name := req.Header.Get(t.cfg.Header); name != "" {
+		return name
+	}
+
+	if t.cfg.Claim == "" {
+		return ""
+	}
+
+	token, ok := bearerToken(req)
+	if !ok {
+		return ""
+	}
+
+	report := decodeToken(token)
+	if report.Error != "" {
+		return ""
+	}
+
+	name, _ := report.Claims[t.cfg.Claim].(string)
+
+	return name
+}
+
+// tenant returns the partition of name, creating it if needed.
+func (t *tenantRouter) tenant(name string) (*tenant, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tn, ok := t.tenants[name]; ok {
+		return tn, nil
+	}
+
+	if len(t.cfg.Allowed) > 0 && !slices.Contains(t.cfg.Allowed, name) {
+		return nil, errTenantNotAllowed
+	}
+	if len(t.tenants) >= t.cfg.max() {
+		return nil, errTooManyTenants
+	}
+
+	t.base.mu.RLock()
+	a := &api{
+		openAPISpec: t.base.openAPISpec,
+		specDoc:     t.base.specDoc,
+		latency:     t.base.latency,
+		errorRate:   t.base.errorRate,
+		data:        cloneData(t.template),
+	}
+	t.base.mu.RUnlock()
+	a.audit.shareSinks(&t.base.audit)
+
+	if err := a.configure(t.features); err != nil {
+		return nil, err
+	}
+	// Clients are limited across the tenants, which they may pick.
+	a.rateLimits = t.base.rateLimits
+	a.generators.start(a)
+
+	tn := &tenant{name: name, api: a, handler: a.getRouter(), createdAt: time.Now()}
+	t.tenants[name] = tn
+
+	return tn, nil
+}
+
+func (t *tenantRouter) list() []tenantReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports := make([]tenantReport, 0, len(t.tenants))
+	for _, tn := range t.tenants {
+		reports = append(reports, tn.report())
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+
+	return reports
+}
+
+func (tn *tenant) report() tenantReport {
+	report := tenantReport{Name: tn.name, CreatedAt: tn.createdAt, Collections: map[string]int{}}
+	for _, name := range tn.api.collectionNames() {
+		records, _ := tn.api.listObjects(name)
+		report.Collections[name] = len(records)
+	}
+
+	return report
+}
+
+// purge forgets the partition of name, which is seeded again on next use.
+func (t *tenantRouter) purge(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tn, ok := t.tenants[name]
+	if !ok {
+		return false
+	}
+	tn.api.generators.shutdown()
+	delete(t.tenants, name)
+
+	return true
+}
+
+// handleTenants lists the tenants on GET /_tenants, describes one on GET
+// /_tenants/{name}, and purges one on DELETE /_tenants/{name}, or all of them
+// on DELETE /_tenants.
+func (t *tenantRouter) handleTenants(rw http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, tenantsPath), "/")
+
+	switch req.Method {
+	case http.MethodGet:
+		if name == "" {
+			writeJSONResponse(rw, http.StatusOK, t.list())
+			return
+		}
+
+		t.mu.Lock()
+		tn, ok := t.tenants[name]
+		t.mu.Unlock()
+		if !ok {
+			JSONError(rw, http.StatusNotFound, errTenantNotFound.Error())
+			return
+		}
+
+		writeJSONResponse(rw, http.StatusOK, tn.report())
+
+	case http.MethodDelete:
+		if name == "" {
+			t.mu.Lock()
+			for _, tn := range t.tenants {
+				tn.api.generators.shutdown()
+			}
+			t.tenants = map[string]*tenant{}
+			t.mu.Unlock()
+
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !t.purge(name) {
+			JSONError(rw, http.StatusNotFound, errTenantNotFound.Error())
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		JSONError(rw, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", req.Method))
+	}
+}
+
+func cloneData(data map[string]map[string]json.RawMessage) map[string]map[string]json.RawMessage {
+	cloned := make(map[string]map[string]json.RawMessage, len(data))
+	for collection, records := range data {
+		cloned[collection] = make(map[string]json.RawMessage, len(records))
+		for id, record := range records {
+			cloned[collection][id] = bytes.Clone(record)
+		}
+	}
+
+	return cloned
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTenantsAPI(t *testing.T, cfg *config) *httptest.Server {
+	t.Helper()
+
+	a := &api{}
+	require.NoError(t, a.loadData("fixtures/data.json"))
+	require.NoError(t, a.configure(cfg))
+	t.Cleanup(a.generators.shutdown)
+
+	tenants, err := newTenantRouter(cfg, a)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tenants)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func tenantRequest(t *testing.T, method, url, header, value, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	return resp
+}
+
+func Test_tenantRouter_partitions(t *testing.T) {
+	srv := newTenantsAPI(t, &config{Tenants: &tenantsConfig{}})
+
+	resp := tenantRequest(t, http.MethodDelete, srv.URL+"/weather/1", "X-Tenant", "acme", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "acme", resp.Header.Get("Api-Tenant"))
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "acme", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Other tenants and the shared dataset are left untouched.
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "globex", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Api-Tenant"))
+	assert.Equal(t, "X-Tenant", resp.Header.Get("Vary"))
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "../acme", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_tenantRouter_claim(t *testing.T) {
+	srv := newTenantsAPI(t, &config{Tenants: &tenantsConfig{Header: "X-Org", Claim: "org", Required: true}})
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "org": "acme"}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	resp := tenantRequest(t, http.MethodPost, srv.URL+"/weather", "Authorization", "Bearer "+token, `{"city":"Lyon"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "acme", resp.Header.Get("Api-Tenant"))
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather", "X-Org", "acme", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var records []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&records))
+	assert.Len(t, records, 4)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather", "", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_handleTenants(t *testing.T) {
+	srv := newTenantsAPI(t, &config{Tenants: &tenantsConfig{Data: "fixtures/data.json"}})
+
+	tenantRequest(t, http.MethodDelete, srv.URL+"/weather/0", "X-Tenant", "acme", "")
+	tenantRequest(t, http.MethodGet, srv.URL+"/weather", "X-Tenant", "globex", "")
+
+	resp := tenantRequest(t, http.MethodGet, srv.URL+"/_tenants", "", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var reports []tenantReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	require.Len(t, reports, 2)
+	assert.Equal(t, "acme", reports[0].Name)
+	assert.Equal(t, 2, reports[0].Collections["weather"])
+	assert.Equal(t, "globex", reports[1].Name)
+	assert.Equal(t, 3, reports[1].Collections["weather"])
+
+	resp = tenantRequest(t, http.MethodDelete, srv.URL+"/_tenants/acme", "", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/_tenants/acme", "", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The tenant is seeded again.
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/0", "X-Tenant", "acme", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/_tenants/acme", "", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"weather":3`)
+
+	resp = tenantRequest(t, http.MethodDelete, srv.URL+"/_tenants", "", "", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/_tenants", "", "", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	assert.Empty(t, reports)
+
+	resp = tenantRequest(t, http.MethodPost, srv.URL+"/_tenants", "", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func Test_tenantRouter_limits(t *testing.T) {
+	srv := newTenantsAPI(t, &config{
+		Tenants:    &tenantsConfig{Allowed: []string{"acme", "globex", "initech"}, Max: 2},
+		RateLimits: []rateLimitConfig{{Name: "per-ip", Key: rateLimitKeyIP, Rate: 3, Period: time.Hour}},
+	})
+
+	resp := tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "umbrella", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "acme", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "globex", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "initech", "")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// The rate limits are shared by the tenants.
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "acme", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = tenantRequest(t, http.MethodGet, srv.URL+"/weather/1", "X-Tenant", "globex", "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func Test_tenantRouter_audit(t *testing.T) {
+	cfg := &config{
+		Tenants: &tenantsConfig{},
+		Audit:   auditConfig{Enabled: true, File: filepath.Join(t.TempDir(), "audit.jsonl")},
+	}
+
+	base := &api{}
+	require.NoError(t, base.loadData("fixtures/data.json"))
+	require.NoError(t, base.configure(cfg))
+
+	tenants, err := newTenantRouter(cfg, base)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tenants)
+	t.Cleanup(srv.Close)
+
+	for _, name := range []string{"acme", "globex"} {
+		resp := tenantRequest(t, http.MethodDelete, srv.URL+"/weather/1", "X-Tenant", name, "")
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	// The tenants write to the audit file of the base API, opened once.
+	for _, name := range []string{"acme", "globex"} {
+		tn, ok := tenants.tenants[name]
+		require.True(t, ok)
+		assert.Equal(t, base.audit.sinks, tn.api.audit.sinks)
+	}
+
+	raw, err := os.ReadFile(cfg.Audit.File)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(raw)), "\n"), 2)
+}
+
+func Test_handleTenants_admin(t *testing.T) {
+	srv := newTenantsAPI(t, &config{
+		Tenants: &tenantsConfig{},
+		Auth:    &authConfig{Users: []userCredential{{Username: "admin", Password: "secret", Scopes: []string{"admin"}}}},
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		resp := tenantRequest(t, method, srv.URL+"/_tenants", "", "", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = tenantRequest(t, method, srv.URL+"/_tenants/acme", "", "", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/_tenants", http.NoBody)
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func Test_configure_tenantsWithVersioning(t *testing.T) {
+	a := &api{}
+	assert.Error(t, a.configure(&config{Tenants: &tenantsConfig{}, Versioning: &versioningConfig{}}))
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const defaultVersionHeader = "Accept-Version"
+
+type versioningConfig struct {
+	// Header is the request header naming the version to use.
+	Header string `yaml:"header"`
+	// Default is the version used when the request does not select any.
+	Default string `yaml:"default"`
+	// Vendor is the vendor of the media types selecting a version, as
+	// "weather" in application/vnd.weather.v2+json. Vendor media types do not
+	// select versions without it.
+	Vendor   string          `yaml:"vendor"`
+	Versions []versionConfig `yaml:"versions"`
+}
+
+type versionConfig struct {
+	Name    string `yaml:"name"`
+	Prefix  string `yaml:"prefix"`
+	OpenAPI string `yaml:"openapi"`
+	Data    string `yaml:"data"`
+	// Base is the name of a version whose dataset is shared with this
+	// version, through the optional transform rules.
+	Base      string           `yaml:"base"`
+	Transform *transformConfig `yaml:"transform"`
+}
+
+// transformConfig describes how the records of a base version are presented
+// by a version sharing its dataset.
+type transformConfig struct {
+	// Rename maps base field names to the names exposed by the version.
+	Rename map[string]string `yaml:"rename"`
+	// Remove lists base fields hidden by the version.
+	Remove []string `yaml:"remove"`
+	// Set adds fields with fixed values to the records of the version.
+	Set map[string]interface{} `yaml:"set"`
+}
+
+type apiVersion struct {
+	name    string
+	prefix  string
+	handler http.Handler
+	// base is the version whose records are served, if not this one.
+	base *apiVersion
+
+	// api is the instance loaded from specPath and dataPath. It is nil for
+	// versions sharing the dataset and spec of their base version.
+	api      *api
+	specPath string
+	dataPath string
+}
+
+// versionRouter dispatches requests between the versions of an API. The
+// version is selected by path prefix, then by header, then by media type, and
+// falls back to the default version.
+type versionRouter struct {
+	header         string
+	defaultVersion string
+	vendor         string
+	versions       []*apiVersion
+}
+
+func newVersionRouter(cfg *config, base *api) (*versionRouter, error) {
+	router := &versionRouter{
+		header:         cfg.Versioning.Header,
+		defaultVersion: cfg.Versioning.Default,
+		vendor:         cfg.Versioning.Vendor,
+	}
+	if router.header == "" {
+		router.header = defaultVersionHeader
+	}
+
+	for _, vCfg := range cfg.Versioning.Versions {
+		if vCfg.Name == "" {
+			return nil, errors.New("version without name")
+		}
+		if router.version(vCfg.Name) != nil {
+			return nil, fmt.Errorf("duplicated version %q", vCfg.Name)
+		}
+
+		version, err := router.newVersion(vCfg, cfg, base)
+		if err != nil {
+			return nil, fmt.Errorf("version %q: %w", vCfg.Name, err)
+		}
+		router.versions = append(router.versions, version)
+	}
+
+	if router.defaultVersion != "" && router.version(router.defaultVersion) == nil {
+		return nil, fmt.Errorf("unknown default version %q", router.defaultVersion)
+	}
+
+	return router, nil
+}
+
+func (v *versionRouter) newVersion(vCfg versionConfig, cfg *config, base *api) (*apiVersion, error) {
+	version := &apiVersion{
+		name:     vCfg.Name,
+		prefix:   strings.TrimSuffix(vCfg.Prefix, "/"),
+		specPath: vCfg.OpenAPI,
+		dataPath: vCfg.Data,
+	}
+
+	if vCfg.Base != "" {
+		baseVersion := v.version(vCfg.Base)
+		if baseVersion == nil {
+			return nil, fmt.Errorf("unknown base version %q", vCfg.Base)
+		}
+		if vCfg.Data != "" {
+			return nil, errors.New("a version cannot have both a base and data")
+		}
+
+		version.dataPath = ""
+		version.base = baseVersion
+		version.handler = baseVersion.handler
+		if vCfg.Transform != nil {
+			version.handler = transformHandler(*vCfg.Transform, baseVersion.handler)
+		}
+
+		if vCfg.OpenAPI == "" {
+			return version, nil
+		}
+
+		// The version documents its own spec, served in place of the base one.
+		version.api = &api{}
+		if err := version.api.loadOpenAPISpec(vCfg.OpenAPI); err != nil {
+			return nil, err
+		}
+		version.handler = withOwnSpec(version.api.getRouter(), version.handler)
+
+		return version, nil
+	}
+
+	a := &api{latency: base.latency, errorRate: base.errorRate}
+	a.audit.shareSinks(&base.audit)
+	if vCfg.OpenAPI != "" {
+		if err := a.loadOpenAPISpec(vCfg.OpenAPI); err != nil {
+			return nil, err
+		}
+	}
+	if vCfg.Data != "" {
+		if err := a.loadData(vCfg.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.configure(cfg); err != nil {
+		return nil, err
+	}
+	// Clients are limited across the versions, which they may pick.
+	a.rateLimits = base.rateLimits
+	a.generators.start(a)
+
+	version.api = a
+	version.handler = a.getRouter()
+
+	return version, nil
+}
+
+// watchFiles reloads the files of each version when they change.
+func (v *versionRouter) watchFiles() error {
+	for _, version := range v.versions {
+		if version.api == nil {
+			continue
+		}
+
+		_, err := version.api.watchFiles(version.specPath, version.dataPath)
+		if err != nil {
+			return fmt.Errorf("version %q: %w", version.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (v *versionRouter) version(name string) *apiVersion {
+	for _, version := range v.versions {
+		if version.name == name {
+			return version
+		}
+	}
+
+	return nil
+}
+
+// store returns the instance holding the records of the default version, or
+// of the first version when there is no default.
+func (v *versionRouter) store() *api {
+	version := v.version(v.defaultVersion)
+	if version == nil && len(v.versions) > 0 {
+		version = v.versions[0]
+	}
+	if version == nil {
+		return nil
+	}
+
+	for version.base != nil {
+		version = version.base
+	}
+
+	return version.api
+}
+
+func (v *versionRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Vary", v.header)
+	rw.Header().Add("Vary", "Accept")
+
+	for _, version := range v.versions {
+		if version.prefix == "" {
+			continue
+		}
+
+		if req.URL.Path == version.prefix || strings.HasPrefix(req.URL.Path, version.prefix+"/") {
+			rw.Header().Set("Api-Version", version.name)
+			version.handler.ServeHTTP(rw, stripPrefix(req, version.prefix))
+			return
+		}
+	}
+
+	if name := req.Header.Get(v.header); name != "" {
+		version := v.version(name)
+		if version == nil {
+			JSONError(rw, http.StatusBadRequest, fmt.Sprintf("unknown version %q", name))
+			return
+		}
+
+		rw.Header().Set("Api-Version", version.name)
+		version.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if names := mediaTypeVersions(req.Header.Get("Accept"), v.vendor); len(names) > 0 {
+		for _, name := range names {
+			if version := v.version(name); version != nil {
+				rw.Header().Set("Api-Version", version.name)
+				version.handler.ServeHTTP(rw, req)
+				return
+			}
+		}
+
+		JSONError(rw, http.StatusNotAcceptable, fmt.Sprintf("unknown version %q", strings.Join(names, ", ")))
+		return
+	}
+
+	version := v.version(v.defaultVersion)
+	if version == nil {
+		JSONError(rw, http.StatusBadRequest, "no version selected")
+		return
+	}
+
+	rw.Header().Set("Api-Version", version.name)
+	version.handler.ServeHTTP(rw, req)
+}
+
+// mediaTypeVersions returns the versions requested through media types,
+// either with a "version" parameter (application/json; version=v2) or as the
+// last part of a media type of vendor (application/vnd.weather.v2+json). The
+// media types of other vendors are ignored.
+func mediaTypeVersions(accept, vendor string) []string {
+	var versions []string
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		if version, ok := params["version"]; ok {
+			versions = append(versions, version)
+			continue
+		}
+
+		if vendor == "" {
+			continue
+		}
+		subtype, ok := strings.CutPrefix(mediaType, "application/vnd."+strings.ToLower(vendor)+".")
+		if !ok {
+			continue
+		}
+
+		version, _, _ := strings.Cut(subtype, "+")
+		if version != "" {
+			versions = append(versions, version)
+		}
+	}
+
+	return versions
+}
+
+func stripPrefix(req *http.Request, prefix string) *http.Request {
+	r := req.Clone(req.Context())
+	r.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+	r.URL.RawPath = ""
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	r.Header.Set("X-Forwarded-Prefix", req.Header.Get("X-Forwarded-Prefix")+prefix)
+
+	return r
+}
+
+// withOwnSpec serves the OpenAPI spec with specRouter and forwards anything
+// else to next.
+func withOwnSpec(specRouter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/openapi" || strings.HasPrefix(req.URL.Path, "/openapi.") {
+			specRouter.ServeHTTP(rw, req)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// transformHandler presents the records served by next through the given
+// transform rules. Request bodies go through the reverse rules.
+func transformHandler(t transformConfig, next http.Handler) http.Handler {
+	reverse := make(map[string]string, len(t.Rename))
+	for from, to := range t.Rename {
+		reverse[to] = from
+	}
+
+	toBase := func(obj map[string]interface{}) {
+		for field := range t.Set {
+			delete(obj, field)
+		}
+		renameFields(obj, reverse)
+	}
+
+	toVersion := func(obj map[string]interface{}) {
+		for _, field := range t.Remove {
+			delete(obj, field)
+		}
+		renameFields(obj, t.Rename)
+		for field, value := range t.Set {
+			obj[field] = value
+		}
+	}
+
+	// hiddenFields returns the fields removed from the record at the path of
+	// req, as the base version serves it.
+	hiddenFields := func(req *http.Request) map[string]interface{} {
+		if len(t.Remove) == 0 {
+			return nil
+		}
+
+		r := req.Clone(req.Context())
+		r.Method = http.MethodGet
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.Header.Del("Content-Type")
+		r.Header.Set("Accept", mediaTypeJSON)
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+		if capture.statusCode() != http.StatusOK {
+			return nil
+		}
+
+		var stored map[string]interface{}
+		if err := json.Unmarshal(capture.body.Bytes(), &stored); err != nil {
+			return nil
+		}
+
+		fields := map[string]interface{}{}
+		for _, field := range t.Remove {
+			if value, ok := stored[field]; ok {
+				fields[field] = value
+			}
+		}
+
+		return fields
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Change feeds are streamed, they carry the records of the base
+		// version.
+		if strings.HasSuffix(req.URL.Path, "/_events") {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		c, err := responseCodec(req, true)
+		if err != nil {
+			JSONError(rw, http.StatusNotAcceptable, err.Error())
+			return
+		}
+
+		// The base version is talked to in JSON, the response is encoded in
+		// the format asked by the client once transformed.
+		r := req.Clone(req.Context())
+		r.Header.Set("Accept", mediaTypeJSON)
+
+		if req.Body != nil && req.Body != http.NoBody {
+			var body []byte
+			if req.Method == http.MethodPatch {
+				body, err = io.ReadAll(req.Body)
+				if err != nil {
+					JSONError(rw, http.StatusInternalServerError, err.Error())
+					return
+				}
+				body = renamePatchPaths(body, reverse)
+			} else {
+				v, err := decodeBody(req)
+				if err != nil {
+					bodyError(rw, err)
+					return
+				}
+				transformValue(v, toBase)
+
+				// Replacing a record keeps the fields the version hides.
+				if obj, ok := v.(map[string]interface{}); ok && req.Method == http.MethodPut {
+					for field, value := range hiddenFields(req) {
+						if _, ok := obj[field]; !ok {
+							obj[field] = value
+						}
+					}
+				}
+
+				body, err = json.Marshal(v)
+				if err != nil {
+					JSONError(rw, http.StatusInternalServerError, err.Error())
+					return
+				}
+				r.Header.Set("Content-Type", mediaTypeJSON)
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		capture := newResponseCapture()
+		next.ServeHTTP(capture, r)
+
+		if capture.statusCode() >= http.StatusMultipleChoices || capture.header.Get("Content-Type") != mediaTypeJSON {
+			capture.flush(rw, capture.body.Bytes())
+			return
+		}
+
+		v, err := codecs[0].unmarshal(capture.body.Bytes())
+		if err != nil {
+			capture.flush(rw, capture.body.Bytes())
+			return
+		}
+		transformValue(v, toVersion)
+
+		for k, values := range capture.header {
+			switch k {
+			case "Content-Type", "Content-Length", "Vary":
+			default:
+				rw.Header()[k] = values
+			}
+		}
+		c.write(rw, capture.statusCode(), v)
+	})
+}
+
+// transformValue applies fn to v when it is an object, or to each object of v
+// when it is a list.
+func transformValue(v interface{}, fn func(map[string]interface{})) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		fn(value)
+	case []interface{}:
+		for _, item := range value {
+			if obj, ok := item.(map[string]interface{}); ok {
+				fn(obj)
+			}
+		}
+	}
+}
+
+func renameFields(obj map[string]interface{}, rename map[string]string) {
+	renamed := map[string]interface{}{}
+	for from, to := range rename {
+		if value, ok := obj[from]; ok {
+			delete(obj, from)
+			renamed[to] = value
+		}
+	}
+
+	for field, value := range renamed {
+		obj[field] = value
+	}
+}
+
+// renamePatchPaths renames the top level field targeted by each operation of
+// a JSON patch.
+func renamePatchPaths(body []byte, rename map[string]string) []byte {
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return body
+	}
+
+	for _, op := range ops {
+		for _, key := range []string{"path", "from"} {
+			path, ok := op[key].(string)
+			if !ok {
+				continue
+			}
+
+			field, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+			if to, ok := rename[field]; ok {
+				path = "/" + to
+				if rest != "" {
+					path += "/" + rest
+				}
+				op[key] = path
+			}
+		}
+	}
+
+	out, err := json.Marshal(ops)
+	if err != nil {
+		return body
+	}
+
+	return out
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newVersionedAPI(t *testing.T) (*httptest.Server, *versionRouter) {
+	t.Helper()
+
+	dataV2 := filepath.Join(t.TempDir(), "data.json")
+	require.NoError(t, os.WriteFile(dataV2, []byte(`{"weather": {"0": {"city": "GopherCity", "temperature": 21}}}`), 0o600))
+
+	cfg := &config{Versioning: &versioningConfig{
+		Header:  "X-Version",
+		Default: "v1",
+		Vendor:  "weather",
+		Versions: []versionConfig{
+			{Name: "v1", Prefix: "/v1", OpenAPI: "fixtures/openapi.yaml", Data: "fixtures/data.json"},
+			{Name: "v2", Prefix: "/v2", Data: dataV2},
+			{
+				Name: "v1.1",
+				Base: "v1",
+				Transform: &transformConfig{
+					Rename: map[string]string{"weather": "conditions"},
+					Set:    map[string]interface{}{"unit": "celsius"},
+				},
+			},
+		},
+	}}
+
+	versions, err := newVersionRouter(cfg, &api{})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(versions)
+	t.Cleanup(srv.Close)
+
+	return srv, versions
+}
+
+func getWeather(t *testing.T, req *http.Request) (*http.Response, map[string]interface{}) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var doc map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&doc)
+
+	return resp, doc
+}
+
+func Test_versionRouter(t *testing.T) {
+	srv, _ := newVersionedAPI(t)
+
+	tests := []struct {
+		desc        string
+		path        string
+		headers     map[string]string
+		expected    int
+		expectedVer string
+		expectedKey string
+	}{
+		{desc: "default", path: "/weather/0", expected: http.StatusOK, expectedVer: "v1", expectedKey: "weather"},
+		{desc: "prefix", path: "/v2/weather/0", expected: http.StatusOK, expectedVer: "v2", expectedKey: "temperature"},
+		{
+			desc:        "header",
+			path:        "/weather/0",
+			headers:     map[string]string{"X-Version": "v2"},
+			expected:    http.StatusOK,
+			expectedVer: "v2",
+			expectedKey: "temperature",
+		},
+		{
+			desc:        "vendor media type",
+			path:        "/weather/0",
+			headers:     map[string]string{"Accept": "application/vnd.weather.v2+json"},
+			expected:    http.StatusOK,
+			expectedVer: "v2",
+			expectedKey: "temperature",
+		},
+		{
+			desc:        "media type parameter",
+			path:        "/weather/0",
+			headers:     map[string]string{"Accept": "application/json; version=v1.1"},
+			expected:    http.StatusOK,
+			expectedVer: "v1.1",
+			expectedKey: "conditions",
+		},
+		{desc: "unknown header version", path: "/weather/0", headers: map[string]string{"X-Version": "v3"}, expected: http.StatusBadRequest},
+		{
+			desc:     "unknown media type version",
+			path:     "/weather/0",
+			headers:  map[string]string{"Accept": "application/vnd.weather.v3+json"},
+			expected: http.StatusNotAcceptable,
+		},
+		{
+			desc:        "other vendor media type",
+			path:        "/weather/0",
+			headers:     map[string]string{"Accept": "application/vnd.api+json"},
+			expected:    http.StatusOK,
+			expectedVer: "v1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+test.path, http.NoBody)
+			require.NoError(t, err)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			resp, doc := getWeather(t, req)
+
+			assert.Equal(t, test.expected, resp.StatusCode)
+			assert.Equal(t, test.expectedVer, resp.Header.Get("Api-Version"))
+			if test.expectedKey != "" {
+				assert.Contains(t, doc, test.expectedKey)
+			}
+		})
+	}
+}
+
+func Test_versionRouter_transform(t *testing.T) {
+	srv, versions := newVersionedAPI(t)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/0", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Version", "v1.1")
+
+	_, doc := getWeather(t, req)
+	assert.Equal(t, map[string]interface{}{
+		"city":       "GopherCity",
+		"conditions": "Moderate rain",
+		"unit":       "celsius",
+	}, doc)
+
+	req, err = http.NewRequest(http.MethodPut, srv.URL+"/weather/0", bytes.NewBufferString(`{"city": "Lyon", "conditions": "Sunny", "unit": "celsius"}`))
+	require.NoError(t, err)
+	req.Header.Set("X-Version", "v1.1")
+
+	resp, _ := getWeather(t, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The shared dataset is stored with the field names of the base version.
+	obj, err := versions.version("v1").api.getObject("weather", "0")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city": "Lyon", "weather": "Sunny"}`, string(obj))
+}
+
+func Test_versionRouter_transformRemove(t *testing.T) {
+	cfg := &config{Versioning: &versioningConfig{
+		Header: "X-Version",
+		Versions: []versionConfig{
+			{Name: "v1", Data: "fixtures/data.json"},
+			{Name: "v1.1", Base: "v1", Transform: &transformConfig{Remove: []string{"weather"}}},
+		},
+	}}
+
+	versions, err := newVersionRouter(cfg, &api{})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(versions)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/0", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Version", "v1.1")
+
+	_, doc := getWeather(t, req)
+	assert.Equal(t, map[string]interface{}{"city": "GopherCity"}, doc)
+
+	req, err = http.NewRequest(http.MethodPut, srv.URL+"/weather/0", bytes.NewBufferString(`{"city": "Lyon"}`))
+	require.NoError(t, err)
+	req.Header.Set("X-Version", "v1.1")
+
+	resp, _ := getWeather(t, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Replacing the record keeps the fields hidden by the version.
+	obj, err := versions.version("v1").api.getObject("weather", "0")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city": "Lyon", "weather": "Moderate rain"}`, string(obj))
+}
+
+func Test_versionRouter_rateLimits(t *testing.T) {
+	cfg := &config{
+		Versioning: &versioningConfig{
+			Header: "X-Version",
+			Versions: []versionConfig{
+				{Name: "v1", Data: "fixtures/data.json"},
+				{Name: "v2", Data: "fixtures/data.json"},
+			},
+		},
+		RateLimits: []rateLimitConfig{{Name: "per-ip", Key: rateLimitKeyIP, Rate: 2, Period: time.Hour}},
+	}
+
+	base := &api{}
+	require.NoError(t, base.configure(cfg))
+
+	versions, err := newVersionRouter(cfg, base)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(versions)
+	t.Cleanup(srv.Close)
+
+	get := func(version string) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/weather/0", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("X-Version", version)
+
+		resp, _ := getWeather(t, req)
+		return resp.StatusCode
+	}
+
+	// The rate limits are shared by the versions.
+	assert.Equal(t, http.StatusOK, get("v1"))
+	assert.Equal(t, http.StatusOK, get("v2"))
+	assert.Equal(t, http.StatusTooManyRequests, get("v1"))
+}
+
+func Test_newVersionRouter_invalid(t *testing.T) {
+	tests := []struct {
+		desc     string
+		cfg      versioningConfig
+		expected string
+	}{
+		{
+			desc:     "unknown base",
+			cfg:      versioningConfig{Versions: []versionConfig{{Name: "v2", Base: "v1"}}},
+			expected: `version "v2": unknown base version "v1"`,
+		},
+		{
+			desc:     "duplicated version",
+			cfg:      versioningConfig{Versions: []versionConfig{{Name: "v1"}, {Name: "v1"}}},
+			expected: `duplicated version "v1"`,
+		},
+		{
+			desc:     "unknown default",
+			cfg:      versioningConfig{Default: "v2", Versions: []versionConfig{{Name: "v1"}}},
+			expected: `unknown default version "v2"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := newVersionRouter(&config{Versioning: &test.cfg}, &api{})
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
+
+func Test_versionRouter_generators(t *testing.T) {
+	cfg := &config{
+		Versioning: &versioningConfig{
+			Header:   "X-Version",
+			Default:  "v1",
+			Versions: []versionConfig{{Name: "v1", Prefix: "/v1", Data: "fixtures/data.json"}},
+		},
+		Generators: []generatorConfig{{Collection: "weather", Records: []string{"0"}, Interval: time.Hour, Fields: map[string]fieldGeneratorConfig{"updatedAt": {Type: generatorNow}}}},
+	}
+
+	base := &api{}
+	require.NoError(t, base.loadData("fixtures/data.json"))
+	require.NoError(t, base.configure(cfg))
+
+	versions, err := newVersionRouter(cfg, base)
+	require.NoError(t, err)
+	t.Cleanup(versions.version("v1").api.generators.shutdown)
+
+	// Only the versions, which serve the requests, run the generators.
+	assert.Equal(t, 1, versions.version("v1").api.generators.list()[0].Generations)
+	assert.Equal(t, 0, base.generators.list()[0].Generations)
+	assert.NotContains(t, getDoc(t, base, "weather", "0"), "updatedAt")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay is how long the watcher waits for filesystem events to settle
+// before reloading. Kubernetes updates mounted ConfigMaps by creating a new
+// timestamped directory and swapping the "..data" symlink, which fires a
+// burst of events for a single logical change.
+const reloadDelay = 100 * time.Millisecond
+
+type fileWatcher struct {
+	api      *api
+	specPath string
+	dataPath string
+	watcher  *fsnotify.Watcher
+
+	mu   sync.Mutex
+	sums map[string][]byte
+	done chan struct{}
+}
+
+// watchFiles reloads the OpenAPI spec and data files whenever their content
+// changes on disk. Parent directories are watched rather than the files
+// themselves, so that symlink swaps and atomic renames are picked up.
+func (a *api) watchFiles(specPath, dataPath string) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &fileWatcher{
+		api:      a,
+		specPath: specPath,
+		dataPath: dataPath,
+		watcher:  watcher,
+		sums:     map[string][]byte{},
+		done:     make(chan struct{}),
+	}
+
+	for _, path := range []string{specPath, dataPath} {
+		if path == "" {
+			continue
+		}
+
+		sum, err := fileSum(path)
+		if err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+		w.sums[path] = sum
+
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// Close stops watching for changes.
+func (w *fileWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+func (w *fileWatcher) run() {
+	defer close(w.done)
+
+	var timer *time.Timer
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(reloadDelay, w.reload)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watcher error: %v", err)
+		}
+	}
+}
+
+func (w *fileWatcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reloaded, err := w.api.reloadFiles(w.specPath, w.dataPath, w.sums)
+	if err != nil {
+		log.Printf("rejecting update, keeping previous state: %v", err)
+		return
+	}
+
+	if reloaded {
+		log.Printf("reloaded openapispec %q and data %q", w.specPath, w.dataPath)
+	}
+}
+
+// reloadFiles loads the spec and data files if their checksums differ from
+// the given ones. Both files are parsed before anything is swapped, so either
+// the whole update is applied or the previous state is kept. Checksums are
+// updated for any content that was looked at, so an invalid update is only
+// reported once.
+func (a *api) reloadFiles(specPath, dataPath string, sums map[string][]byte) (bool, error) {
+	changed := map[string][]byte{}
+	for _, path := range []string{specPath, dataPath} {
+		if path == "" {
+			continue
+		}
+
+		sum, err := fileSum(path)
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(sum, sums[path]) {
+			changed[path] = sum
+		}
+	}
+
+	if len(changed) == 0 {
+		return false, nil
+	}
+
+	for path, sum := range changed {
+		sums[path] = sum
+	}
+
+	var (
+		openAPISpec *openAPIDocument
+		specDoc     *specDocument
+		data        map[string]map[string]json.RawMessage
+		err         error
+	)
+
+	if specPath != "" {
+		openAPISpec, err = loadOpenAPIDocument(specPath)
+		if err != nil {
+			return false, fmt.Errorf("loading openapispec %q: %w", specPath, err)
+		}
+
+		specDoc, err = parseSpecDocument(openAPISpec.Raw())
+		if err != nil {
+			return false, fmt.Errorf("parsing openapispec %q: %w", specPath, err)
+		}
+	}
+
+	if dataPath != "" {
+		data, err = readData(dataPath)
+		if err != nil {
+			return false, fmt.Errorf("loading data %q: %w", dataPath, err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if openAPISpec != nil {
+		a.openAPISpec = openAPISpec
+		a.specDoc = specDoc
+	}
+	if data != nil {
+		a.data = data
+		a.indexes.reset()
+		a.history.reset(data)
+		a.audit.reset(data)
+	}
+
+	return true, nil
+}
+
+func fileSum(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(content)
+	return sum[:], nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_reloadFiles(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "data.json")
+	require.NoError(t, os.WriteFile(dataPath, []byte(`{"weather": {"0": {"city": "GopherCity"}}}`), 0o600))
+
+	a := api{}
+	require.NoError(t, a.loadData(dataPath))
+
+	sums := map[string][]byte{}
+	reloaded, err := a.reloadFiles("", dataPath, sums)
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+
+	reloaded, err = a.reloadFiles("", dataPath, sums)
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	require.NoError(t, os.WriteFile(dataPath, []byte(`{"weather": {"1": {"city": "Lyon"}}}`), 0o600))
+
+	reloaded, err = a.reloadFiles("", dataPath, sums)
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+
+	_, err = a.getObject("weather", "1")
+	assert.NoError(t, err)
+	_, err = a.getObject("weather", "0")
+	assert.Error(t, err)
+}
+
+func Test_reloadFiles_invalidUpdateKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "data.json")
+	specPath := filepath.Join(dir, "openapi.yaml")
+	require.NoError(t, os.WriteFile(dataPath, []byte(`{"weather": {"0": {"city": "GopherCity"}}}`), 0o600))
+	spec, err := os.ReadFile("fixtures/openapi.yaml")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(specPath, spec, 0o600))
+
+	a := api{}
+	require.NoError(t, a.loadData(dataPath))
+	require.NoError(t, a.loadOpenAPISpec(specPath))
+	sums := map[string][]byte{}
+	_, err = a.reloadFiles(specPath, dataPath, sums)
+	require.NoError(t, err)
+	openAPISpec := a.openAPISpec
+
+	// A valid data update alongside an invalid spec must not be applied.
+	require.NoError(t, os.WriteFile(dataPath, []byte(`{"weather": {"1": {"city": "Lyon"}}}`), 0o600))
+	require.NoError(t, os.WriteFile(specPath, []byte(`test`), 0o600))
+
+	reloaded, err := a.reloadFiles(specPath, dataPath, sums)
+	assert.Error(t, err)
+	assert.False(t, reloaded)
+
+	_, err = a.getObject("weather", "0")
+	assert.NoError(t, err)
+	assert.Same(t, openAPISpec, a.openAPISpec)
+}
+
+func Test_watchFiles_configMapSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+
+	// Reproduce the layout of a mounted ConfigMap:
+	// api.json -> ..data/api.json, ..data -> ..<timestamp>.
+	writeVersion := func(name, content string) {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "api.json"), []byte(content), 0o600))
+	}
+
+	writeVersion("..v1", `{"weather": {"0": {"city": "GopherCity"}}}`)
+	require.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "api.json"), filepath.Join(dir, "api.json")))
+
+	dataPath := filepath.Join(dir, "api.json")
+
+	a := api{}
+	require.NoError(t, a.loadData(dataPath))
+
+	w, err := a.watchFiles("", dataPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = w.Close() })
+
+	writeVersion("..v2", `{"weather": {"1": {"city": "Lyon"}}}`)
+	require.NoError(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "..v1")))
+
+	assert.Eventually(t, func() bool {
+		_, err := a.getObject("weather", "1")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
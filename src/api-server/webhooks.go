@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+
+	webhookSecretPrefix = "whsec_"
+
+	// maxDeliveries is the number of deliveries kept per subscription.
+	maxDeliveries = 100
+
+	defaultWebhookMaxAttempts    = 5
+	defaultWebhookInitialBackoff = time.Second
+	defaultWebhookMaxBackoff     = time.Minute
+	defaultWebhookTimeout        = 10 * time.Second
+	defaultWebhookWorkers        = 4
+	defaultWebhookQueueSize      = 1000
+)
+
+type webhooksConfig struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Timeout        time.Duration `yaml:"timeout"`
+	// Workers is the number of attempts made at once.
+	Workers int `yaml:"workers"`
+	// QueueSize is the number of attempts waiting for a worker, beyond which
+	// deliveries fail.
+	QueueSize int `yaml:"queueSize"`
+}
+
+func (c webhooksConfig) withDefaults() webhooksConfig {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = defaultWebhookInitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+	if c.Workers <= 0 {
+		c.Workers = defaultWebhookWorkers
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultWebhookQueueSize
+	}
+
+	return c
+}
+
+// webhookSubscription is a URL called on the changes of the records. Empty
+// Collections and Events match everything.
+type webhookSubscription struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Collections []string  `json:"collections,omitempty"`
+	Events      []string  `json:"events,omitempty"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (s *webhookSubscription) matches(evt event) bool {
+	return (len(s.Collections) == 0 || slices.Contains(s.Collections, evt.Collection)) &&
+		(len(s.Events) == 0 || slices.Contains(s.Events, evt.Type))
+}
+
+type webhookDelivery struct {
+	ID          string           `json:"id"`
+	EventID     uint64           `json:"eventId"`
+	EventType   string           `json:"eventType"`
+	Collection  string           `json:"collection"`
+	ObjectID    string           `json:"objectId"`
+	Status      string           `json:"status"`
+	Attempts    []webhookAttempt `json:"attempts"`
+	NextAttempt *time.Time       `json:"nextAttempt,omitempty"`
+}
+
+type webhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   string    `json:"duration"`
+}
+
+// webhookJob is the next attempt of a delivery.
+type webhookJob struct {
+	sub      webhookSubscription
+	delivery *webhookDelivery
+	payload  []byte
+	attempt  int
+	backoff  time.Duration
+}
+
+// webhookRegistry holds the webhook subscriptions, and delivers the events
+// of the records to them. The attempts are queued for a fixed number of
+// workers.
+type webhookRegistry struct {
+	mu            sync.Mutex
+	listening     sync.Once
+	cfg           webhooksConfig
+	client        *http.Client
+	queue         chan *webhookJob
+	subscriptions map[string]*webhookSubscription
+	deliveries    map[string][]*webhookDelivery
+}
+
+func (r *webhookRegistry) configure(cfg webhooksConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cfg = cfg
+}
+
+func (r *webhookRegistry) add(sub *webhookSubscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subscriptions == nil {
+		r.subscriptions = map[string]*webhookSubscription{}
+		r.deliveries = map[string][]*webhookDelivery{}
+	}
+	r.subscriptions[sub.ID] = sub
+}
+
+func (r *webhookRegistry) get(id string) (webhookSubscription, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub, ok := r.subscriptions[id]
+	if !ok {
+		return webhookSubscription{}, false
+	}
+
+	return *sub, true
+}
+
+func (r *webhookRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.subscriptions, id)
+	delete(r.deliveries, id)
+}
+
+func (r *webhookRegistry) list() []webhookSubscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subs := make([]webhookSubscription, 0, len(r.subscriptions))
+	for _, sub := range r.subscriptions {
+		subs = append(subs, *sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+	})
+
+	return subs
+}
+
+func (r *webhookRegistry) deliveriesOf(id string) []webhookDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deliveries := make([]webhookDelivery, 0, len(r.deliveries[id]))
+	for _, delivery := range r.deliveries[id] {
+		copied := *delivery
+		copied.Attempts = append([]webhookAttempt(nil), delivery.Attempts...)
+		deliveries = append(deliveries, copied)
+	}
+
+	return deliveries
+}
+
+// dispatch queues the delivery of evt to the matching subscriptions. It is
+// called while the records are locked, and must not block.
+func (r *webhookRegistry) dispatch(evt event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payload, err := json.Marshal(evt)
+	cfg := r.cfg.withDefaults()
+	for _, sub := range r.subscriptions {
+		if !sub.matches(evt) {
+			continue
+		}
+
+		delivery := &webhookDelivery{
+			ID:         uuid.New().String(),
+			EventID:    evt.ID,
+			EventType:  evt.Type,
+			Collection: evt.Collection,
+			ObjectID:   evt.ObjectID,
+			Status:     deliveryPending,
+			Attempts:   []webhookAttempt{},
+		}
+
+		deliveries := append(r.deliveries[sub.ID], delivery)
+		if len(deliveries) > maxDeliveries {
+			deliveries = deliveries[len(deliveries)-maxDeliveries:]
+		}
+		r.deliveries[sub.ID] = deliveries
+
+		if err != nil {
+			failDelivery(delivery, err.Error())
+			continue
+		}
+		r.enqueue(&webhookJob{sub: *sub, delivery: delivery, payload: payload, attempt: 1, backoff: cfg.InitialBackoff})
+	}
+}
+
+// enqueue queues job for the workers, which are started on first use. The
+// delivery fails when the queue is full. The registry must be locked.
+func (r *webhookRegistry) enqueue(job *webhookJob) {
+	if r.queue == nil {
+		cfg := r.cfg.withDefaults()
+		r.client = &http.Client{Timeout: cfg.Timeout}
+		r.queue = make(chan *webhookJob, cfg.QueueSize)
+		for range cfg.Workers {
+			go r.work(r.queue)
+		}
+	}
+
+	select {
+	case r.queue <- job:
+	default:
+		failDelivery(job.delivery, "delivery queue full")
+	}
+}
+
+func (r *webhookRegistry) work(queue chan *webhookJob) {
+	for job := range queue {
+		r.attempt(job)
+	}
+}
+
+// attempt posts the event of job. Failed attempts are queued again after
+// their backoff until the attempts are exhausted, or the subscription is
+// removed.
+func (r *webhookRegistry) attempt(job *webhookJob) {
+	if _, ok := r.get(job.sub.ID); !ok {
+		return
+	}
+
+	r.mu.Lock()
+	cfg := r.cfg.withDefaults()
+	client := r.client
+	r.mu.Unlock()
+
+	start := time.Now()
+	statusCode, err := postWebhook(client, job.sub, job.delivery.ID, job.payload, start)
+
+	result := webhookAttempt{Time: start, StatusCode: statusCode, Duration: time.Since(start).String()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	succeeded := err == nil && statusCode >= 200 && statusCode < 300
+	if succeeded || job.attempt >= cfg.MaxAttempts {
+		r.record(job.sub.ID, job.delivery, result, nil, succeeded)
+		return
+	}
+
+	next := time.Now().Add(job.backoff)
+	r.record(job.sub.ID, job.delivery, result, &next, false)
+
+	retry := *job
+	retry.attempt++
+	retry.backoff = min(2*job.backoff, cfg.MaxBackoff)
+	time.AfterFunc(job.backoff, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.enqueue(&retry)
+	})
+}
+
+// failDelivery ends delivery with an attempt which could not be made. The
+// registry must be locked.
+func failDelivery(delivery *webhookDelivery, reason string) {
+	delivery.Attempts = append(delivery.Attempts, webhookAttempt{Time: time.Now(), Error: reason, Duration: "0s"})
+	delivery.NextAttempt = nil
+	delivery.Status = deliveryFailed
+}
+
+func (r *webhookRegistry) record(subID string, delivery *webhookDelivery, result webhookAttempt, next *time.Time, succeeded bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delivery.Attempts = append(delivery.Attempts, result)
+	delivery.NextAttempt = next
+
+	switch {
+	case succeeded:
+		delivery.Status = deliverySucceeded
+	case next == nil:
+		delivery.Status = deliveryFailed
+	}
+}
+
+// postWebhook sends payload signed following the Standard Webhooks
+// specification.
+func postWebhook(client *http.Client, sub webhookSubscription, msgID string, payload []byte, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature, err := signWebhook(sub.Secret, msgID, timestamp, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", mediaTypeJSON)
+	req.Header.Set("Webhook-Id", msgID)
+	req.Header.Set("Webhook-Timestamp", timestamp)
+	req.Header.Set("Webhook-Signature", signature)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
+
+func signWebhook(secret, msgID, timestamp string, payload []byte) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, webhookSecretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook secret: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = fmt.Fprintf(mac, "%s.%s.", msgID, timestamp)
+	_, _ = mac.Write(payload)
+
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func newWebhookSecret() (string, error) {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return webhookSecretPrefix + base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (a *api) handleGetWebhooks(rw http.ResponseWriter, req *http.Request) {
+	subs := a.webhooks.list()
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+
+	writeJSONResponse(rw, http.StatusOK, subs)
+}
+
+func (a *api) handlePostWebhook(rw http.ResponseWriter, req *http.Request) {
+	var sub webhookSubscription
+	err := json.NewDecoder(req.Body).Decode(&sub)
+	if err != nil {
+		JSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	target, err := url.Parse(sub.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		JSONError(rw, http.StatusUnprocessableEntity, fmt.Sprintf("invalid webhook URL %q", sub.URL))
+		return
+	}
+
+	for _, typ := range sub.Events {
+		if typ != eventCreated && typ != eventUpdated && typ != eventDeleted {
+			JSONError(rw, http.StatusUnprocessableEntity, fmt.Sprintf("unknown event %q", typ))
+			return
+		}
+	}
+
+	if sub.Secret == "" {
+		sub.Secret, err = newWebhookSecret()
+		if err != nil {
+			JSONError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else if _, err = signWebhook(sub.Secret, "", "", nil); err != nil {
+		JSONError(rw, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	sub.ID = uuid.New().String()
+	sub.CreatedAt = time.Now().UTC()
+
+	a.webhooks.listening.Do(func() {
+		a.events.listen(a.webhooks.dispatch)
+	})
+	a.webhooks.add(&sub)
+
+	// The secret is only disclosed on creation.
+	writeJSONResponse(rw, http.StatusCreated, sub)
+}
+
+func (a *api) handleGetWebhook(rw http.ResponseWriter, req *http.Request) {
+	sub, ok := a.webhooks.get(chi.URLParam(req, "webhookId"))
+	if !ok {
+		JSONError(rw, http.StatusNotFound, "webhook not found")
+		return
+	}
+	sub.Secret = ""
+
+	writeJSONResponse(rw, http.StatusOK, sub)
+}
+
+func (a *api) handleDeleteWebhook(rw http.ResponseWriter, req *http.Request) {
+	a.webhooks.remove(chi.URLParam(req, "webhookId"))
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) handleGetWebhookDeliveries(rw http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "webhookId")
+	if _, ok := a.webhooks.get(id); !ok {
+		JSONError(rw, http.StatusNotFound, "webhook not found")
+		return
+	}
+
+	writeJSONResponse(rw, http.StatusOK, a.webhooks.deliveriesOf(id))
+}
+
+func writeJSONResponse(rw http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		JSONError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", mediaTypeJSON)
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
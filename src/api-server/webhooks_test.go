@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newWebhooksAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	_, srv := newTestServer(t, &config{Webhooks: webhooksConfig{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+	}})
+
+	return srv
+}
+
+func registerWebhook(t *testing.T, srv *httptest.Server, subscription string) webhookSubscription {
+	t.Helper()
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/_webhooks", "application/json", subscription)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var sub webhookSubscription
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sub))
+
+	return sub
+}
+
+func webhookDeliveries(t *testing.T, srv *httptest.Server, id string) []webhookDelivery {
+	t.Helper()
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/_webhooks/"+id+"/deliveries", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var deliveries []webhookDelivery
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&deliveries))
+
+	return deliveries
+}
+
+func Test_webhooks_delivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- req
+		bodies <- body
+	}))
+	t.Cleanup(receiver.Close)
+
+	srv := newWebhooksAPI(t)
+
+	sub := registerWebhook(t, srv, `{"url":"`+receiver.URL+`","collections":["weather"],"events":["deleted"]}`)
+	assert.NotEmpty(t, sub.ID)
+	assert.Regexp(t, `^whsec_`, sub.Secret)
+
+	doRequest(t, http.MethodPost, srv.URL+"/weather", "application/json", `{"city":"Lyon"}`)
+	doRequest(t, http.MethodDelete, srv.URL+"/weather/1", "", "")
+
+	var req *http.Request
+	select {
+	case req = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	body := <-bodies
+
+	var evt event
+	require.NoError(t, json.Unmarshal(body, &evt))
+	assert.Equal(t, "deleted", evt.Type)
+	assert.Equal(t, "1", evt.ObjectID)
+
+	signature, err := signWebhook(sub.Secret, req.Header.Get("Webhook-Id"), req.Header.Get("Webhook-Timestamp"), body)
+	require.NoError(t, err)
+	assert.Equal(t, signature, req.Header.Get("Webhook-Signature"))
+
+	assert.Eventually(t, func() bool {
+		deliveries := webhookDeliveries(t, srv, sub.ID)
+		return len(deliveries) == 1 && deliveries[0].Status == deliverySucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/_webhooks", "", "")
+	var subs []webhookSubscription
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&subs))
+	require.Len(t, subs, 1)
+	assert.Empty(t, subs[0].Secret, "secrets are only disclosed on creation")
+}
+
+func Test_webhooks_retry(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) < 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+
+	srv := newWebhooksAPI(t)
+
+	sub := registerWebhook(t, srv, `{"url":"`+receiver.URL+`"}`)
+	failingSub := registerWebhook(t, srv, `{"url":"`+failing.URL+`"}`)
+
+	doRequest(t, http.MethodDelete, srv.URL+"/weather/1", "", "")
+
+	assert.Eventually(t, func() bool {
+		deliveries := webhookDeliveries(t, srv, sub.ID)
+		return len(deliveries) == 1 && deliveries[0].Status == deliverySucceeded && len(deliveries[0].Attempts) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		deliveries := webhookDeliveries(t, srv, failingSub.ID)
+		return len(deliveries) == 1 && deliveries[0].Status == deliveryFailed && len(deliveries[0].Attempts) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_webhooks_queueFull(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(receiver.Close)
+	t.Cleanup(func() { close(release) })
+
+	_, srv := newTestServer(t, &config{Webhooks: webhooksConfig{MaxAttempts: 1, Workers: 1, QueueSize: 1}})
+
+	sub := registerWebhook(t, srv, `{"url":"`+receiver.URL+`"}`)
+
+	for _, id := range []string{"0", "1", "2"} {
+		doRequest(t, http.MethodDelete, srv.URL+"/weather/"+id, "", "")
+	}
+
+	deliveries := webhookDeliveries(t, srv, sub.ID)
+	require.Len(t, deliveries, 3)
+
+	last := deliveries[2]
+	assert.Equal(t, deliveryFailed, last.Status)
+	require.Len(t, last.Attempts, 1)
+	assert.Equal(t, "delivery queue full", last.Attempts[0].Error)
+}
+
+func Test_handlePostWebhook_invalid(t *testing.T) {
+	srv := newWebhooksAPI(t)
+
+	tests := []struct {
+		desc string
+		body string
+	}{
+		{desc: "invalid URL", body: `{"url":"ftp://example.com"}`},
+		{desc: "unknown event", body: `{"url":"http://example.com","events":["renamed"]}`},
+		{desc: "invalid secret", body: `{"url":"http://example.com","secret":"whsec_!!"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			resp := doRequest(t, http.MethodPost, srv.URL+"/_webhooks", "application/json", test.body)
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		})
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/_webhooks/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}